@@ -0,0 +1,315 @@
+package provider
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// progressInterval is how often the extraction progress is logged.
+const progressInterval = 10 * time.Second
+
+// UnsafePathError is returned when an archive entry would be written outside
+// of the extraction directory.
+type UnsafePathError string
+
+func (e UnsafePathError) Error() string {
+	return fmt.Sprintf("archive entry %q points outside of the target directory", string(e))
+}
+
+var (
+	magicGzip  = []byte{0x1f, 0x8b}
+	magicBzip2 = []byte("BZh")
+	magicXz    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	magicZstd  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// decompress detects the compression of the stream based on its magic bytes
+// and returns the decompressed stream. Streams without a known compression are
+// returned as is, which allows plain tar archives (like most Vagrant boxes).
+func decompress(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	// Peek returns an error if the stream is shorter than requested, the bytes
+	// read until then are still good enough to check for the magic.
+	header, _ := br.Peek(len(magicXz))
+
+	switch {
+	case bytes.HasPrefix(header, magicGzip):
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read gzip stream: %w", err)
+		}
+		return zr, nil
+	case bytes.HasPrefix(header, magicBzip2):
+		return io.NopCloser(bzip2.NewReader(br)), nil
+	case bytes.HasPrefix(header, magicXz):
+		xr, err := xz.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read xz stream: %w", err)
+		}
+		return io.NopCloser(xr), nil
+	case bytes.HasPrefix(header, magicZstd):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read zstd stream: %w", err)
+		}
+		return zr.IOReadCloser(), nil
+	default:
+		return io.NopCloser(br), nil
+	}
+}
+
+// extractArchive extracts the (optionally compressed) tar archive at path
+// into the dir directory.
+func extractArchive(ctx context.Context, path, dir string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return extractArchiveFrom(ctx, f, path, dir)
+}
+
+// extractArchiveFrom extracts the (optionally compressed) tar archive read
+// from src into the dir directory. The name is only used for logging.
+func extractArchiveFrom(ctx context.Context, src io.Reader, name, dir string) error {
+	r, err := decompress(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(r)
+	progress := &extractProgress{ctx: ctx, r: tr, image: name, last: time.Now()}
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("unable to read archive: %w", err)
+		}
+
+		target, err := archiveTarget(dir, hdr.Name)
+		if err != nil {
+			return err
+		}
+
+		tflog.Trace(ctx, "extracting archive entry", map[string]any{
+			"name": hdr.Name,
+			"size": hdr.Size,
+		})
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := mkdirAll(dir, target); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA: //nolint:staticcheck
+			if err := mkdirAll(dir, filepath.Dir(target)); err != nil {
+				return err
+			}
+			if _, err := extractFile(progress, target, hdr.FileInfo().Mode().Perm()); err != nil {
+				return fmt.Errorf("unable to extract %q: %w", hdr.Name, err)
+			}
+			progress.files++
+		case tar.TypeSymlink:
+			if err := mkdirAll(dir, filepath.Dir(target)); err != nil {
+				return err
+			}
+			if err := extractSymlink(dir, target, hdr.Linkname); err != nil {
+				return fmt.Errorf("unable to extract %q: %w", hdr.Name, err)
+			}
+		case tar.TypeLink:
+			source, err := archiveTarget(dir, hdr.Linkname)
+			if err != nil {
+				return err
+			}
+			if err := mkdirAll(dir, filepath.Dir(target)); err != nil {
+				return err
+			}
+			if err := os.Link(source, target); err != nil {
+				return fmt.Errorf("unable to extract %q: %w", hdr.Name, err)
+			}
+		default:
+			tflog.Debug(ctx, "skipping unsupported archive entry", map[string]any{
+				"name": hdr.Name,
+				"type": string(hdr.Typeflag),
+			})
+		}
+
+		progress.log()
+	}
+
+	tflog.Debug(ctx, "extracted image", map[string]any{
+		"image": name,
+		"files": progress.files,
+		"bytes": progress.bytes,
+	})
+	return nil
+}
+
+// extractProgress counts the bytes read from the entries of the archive r,
+// and logs the progress periodically, also while extracting large entries.
+// Reads fail once the context is done.
+type extractProgress struct {
+	ctx   context.Context
+	r     io.Reader
+	image string
+	files int64
+	bytes int64
+	last  time.Time
+}
+
+func (p *extractProgress) Read(b []byte) (int, error) {
+	if err := p.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := p.r.Read(b)
+	p.bytes += int64(n)
+	p.log()
+	return n, err
+}
+
+// log logs the progress unless it was logged within the progressInterval.
+func (p *extractProgress) log() {
+	if now := time.Now(); now.Sub(p.last) >= progressInterval {
+		p.last = now
+		tflog.Info(p.ctx, "extracting image", map[string]any{
+			"image": p.image,
+			"files": p.files,
+			"bytes": humanize.IBytes(uint64(p.bytes)),
+		})
+	}
+}
+
+// archiveTarget returns the path where the archive entry name is extracted to
+// inside of dir. Entries that would end up outside of dir are rejected.
+func archiveTarget(dir, name string) (string, error) {
+	if filepath.IsAbs(name) || strings.HasPrefix(name, "/") {
+		return "", UnsafePathError(name)
+	}
+	target := filepath.Join(dir, name)
+	if !withinDir(dir, target) {
+		return "", UnsafePathError(name)
+	}
+	return target, nil
+}
+
+// withinDir reports whether path is dir or inside of it. Both must be clean.
+func withinDir(dir, path string) bool {
+	return path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
+
+// mkdirAll creates the directory path inside of dir just like os.MkdirAll,
+// but refuses to follow symlinks, extracted by earlier entries, which resolve
+// outside of dir.
+func mkdirAll(dir, path string) error {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return err
+	}
+	if rel == "." {
+		return nil
+	}
+
+	current := dir
+	for _, elem := range strings.Split(rel, string(filepath.Separator)) {
+		current = filepath.Join(current, elem)
+		fi, err := os.Lstat(current)
+		switch {
+		case os.IsNotExist(err):
+			if err := os.Mkdir(current, 0750); err != nil {
+				return fmt.Errorf("unable to create directory: %w", err)
+			}
+			continue
+		case err != nil:
+			return err
+		}
+
+		if fi.Mode()&os.ModeSymlink != 0 {
+			real, err := filepath.EvalSymlinks(current)
+			if err != nil {
+				return err
+			}
+			if !withinDir(dir, real) {
+				return UnsafePathError(path)
+			}
+			if fi, err = os.Stat(real); err != nil {
+				return err
+			}
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("%q is not a directory", current)
+		}
+	}
+	return nil
+}
+
+func extractFile(r io.Reader, target string, perm os.FileMode) (int64, error) {
+	// Never write through an existing symlink, it might have been created by
+	// an earlier entry of the same archive.
+	if fi, err := os.Lstat(target); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		if err := os.Remove(target); err != nil {
+			return 0, err
+		}
+	}
+
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm|0600)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		return n, err
+	}
+	return n, f.Close()
+}
+
+// extractSymlink creates the symlink at target, as long as the link does not
+// point outside of dir.
+func extractSymlink(dir, target, link string) error {
+	if filepath.IsAbs(link) || strings.HasPrefix(link, "/") {
+		return UnsafePathError(link)
+	}
+	parent, err := filepath.EvalSymlinks(filepath.Dir(target))
+	if err != nil {
+		return err
+	}
+	if !withinDir(dir, filepath.Join(parent, link)) {
+		return UnsafePathError(link)
+	}
+	if err := os.RemoveAll(target); err != nil {
+		return err
+	}
+	return os.Symlink(link, target)
+}
@@ -0,0 +1,196 @@
+package provider
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	"github.com/hashicorp/terraform-plugin-log/tflogtest"
+)
+
+type tarEntry struct {
+	hdr  tar.Header
+	body string
+}
+
+// writeTar writes the entries as an uncompressed tar archive and returns its
+// path.
+func writeTar(t *testing.T, entries []tarEntry) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "archive.tar")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("unable to create archive: %v", err)
+	}
+	defer f.Close()
+
+	tw := tar.NewWriter(f)
+	for _, e := range entries {
+		hdr := e.hdr
+		if hdr.Mode == 0 {
+			hdr.Mode = 0644
+		}
+		hdr.Size = int64(len(e.body))
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatalf("unable to write header: %v", err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatalf("unable to write body: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("unable to close archive: %v", err)
+	}
+	return path
+}
+
+func TestExtractArchive(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks require elevated privileges on windows")
+	}
+
+	archive := writeTar(t, []tarEntry{
+		{hdr: tar.Header{Name: "box/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{hdr: tar.Header{Name: "box/disk.vmdk", Typeflag: tar.TypeReg}, body: "disk"},
+		{hdr: tar.Header{Name: "box/link.vmdk", Typeflag: tar.TypeSymlink, Linkname: "disk.vmdk"}},
+		{hdr: tar.Header{Name: "nested/dir/hard.vmdk", Typeflag: tar.TypeLink, Linkname: "box/disk.vmdk"}},
+	})
+
+	dir := t.TempDir()
+	if err := extractArchive(context.Background(), archive, dir); err != nil {
+		t.Fatalf("extractArchive() = %v", err)
+	}
+
+	for _, name := range []string{"box/disk.vmdk", "box/link.vmdk", "nested/dir/hard.vmdk"} {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Errorf("unable to read %s: %v", name, err)
+			continue
+		}
+		if string(b) != "disk" {
+			t.Errorf("%s = %q, want %q", name, b, "disk")
+		}
+	}
+
+	link, err := os.Readlink(filepath.Join(dir, "box", "link.vmdk"))
+	if err != nil {
+		t.Fatalf("unable to read link: %v", err)
+	}
+	if link != "disk.vmdk" {
+		t.Errorf("link = %q, want %q", link, "disk.vmdk")
+	}
+}
+
+func TestExtractArchive_unsafe(t *testing.T) {
+	testCases := map[string][]tarEntry{
+		"parent traversal": {
+			{hdr: tar.Header{Name: "../evil", Typeflag: tar.TypeReg}, body: "evil"},
+		},
+		"nested traversal": {
+			{hdr: tar.Header{Name: "box/../../evil", Typeflag: tar.TypeReg}, body: "evil"},
+		},
+		"absolute path": {
+			{hdr: tar.Header{Name: "/tmp/evil", Typeflag: tar.TypeReg}, body: "evil"},
+		},
+		"absolute symlink": {
+			{hdr: tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/etc"}},
+		},
+		"escaping symlink": {
+			{hdr: tar.Header{Name: "box/link", Typeflag: tar.TypeSymlink, Linkname: "../../etc"}},
+		},
+		"escaping hardlink": {
+			{hdr: tar.Header{Name: "link", Typeflag: tar.TypeLink, Linkname: "../evil"}},
+		},
+		"write through symlink": {
+			{hdr: tar.Header{Name: "self", Typeflag: tar.TypeSymlink, Linkname: "."}},
+			{hdr: tar.Header{Name: "self/escape", Typeflag: tar.TypeSymlink, Linkname: "self/../.."}},
+			{hdr: tar.Header{Name: "self/escape/evil", Typeflag: tar.TypeReg}, body: "evil"},
+		},
+	}
+
+	for name, entries := range testCases {
+		t.Run(name, func(t *testing.T) {
+			if runtime.GOOS == "windows" {
+				t.Skip("symlinks require elevated privileges on windows")
+			}
+
+			archive := writeTar(t, entries)
+			root := t.TempDir()
+			dir := filepath.Join(root, "gold")
+			if err := os.Mkdir(dir, 0750); err != nil {
+				t.Fatal(err)
+			}
+
+			var unsafe UnsafePathError
+			if err := extractArchive(context.Background(), archive, dir); !errors.As(err, &unsafe) {
+				t.Errorf("extractArchive() = %v, want UnsafePathError", err)
+			}
+			if _, err := os.Stat(filepath.Join(root, "evil")); err == nil {
+				t.Errorf("file was written outside of the target directory")
+			}
+		})
+	}
+}
+
+func TestExtractArchive_canceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := extractArchive(ctx, filepath.Join("testdata", "hello.tar.gz"), t.TempDir()); !errors.Is(err, context.Canceled) {
+		t.Errorf("extractArchive() = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestExtractProgress(t *testing.T) {
+	var out bytes.Buffer
+	ctx := tflogtest.RootLogger(context.Background(), &out)
+
+	// The first read within the entry is past due.
+	body := strings.Repeat("x", 1<<20)
+	p := &extractProgress{ctx: ctx, r: strings.NewReader(body), image: "image.box", last: time.Now().Add(-progressInterval)}
+	if _, err := p.Read(make([]byte, 64<<10)); err != nil {
+		t.Fatalf("Read() = %v", err)
+	}
+	if _, err := io.Copy(io.Discard, p); err != nil {
+		t.Fatalf("Copy() = %v", err)
+	}
+	if p.bytes != int64(len(body)) {
+		t.Errorf("bytes = %d, want %d", p.bytes, len(body))
+	}
+
+	entries, err := tflogtest.MultilineJSONDecode(&out)
+	if err != nil {
+		t.Fatalf("MultilineJSONDecode() = %v", err)
+	}
+	want := []map[string]any{{
+		"@level":   "info",
+		"@message": "extracting image",
+		"@module":  "provider",
+		"image":    "image.box",
+		"files":    float64(0),
+		"bytes":    "64 KiB",
+	}}
+	if diff := deep.Equal(entries, want); diff != nil {
+		t.Errorf("logged progress diff = %v", diff)
+	}
+}
+
+func TestExtractProgress_canceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &extractProgress{ctx: ctx, r: strings.NewReader("data"), last: time.Now()}
+	cancel()
+
+	if _, err := p.Read(make([]byte, 4)); !errors.Is(err, context.Canceled) {
+		t.Errorf("Read() = %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,288 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+	vbox "github.com/terra-farm/go-virtualbox"
+)
+
+// Clone modes of the gold disks.
+const (
+	cloneModeFull   = "full"
+	cloneModeLinked = "linked"
+)
+
+var cloneModes = []string{cloneModeFull, cloneModeLinked}
+
+// templateSnapshot is the snapshot of the template VM linked clones are based
+// on.
+const templateSnapshot = "base"
+
+// Extra data keys used to track linked clones. The template lists its clones,
+// each clone references its template and the gold image the template was
+// created from.
+const (
+	extraDataLinkedClones = "terraform-virtualbox/linked-clones"
+	extraDataTemplate     = "terraform-virtualbox/template"
+	extraDataGold         = "terraform-virtualbox/gold"
+)
+
+// templateName returns the name of the template VM of the gold image. The
+// image checksum is part of the name, so clones of a stale gold image keep
+// their template while new VMs get a new one. Clones inherit the storage
+// controllers of their template, so the name of templates with a storage
+// layout other than the default one also includes its fingerprint.
+func templateName(goldPath, imageSum string, layout storageLayout) string {
+	if len(imageSum) > 12 {
+		imageSum = imageSum[:12]
+	}
+	name := fmt.Sprintf("terraform-template-%s-%s", filepath.Base(goldPath), imageSum)
+	if !layout.isDefault() {
+		name += "-" + layout.fingerprint()[:8]
+	}
+	return name
+}
+
+// ensureTemplate returns the template VM of the gold image, creating it if
+// needed. The template gets the storage controllers of the layout, full
+// clones of the gold disks, converted to VDI so the disks of linked clones can
+// be resized, and a base snapshot. Templates without the base snapshot, left
+// behind by an interrupted run, are rebuilt. The gold image must be locked.
+func ensureTemplate(ctx context.Context, p *providerMeta, name, goldPath, ovfPath string, goldDisks []string, layout storageLayout) (*vbox.Machine, error) {
+	tpl, err := getMachine(ctx, p, name)
+	switch err {
+	case nil:
+		info, err := showVMInfo(ctx, p, tpl.UUID)
+		if err != nil {
+			return nil, err
+		}
+		if info.hasSnapshot(templateSnapshot) {
+			return tpl, nil
+		}
+		// Linked clones need the snapshot, so the template has none.
+		tflog.Warn(ctx, "rebuilding template without base snapshot", map[string]any{
+			"template": name,
+		})
+		if err := deleteMachine(ctx, p, tpl.UUID); err != nil {
+			return nil, fmt.Errorf("unable to delete incomplete template %s: %w", name, err)
+		}
+	case vbox.ErrMachineNotExist:
+	default:
+		return nil, fmt.Errorf("unable to get template %s: %w", name, err)
+	}
+
+	tflog.Info(ctx, "creating template for linked clones", map[string]any{
+		"template": name,
+		"gold":     goldPath,
+	})
+	if ovfPath != "" {
+		if err := importOVF(ctx, p, ovfPath, name, p.goldFolder); err != nil {
+			return nil, err
+		}
+		tpl, err = getMachine(ctx, p, name)
+	} else {
+		tpl, err = createMachine(ctx, p, name, p.goldFolder)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to create template %s: %w", name, err)
+	}
+
+	if disks, err := setUpTemplate(ctx, p, tpl, goldPath, goldDisks, layout); err != nil {
+		discardTemplate(ctx, p, tpl, disks)
+		return nil, err
+	}
+	return tpl, nil
+}
+
+// setUpTemplate clones the gold disks into the created template, attaches
+// them and takes the base snapshot. The cloned disks are returned on errors
+// too.
+func setUpTemplate(ctx context.Context, p *providerMeta, tpl *vbox.Machine, goldPath string, goldDisks []string, layout storageLayout) ([]string, error) {
+	disks := make([]string, 0, len(goldDisks))
+	for _, src := range goldDisks {
+		target, err := cloneTarget(goldPath, tpl.BaseFolder, src)
+		if err != nil {
+			return disks, err
+		}
+		target = vdiPath(target)
+		if _, _, err := p.run(ctx, "internalcommands", "sethduuid", src); err != nil {
+			return disks, fmt.Errorf("unable to set UUID: %w", err)
+		}
+		if _, stderr, err := p.run(ctx, "clonemedium", "disk", src, target, "--format", "VDI"); err != nil {
+			return disks, fmt.Errorf("unable to clone %s: %w: %s", src, err, stderr)
+		}
+		disks = append(disks, target)
+	}
+	if err := createStorageControllers(ctx, p, tpl.UUID, layout, disks); err != nil {
+		return disks, err
+	}
+
+	if _, stderr, err := p.run(ctx, "snapshot", tpl.UUID, "take", templateSnapshot); err != nil {
+		return disks, fmt.Errorf("unable to snapshot template %s: %w: %s", tpl.Name, err, stderr)
+	}
+	return disks, nil
+}
+
+// discardTemplate deletes the template which could not be set up, and the
+// disks cloned for it which were not attached yet. Errors are only logged,
+// as the setup error is reported.
+func discardTemplate(ctx context.Context, p *providerMeta, tpl *vbox.Machine, disks []string) {
+	tflog.Info(ctx, "deleting incomplete template", map[string]any{
+		"template": tpl.Name,
+	})
+	if err := deleteMachine(ctx, p, tpl.UUID); err != nil {
+		tflog.Warn(ctx, "unable to delete incomplete template", map[string]any{
+			"template": tpl.Name,
+			"error":    err.Error(),
+		})
+	}
+	for _, disk := range disks {
+		// Attached disks are deleted together with the template.
+		if _, err := os.Stat(disk); err != nil {
+			continue
+		}
+		if _, stderr, err := p.run(ctx, "closemedium", "disk", disk, "--delete"); err != nil {
+			tflog.Warn(ctx, "unable to delete disk of incomplete template", map[string]any{
+				"disk":   disk,
+				"error":  err.Error(),
+				"stderr": stderr,
+			})
+		}
+	}
+}
+
+// linkedClone creates the VM name as a linked clone of the base snapshot of
+// the template, and registers it with the template. The clone is deleted if
+// it can not be registered. The gold image must be locked.
+func linkedClone(ctx context.Context, p *providerMeta, tpl *vbox.Machine, name, folder, goldPath string) (*vbox.Machine, error) {
+	if _, stderr, err := p.run(ctx, "clonevm", tpl.UUID,
+		"--snapshot", templateSnapshot,
+		"--options", "link",
+		"--name", name,
+		"--basefolder", folder,
+		"--register",
+	); err != nil {
+		return nil, fmt.Errorf("unable to clone template %s: %w: %s", tpl.Name, err, stderr)
+	}
+	vm, err := registerLinkedClone(ctx, p, tpl, name, goldPath)
+	if err != nil {
+		if err := deleteMachine(ctx, p, name); err != nil {
+			tflog.Warn(ctx, "unable to delete unregistered linked clone", map[string]any{
+				"vm":    name,
+				"error": err.Error(),
+			})
+		}
+		return nil, err
+	}
+	return vm, nil
+}
+
+// registerLinkedClone records the template and gold image of the linked clone
+// name, and adds the clone to the clones of the template.
+func registerLinkedClone(ctx context.Context, p *providerMeta, tpl *vbox.Machine, name, goldPath string) (*vbox.Machine, error) {
+	vm, err := getMachine(ctx, p, name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get linked clone %s: %w", name, err)
+	}
+
+	if err := setExtraData(ctx, p, vm.UUID, extraDataTemplate, tpl.Name); err != nil {
+		return nil, fmt.Errorf("unable to set template of %s: %w", name, err)
+	}
+	if err := setExtraData(ctx, p, vm.UUID, extraDataGold, goldPath); err != nil {
+		return nil, fmt.Errorf("unable to set gold image of %s: %w", name, err)
+	}
+
+	clones, err := linkedClones(ctx, p, tpl)
+	if err != nil {
+		return nil, err
+	}
+	if err := setExtraData(ctx, p, tpl.UUID, extraDataLinkedClones, strings.Join(append(clones, vm.UUID), ",")); err != nil {
+		return nil, fmt.Errorf("unable to register linked clone with template %s: %w", tpl.Name, err)
+	}
+	return vm, nil
+}
+
+// linkedClones returns the UUIDs of the clones registered with the template.
+func linkedClones(ctx context.Context, p *providerMeta, tpl *vbox.Machine) ([]string, error) {
+	v, ok, err := getExtraData(ctx, p, tpl.UUID, extraDataLinkedClones)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get linked clones of template %s: %w", tpl.Name, err)
+	}
+	if !ok {
+		return nil, nil
+	}
+	return splitClones(v), nil
+}
+
+func splitClones(v string) []string {
+	var clones []string
+	for _, clone := range strings.Split(v, ",") {
+		if clone = strings.TrimSpace(clone); clone != "" {
+			clones = append(clones, clone)
+		}
+	}
+	return clones
+}
+
+// remainingClones returns the clones without the removed one and the clones
+// which no longer exist.
+func remainingClones(clones []string, removed string, exists func(string) bool) []string {
+	var remaining []string
+	for _, clone := range clones {
+		if clone != removed && exists(clone) {
+			remaining = append(remaining, clone)
+		}
+	}
+	return remaining
+}
+
+// releaseTemplate unregisters the deleted clone from the template and
+// deletes the template once it has no linked clones left.
+func releaseTemplate(ctx context.Context, p *providerMeta, templateName, goldPath, clone string) error {
+	lock, err := acquireLock(ctx, imageLockPath(goldPath), p.imageLockTimeout)
+	if err != nil {
+		return fmt.Errorf("unable to lock gold image %s: %w", goldPath, err)
+	}
+	defer func() {
+		if err := lock.Unlock(); err != nil {
+			tflog.Warn(ctx, "unable to unlock gold image", map[string]any{
+				"path":  goldPath,
+				"error": err.Error(),
+			})
+		}
+	}()
+
+	tpl, err := getMachine(ctx, p, templateName)
+	switch err {
+	case nil:
+	case vbox.ErrMachineNotExist:
+		return nil
+	default:
+		return fmt.Errorf("unable to get template %s: %w", templateName, err)
+	}
+
+	clones, err := linkedClones(ctx, p, tpl)
+	if err != nil {
+		return err
+	}
+	remaining := remainingClones(clones, clone, func(id string) bool {
+		_, err := getMachine(ctx, p, id)
+		return err != vbox.ErrMachineNotExist
+	})
+	if len(remaining) > 0 {
+		return setExtraData(ctx, p, tpl.UUID, extraDataLinkedClones, strings.Join(remaining, ","))
+	}
+
+	tflog.Info(ctx, "deleting template without linked clones", map[string]any{
+		"template": templateName,
+	})
+	if err := deleteMachine(ctx, p, tpl.UUID); err != nil {
+		return fmt.Errorf("unable to delete template %s: %w", templateName, err)
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-test/deep"
+	vbox "github.com/terra-farm/go-virtualbox"
+)
+
+func TestTemplateName(t *testing.T) {
+	gold := filepath.Join("gold", "ubuntu-bionic")
+	sum := "a213cfed68038b2dc6ac00e94bfb0b36"
+	defaultLayout := storageLayout{
+		Controllers:       []storageController{defaultStorageController},
+		DiskController:    "SATA",
+		OpticalController: "SATA",
+	}
+
+	got := templateName(gold, sum, defaultLayout)
+	if want := "terraform-template-ubuntu-bionic-a213cfed6803"; got != want {
+		t.Errorf("templateName() = %q, want %q", got, want)
+	}
+
+	nvme := storageLayout{
+		Controllers:       []storageController{{Name: "NVMe", Bus: "pcie", Chipset: "NVMe", Bootable: true}},
+		DiskController:    "NVMe",
+		OpticalController: "NVMe",
+	}
+	other := templateName(gold, sum, nvme)
+	if !strings.HasPrefix(other, got+"-") || other == got {
+		t.Errorf("templateName() = %q, want a suffix of the storage layout", other)
+	}
+}
+
+func TestSplitClones(t *testing.T) {
+	testCases := map[string]struct {
+		in   string
+		want []string
+	}{
+		"empty":    {in: "", want: nil},
+		"single":   {in: "a", want: []string{"a"}},
+		"multiple": {in: "a, b,,c", want: []string{"a", "b", "c"}},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			if diff := deep.Equal(splitClones(tc.in), tc.want); diff != nil {
+				t.Errorf("splitClones() diff = %v", diff)
+			}
+		})
+	}
+}
+
+func TestRemainingClones(t *testing.T) {
+	exists := func(id string) bool { return id != "gone" }
+
+	testCases := map[string]struct {
+		clones  []string
+		removed string
+		want    []string
+	}{
+		"last clone": {
+			clones:  []string{"a"},
+			removed: "a",
+			want:    nil,
+		},
+		"other clones": {
+			clones:  []string{"a", "b", "c"},
+			removed: "b",
+			want:    []string{"a", "c"},
+		},
+		"stale clones": {
+			clones:  []string{"a", "gone", "b"},
+			removed: "a",
+			want:    []string{"b"},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			got := remainingClones(tc.clones, tc.removed, exists)
+			if diff := deep.Equal(got, tc.want); diff != nil {
+				t.Errorf("remainingClones() diff = %v", diff)
+			}
+		})
+	}
+}
+
+// templateVBoxManage fakes VBoxManage for the template VM, the command named
+// fail fails.
+type templateVBoxManage struct {
+	folder     string
+	registered bool
+	snapshot   bool
+	fail       string
+	calls      []string
+}
+
+func (f *templateVBoxManage) run(ctx context.Context, args ...string) (string, string, error) {
+	if args[0] == "showvminfo" {
+		if !f.registered {
+			return "", "VBOX_E_OBJECT_NOT_FOUND: Could not find a registered machine", errors.New("exit status 1")
+		}
+		info := fmt.Sprintf("name=\"tpl\"\nUUID=\"tpl-uuid\"\nCfgFile=%q\nVMState=\"poweroff\"\n", filepath.Join(f.folder, "tpl.vbox"))
+		if f.snapshot {
+			info += "SnapshotName=\"base\"\nSnapshotUUID=\"snap-uuid\"\n"
+		}
+		return info, "", nil
+	}
+	f.calls = append(f.calls, strings.Join(args, " "))
+	if args[0] == f.fail {
+		return "", "failed", errors.New("exit status 1")
+	}
+	switch args[0] {
+	case "createvm":
+		f.registered = true
+	case "unregistervm":
+		f.registered, f.snapshot = false, false
+	case "snapshot":
+		f.snapshot = true
+	}
+	return "", "", nil
+}
+
+func TestEnsureTemplate(t *testing.T) {
+	gold := filepath.Join("gold", "ubuntu")
+	disk := filepath.Join(gold, "box-disk001.vmdk")
+
+	testCases := map[string]struct {
+		registered, snapshot bool
+		fail                 string
+		cloned               bool
+		wantCalls            []string
+		wantErr              bool
+	}{
+		"existing": {
+			registered: true,
+			snapshot:   true,
+		},
+		"create": {
+			wantCalls: []string{"createvm", "internalcommands", "clonemedium", "storagectl", "storageattach", "snapshot"},
+		},
+		"existing without snapshot": {
+			registered: true,
+			wantCalls:  []string{"unregistervm", "createvm", "internalcommands", "clonemedium", "storagectl", "storageattach", "snapshot"},
+		},
+		"clone fails": {
+			fail:      "clonemedium",
+			wantCalls: []string{"createvm", "internalcommands", "clonemedium", "unregistervm"},
+			wantErr:   true,
+		},
+		"storage controller fails": {
+			fail:      "storagectl",
+			cloned:    true,
+			wantCalls: []string{"createvm", "internalcommands", "clonemedium", "storagectl", "unregistervm", "closemedium"},
+			wantErr:   true,
+		},
+		"snapshot fails": {
+			fail:      "snapshot",
+			wantCalls: []string{"createvm", "internalcommands", "clonemedium", "storagectl", "storageattach", "snapshot", "unregistervm"},
+			wantErr:   true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			fake := &templateVBoxManage{folder: t.TempDir(), registered: tc.registered, snapshot: tc.snapshot, fail: tc.fail}
+			if tc.cloned {
+				if err := os.WriteFile(filepath.Join(fake.folder, "box-disk001.vdi"), nil, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			p := &providerMeta{run: fake.run}
+
+			_, err := ensureTemplate(context.Background(), p, "tpl", gold, "", []string{disk}, expandStorageLayout(fakeGet(nil)))
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("ensureTemplate() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			var commands []string
+			for _, call := range fake.calls {
+				commands = append(commands, strings.Fields(call)[0])
+			}
+			if diff := deep.Equal(commands, tc.wantCalls); diff != nil {
+				t.Errorf("VBoxManage commands diff = %v, calls %v", diff, fake.calls)
+			}
+			if tc.wantErr && fake.registered {
+				t.Error("incomplete template is still registered")
+			}
+		})
+	}
+}
+
+func TestLinkedClone_deleteUnregistered(t *testing.T) {
+	fake := &fakeVBoxManage{outputs: map[string]string{
+		"showvminfo": "name=\"vm\"\nUUID=\"vm-uuid\"\nCfgFile=\"/vms/vm/vm.vbox\"\n",
+	}}
+	run := func(ctx context.Context, args ...string) (string, string, error) {
+		stdout, _, _ := fake.run(ctx, args...)
+		if args[0] == "setextradata" {
+			return "", "failed", errors.New("exit status 1")
+		}
+		return stdout, "", nil
+	}
+	p := &providerMeta{run: run}
+
+	tpl := &vbox.Machine{Name: "tpl", UUID: "tpl-uuid"}
+	if _, err := linkedClone(context.Background(), p, tpl, "vm", "/vms", "/gold/ubuntu"); err == nil {
+		t.Fatal("linkedClone() succeeded")
+	}
+	want := []string{
+		"clonevm tpl-uuid --snapshot base --options link --name vm --basefolder /vms --register",
+		"setextradata vm-uuid terraform-virtualbox/template tpl",
+		"unregistervm vm --delete",
+	}
+	if diff := deep.Equal(fake.commands(), want); diff != nil {
+		t.Errorf("VBoxManage calls diff = %v", diff)
+	}
+}
@@ -0,0 +1,165 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+)
+
+const (
+	// seedFile is the name of the cloud-init seed image in the VM folder.
+	seedFile = "cidata.iso"
+	// seedLabel is the volume label the cloud-init NoCloud datasource looks
+	// for.
+	seedLabel = "cidata"
+)
+
+// cloudInitSeed is the content of a NoCloud seed image.
+type cloudInitSeed struct {
+	UserData      string
+	MetaData      string
+	NetworkConfig string
+}
+
+// expandCloudInitSeed returns the seed configured for the VM. The second
+// return value is false if the VM does not need a seed image.
+func expandCloudInitSeed(d *schema.ResourceData) (cloudInitSeed, bool) {
+	seed := cloudInitSeed{
+		UserData:      d.Get("user_data").(string),
+		MetaData:      d.Get("meta_data").(string),
+		NetworkConfig: d.Get("network_config").(string),
+	}
+	return seed, seed != cloudInitSeed{}
+}
+
+// files returns the files of the seed image. The meta-data defaults to the VM
+// UUID as instance-id and its name as hostname.
+func (s cloudInitSeed) files(instanceID, hostname string) []isoFile {
+	metaData := s.MetaData
+	if metaData == "" {
+		metaData = fmt.Sprintf("instance-id: %s\nlocal-hostname: %s\n", instanceID, hostname)
+	}
+	files := []isoFile{
+		{Name: "user-data", Data: []byte(s.UserData)},
+		{Name: "meta-data", Data: []byte(metaData)},
+	}
+	if s.NetworkConfig != "" {
+		files = append(files, isoFile{Name: "network-config", Data: []byte(s.NetworkConfig)})
+	}
+	return files
+}
+
+// writeSeed writes the seed image to path, replacing it atomically.
+func writeSeed(path string, files []isoFile) error {
+	var buf bytes.Buffer
+	if err := writeISO(&buf, seedLabel, files, time.Now()); err != nil {
+		return fmt.Errorf("unable to build seed image: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	// VirtualBox reads the image right after it is attached.
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// attachSeed writes the seed image into the VM folder and attaches it as a DVD
+// to the first free slot of the storage controller.
+func attachSeed(ctx context.Context, p *providerMeta, vmID, name, folder, controller string, seed cloudInitSeed) error {
+	path := filepath.Join(folder, seedFile)
+	if err := writeSeed(path, seed.files(vmID, name)); err != nil {
+		return err
+	}
+
+	info, err := showVMInfo(ctx, p, vmID)
+	if err != nil {
+		return err
+	}
+	slot, err := info.freeSlot(controller)
+	if err != nil {
+		return err
+	}
+	if err := ensurePort(ctx, p, info, vmID, controller, slot.Port); err != nil {
+		return err
+	}
+
+	tflog.Debug(ctx, "attaching cloud-init seed image", map[string]any{
+		"path":   path,
+		"port":   slot.Port,
+		"device": slot.Device,
+	})
+	if _, stderr, err := p.run(ctx, "storageattach", vmID,
+		"--storagectl", slot.Controller,
+		"--port", strconv.Itoa(slot.Port),
+		"--device", strconv.Itoa(slot.Device),
+		"--type", "dvddrive",
+		"--medium", path,
+	); err != nil {
+		return fmt.Errorf("unable to attach seed image %s: %w: %s", path, err, stderr)
+	}
+	return nil
+}
+
+// detachSeed detaches the seed image from the VM and deletes it. VMs without
+// a seed image are left alone.
+func detachSeed(ctx context.Context, p *providerMeta, vmID, folder string) error {
+	path := filepath.Join(folder, seedFile)
+	info, err := showVMInfo(ctx, p, vmID)
+	if err != nil {
+		return err
+	}
+	slot, ok := info.attachment(path)
+	if !ok {
+		return nil
+	}
+
+	if _, stderr, err := p.run(ctx, "storageattach", vmID,
+		"--storagectl", slot.Controller,
+		"--port", strconv.Itoa(slot.Port),
+		"--device", strconv.Itoa(slot.Device),
+		"--medium", "none",
+	); err != nil {
+		return fmt.Errorf("unable to detach seed image %s: %w: %s", path, err, stderr)
+	}
+	// Forget the image, so the new one is not mistaken for the cached old
+	// one.
+	if _, stderr, err := p.run(ctx, "closemedium", "dvd", path); err != nil {
+		return fmt.Errorf("unable to close seed image %s: %w: %s", path, err, stderr)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// updateSeed replaces the seed image of the powered off VM after a change of
+// the cloud-init attributes.
+func updateSeed(ctx context.Context, p *providerMeta, vmID, name, folder, controller string, seed cloudInitSeed, wanted bool) error {
+	if err := detachSeed(ctx, p, vmID, folder); err != nil {
+		return err
+	}
+	if !wanted {
+		return nil
+	}
+	return attachSeed(ctx, p, vmID, name, folder, controller, seed)
+}
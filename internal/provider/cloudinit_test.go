@@ -0,0 +1,82 @@
+package provider
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+func TestCloudInitSeedFiles(t *testing.T) {
+	testCases := map[string]struct {
+		seed cloudInitSeed
+		want []isoFile
+	}{
+		"default meta data": {
+			seed: cloudInitSeed{UserData: "#cloud-config\n"},
+			want: []isoFile{
+				{Name: "user-data", Data: []byte("#cloud-config\n")},
+				{Name: "meta-data", Data: []byte("instance-id: uuid\nlocal-hostname: vm\n")},
+			},
+		},
+		"all files": {
+			seed: cloudInitSeed{MetaData: "instance-id: 1\n", NetworkConfig: "version: 2\n"},
+			want: []isoFile{
+				{Name: "user-data", Data: []byte{}},
+				{Name: "meta-data", Data: []byte("instance-id: 1\n")},
+				{Name: "network-config", Data: []byte("version: 2\n")},
+			},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			if diff := deep.Equal(tc.seed.files("uuid", "vm"), tc.want); diff != nil {
+				t.Errorf("files() diff = %v", diff)
+			}
+		})
+	}
+}
+
+func TestUpdateSeed(t *testing.T) {
+	folder := t.TempDir()
+	path := filepath.Join(folder, seedFile)
+	if err := os.WriteFile(path, []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	fake := &fakeVBoxManage{outputs: map[string]string{"showvminfo": `storagecontrollername0="SATA"
+storagecontrollerportcount0="2"
+"SATA-0-0"="/vms/vm/box-disk001.vmdk"
+"SATA-1-0"="` + path + `"
+"SATA-ImageUUID-1-0"="0b4c1ba6-29e5-4e5b-9b8a-7b2a5a4f6d37"
+`}}
+	p := &providerMeta{run: fake.run}
+
+	seed := cloudInitSeed{UserData: "#cloud-config\n"}
+	if err := updateSeed(context.Background(), p, "uuid", "vm", folder, "SATA", seed, true); err != nil {
+		t.Fatalf("updateSeed() = %v", err)
+	}
+
+	// The fake VM info still reports the old image on port 1, so the new one
+	// goes to the next port.
+	want := []string{
+		"storageattach uuid --storagectl SATA --port 1 --device 0 --medium none",
+		"closemedium dvd " + path,
+		"storagectl uuid --name SATA --portcount 3",
+		"storageattach uuid --storagectl SATA --port 2 --device 0 --type dvddrive --medium " + path,
+	}
+	if diff := deep.Equal(fake.commands(), want); diff != nil {
+		t.Errorf("VBoxManage calls diff = %v", diff)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("seed image not written: %v", err)
+	}
+	if len(b) == 0 || len(b)%isoSectorSize != 0 {
+		t.Errorf("seed image has %d bytes", len(b))
+	}
+}
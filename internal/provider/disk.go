@@ -0,0 +1,485 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	humanize "github.com/dustin/go-humanize"
+	"github.com/hashicorp/go-cty/cty"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/validation"
+)
+
+// Formats and variants of the data disks, as accepted by
+// "VBoxManage createmedium".
+var (
+	diskFormats  = []string{"vdi", "vmdk", "vhd"}
+	diskVariants = []string{"Standard", "Fixed"}
+)
+
+// defaultDiskController is the storage controller the gold disks are
+// attached to.
+const defaultDiskController = "SATA"
+
+// diskSchema is the schema of the disk blocks of the virtualbox_vm resource.
+func diskSchema() *schema.Schema {
+	return &schema.Schema{
+		Type:        schema.TypeList,
+		Optional:    true,
+		Description: "Empty data disks attached after the disks of the image",
+		Elem: &schema.Resource{
+			Schema: map[string]*schema.Schema{
+				"size": {
+					Type:             schema.TypeString,
+					Required:         true,
+					Description:      "Size of the disk, e.g. 20gib",
+					ValidateDiagFunc: validateSize,
+					DiffSuppressFunc: suppressEquivalentSize,
+				},
+
+				"format": {
+					Type:             schema.TypeString,
+					Optional:         true,
+					Default:          "vdi",
+					Description:      "Disk format, one of vdi, vmdk, vhd",
+					ValidateDiagFunc: validation.ToDiagFunc(validation.StringInSlice(diskFormats, false)),
+				},
+
+				"variant": {
+					Type:             schema.TypeString,
+					Optional:         true,
+					Default:          "Standard",
+					Description:      "Standard for a dynamically allocated disk, Fixed for a preallocated one",
+					ValidateDiagFunc: validation.ToDiagFunc(validation.StringInSlice(diskVariants, false)),
+				},
+
+				"controller": {
+					Type:        schema.TypeString,
+					Optional:    true,
+					Computed:    true,
+					Description: "Name of the storage controller the disk is attached to, defaults to disk_controller",
+				},
+
+				"port": {
+					Type:             schema.TypeInt,
+					Required:         true,
+					Description:      "Port of the storage controller the disk is attached to",
+					ValidateDiagFunc: validation.ToDiagFunc(validation.IntAtLeast(0)),
+				},
+
+				"device": {
+					Type:             schema.TypeInt,
+					Optional:         true,
+					Description:      "Device of the port the disk is attached to, 1 for the slave of an IDE port",
+					ValidateDiagFunc: validation.ToDiagFunc(validation.IntBetween(0, 1)),
+				},
+
+				"path": {
+					Type:        schema.TypeString,
+					Computed:    true,
+					Description: "Path of the disk file",
+				},
+			},
+		},
+	}
+}
+
+// validateSize validates human readable sizes like "20gib".
+func validateSize(v any, path cty.Path) diag.Diagnostics {
+	if _, err := humanize.ParseBytes(v.(string)); err != nil {
+		return diag.Diagnostics{{
+			Severity:      diag.Error,
+			Summary:       "Invalid size",
+			Detail:        fmt.Sprintf("%q is not a valid size: %v", v, err),
+			AttributePath: path,
+		}}
+	}
+	return nil
+}
+
+// dataDisk is an empty disk created for the VM.
+type dataDisk struct {
+	Size       string
+	Format     string
+	Variant    string
+	Controller string
+	Port       int
+	Device     int
+	Path       string
+}
+
+// key identifies the attachment of the disk.
+func (disk dataDisk) key() string {
+	return disk.Controller + "-" + strconv.Itoa(disk.Port) + "-" + strconv.Itoa(disk.Device)
+}
+
+// validateDataDiskChanges rejects changes of the disks which stay at their
+// slot and can not be applied without losing their data. Disks can only grow,
+// and only in a format which can be resized.
+func validateDataDiskChanges(old, wanted []dataDisk) error {
+	current := make(map[string]dataDisk, len(old))
+	for _, disk := range old {
+		current[disk.key()] = disk
+	}
+	for _, disk := range wanted {
+		cur, ok := current[disk.key()]
+		if !ok {
+			continue
+		}
+		slot := fmt.Sprintf("disk at device %d of port %d of storage controller %q", disk.Device, disk.Port, disk.Controller)
+		if cur.Format != disk.Format || cur.Variant != disk.Variant {
+			return fmt.Errorf("the format and variant of the %s can not change, remove the disk to replace it", slot)
+		}
+		o, err := sizeMiB(cur.Size)
+		if err != nil {
+			continue
+		}
+		n, err := sizeMiB(disk.Size)
+		if err != nil {
+			continue
+		}
+		switch {
+		case n < o:
+			return fmt.Errorf("the %s can not shrink from %s to %s", slot, cur.Size, disk.Size)
+		case n > o && !resizable("disk."+disk.Format):
+			return fmt.Errorf("the %s can not grow, %s disks can not be resized", slot, disk.Format)
+		}
+	}
+	return nil
+}
+
+// expandDataDisks returns the configured data disks, the ones without a
+// controller are attached to controller.
+func expandDataDisks(v []any, controller string) []dataDisk {
+	disks := make([]dataDisk, 0, len(v))
+	for _, raw := range v {
+		m := raw.(map[string]any)
+		disk := dataDisk{
+			Size:       m["size"].(string),
+			Format:     m["format"].(string),
+			Variant:    m["variant"].(string),
+			Controller: m["controller"].(string),
+			Port:       m["port"].(int),
+			Device:     m["device"].(int),
+			Path:       m["path"].(string),
+		}
+		if disk.Controller == "" {
+			disk.Controller = controller
+		}
+		disks = append(disks, disk)
+	}
+	return disks
+}
+
+func flattenDataDisks(disks []dataDisk) []any {
+	v := make([]any, 0, len(disks))
+	for _, disk := range disks {
+		v = append(v, map[string]any{
+			"size":       disk.Size,
+			"format":     disk.Format,
+			"variant":    disk.Variant,
+			"controller": disk.Controller,
+			"port":       disk.Port,
+			"device":     disk.Device,
+			"path":       disk.Path,
+		})
+	}
+	return v
+}
+
+// dataDiskPath returns the path of the disk file in the VM folder.
+func dataDiskPath(folder string, disk dataDisk) string {
+	if disk.Device != 0 {
+		return filepath.Join(folder, fmt.Sprintf("disk-%s-%d-%d.%s", disk.Controller, disk.Port, disk.Device, disk.Format))
+	}
+	return filepath.Join(folder, fmt.Sprintf("disk-%s-%d.%s", disk.Controller, disk.Port, disk.Format))
+}
+
+// createDataDisk creates the medium of disk in folder and attaches it to the
+// VM, which must be powered off. The disk is returned with its path set.
+func createDataDisk(ctx context.Context, p *providerMeta, vmID, folder string, disk dataDisk) (dataDisk, error) {
+	size, err := humanize.ParseBytes(disk.Size)
+	if err != nil {
+		return disk, fmt.Errorf("invalid disk size %q: %w", disk.Size, err)
+	}
+
+	info, err := showVMInfo(ctx, p, vmID)
+	if err != nil {
+		return disk, err
+	}
+	if medium := info.medium(disk.Controller, disk.Port, disk.Device); medium != "" {
+		return disk, fmt.Errorf("device %d of port %d of storage controller %q is already used by %s",
+			disk.Device, disk.Port, disk.Controller, medium)
+	}
+	if err := ensurePort(ctx, p, info, vmID, disk.Controller, disk.Port); err != nil {
+		return disk, err
+	}
+
+	disk.Path = dataDiskPath(folder, disk)
+	tflog.Debug(ctx, "creating data disk", map[string]any{
+		"path":    disk.Path,
+		"size":    size,
+		"variant": disk.Variant,
+	})
+	if _, stderr, err := p.run(ctx, "createmedium", "disk",
+		"--filename", disk.Path,
+		"--size", strconv.FormatUint(size/humanize.MiByte, 10),
+		"--format", strings.ToUpper(disk.Format),
+		"--variant", disk.Variant,
+	); err != nil {
+		return disk, fmt.Errorf("unable to create disk %s: %w: %s", disk.Path, err, stderr)
+	}
+
+	if _, stderr, err := p.run(ctx, "storageattach", vmID,
+		"--storagectl", disk.Controller,
+		"--port", strconv.Itoa(disk.Port),
+		"--device", strconv.Itoa(disk.Device),
+		"--type", "hdd",
+		"--medium", disk.Path,
+	); err != nil {
+		return disk, fmt.Errorf("unable to attach disk %s: %w: %s", disk.Path, err, stderr)
+	}
+	return disk, nil
+}
+
+// removeDataDisk detaches disk from the VM, which must be powered off, and
+// deletes its medium.
+func removeDataDisk(ctx context.Context, p *providerMeta, vmID string, disk dataDisk) error {
+	tflog.Debug(ctx, "removing data disk", map[string]any{
+		"path": disk.Path,
+	})
+	if _, stderr, err := p.run(ctx, "storageattach", vmID,
+		"--storagectl", disk.Controller,
+		"--port", strconv.Itoa(disk.Port),
+		"--device", strconv.Itoa(disk.Device),
+		"--medium", "none",
+	); err != nil {
+		return fmt.Errorf("unable to detach disk %s: %w: %s", disk.Path, err, stderr)
+	}
+	if disk.Path == "" {
+		return nil
+	}
+	if _, stderr, err := p.run(ctx, "closemedium", "disk", disk.Path, "--delete"); err != nil {
+		return fmt.Errorf("unable to delete disk %s: %w: %s", disk.Path, err, stderr)
+	}
+	return nil
+}
+
+// updateDataDisks removes the disks of old which are gone in wanted, grows
+// the ones whose size increased and creates the ones which are new. The
+// resulting disks are returned in the order of wanted.
+func updateDataDisks(ctx context.Context, p *providerMeta, vmID, folder string, old, wanted []dataDisk) ([]dataDisk, error) {
+	seen := make(map[string]bool, len(wanted))
+	for _, disk := range wanted {
+		if seen[disk.key()] {
+			return nil, fmt.Errorf("device %d of port %d of storage controller %q is used by multiple disks",
+				disk.Device, disk.Port, disk.Controller)
+		}
+		seen[disk.key()] = true
+	}
+	if err := validateDataDiskChanges(old, wanted); err != nil {
+		return nil, err
+	}
+
+	current := make(map[string]dataDisk, len(old))
+	for _, disk := range old {
+		current[disk.key()] = disk
+	}
+	for _, disk := range old {
+		if seen[disk.key()] {
+			continue
+		}
+		if err := removeDataDisk(ctx, p, vmID, disk); err != nil {
+			return nil, err
+		}
+	}
+
+	result := make([]dataDisk, 0, len(wanted))
+	for _, disk := range wanted {
+		cur, ok := current[disk.key()]
+		if !ok {
+			created, err := createDataDisk(ctx, p, vmID, folder, disk)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, created)
+			continue
+		}
+
+		if !suppressEquivalentSize("size", cur.Size, disk.Size, nil) {
+			size, err := humanize.ParseBytes(disk.Size)
+			if err != nil {
+				return nil, fmt.Errorf("invalid disk size %q: %w", disk.Size, err)
+			}
+			if err := resizeDisk(ctx, p, cur.Path, size); err != nil {
+				return nil, err
+			}
+			cur.Size = disk.Size
+		}
+		result = append(result, cur)
+	}
+	return result, nil
+}
+
+// Properties of the disks reported by "VBoxManage showmediuminfo".
+var (
+	reMediumCapacity = regexp.MustCompile(`(?m)^Capacity:\s+(\d+) MBytes`)
+	reMediumFormat   = regexp.MustCompile(`(?m)^Storage format:\s+(\S+)`)
+	reMediumVariant  = regexp.MustCompile(`(?m)^Format variant:\s+(.+)$`)
+)
+
+// sizeMiB returns the size in MiB, rounded up the same way as disks are
+// created and resized.
+func sizeMiB(size string) (uint64, error) {
+	bytes, err := humanize.ParseBytes(size)
+	if err != nil {
+		return 0, err
+	}
+	return (bytes + humanize.MiByte - 1) / humanize.MiByte, nil
+}
+
+// suppressEquivalentSize suppresses the diff of sizes which are written
+// differently but result in the same disk, e.g. "10gib" and "10240mib".
+func suppressEquivalentSize(k, old, new string, d *schema.ResourceData) bool {
+	o, err := sizeMiB(old)
+	if err != nil {
+		return false
+	}
+	n, err := sizeMiB(new)
+	if err != nil {
+		return false
+	}
+	return o == n
+}
+
+// formatSize formats a size in MiB, which is exact for the capacity of disks.
+func formatSize(bytes uint64) string {
+	return fmt.Sprintf("%dmib", bytes/humanize.MiByte)
+}
+
+// showMediumInfo returns the output of "VBoxManage showmediuminfo" for the
+// disk at path.
+func showMediumInfo(ctx context.Context, p *providerMeta, path string) (string, error) {
+	stdout, stderr, err := p.run(ctx, "showmediuminfo", "disk", path)
+	if err != nil {
+		return "", fmt.Errorf("unable to get medium info of %s: %w: %s", path, err, stderr)
+	}
+	return stdout, nil
+}
+
+// mediumCapacity returns the capacity of the disk at path in bytes.
+func mediumCapacity(ctx context.Context, p *providerMeta, path string) (uint64, error) {
+	stdout, err := showMediumInfo(ctx, p, path)
+	if err != nil {
+		return 0, err
+	}
+	return parseMediumCapacity(path, stdout)
+}
+
+// parseMediumCapacity returns the capacity in bytes from the medium info of
+// the disk at path.
+func parseMediumCapacity(path, stdout string) (uint64, error) {
+	m := reMediumCapacity.FindStringSubmatch(stdout)
+	if m == nil {
+		return 0, fmt.Errorf("unable to find the capacity of %s", path)
+	}
+	mib, err := strconv.ParseUint(m[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid capacity of %s: %w", path, err)
+	}
+	return mib * humanize.MiByte, nil
+}
+
+// resizable reports whether VirtualBox can resize the disk at path, which is
+// only supported for the VDI and VHD formats.
+func resizable(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".vdi", ".vhd":
+		return true
+	default:
+		return false
+	}
+}
+
+// vdiPath returns path with the extension replaced by .vdi.
+func vdiPath(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + ".vdi"
+}
+
+// resizeDisk grows the disk at path to size bytes. Disks can not shrink.
+func resizeDisk(ctx context.Context, p *providerMeta, path string, size uint64) error {
+	capacity, err := mediumCapacity(ctx, p, path)
+	if err != nil {
+		return err
+	}
+	// Disks are sized in whole MiB.
+	mib := (size + humanize.MiByte - 1) / humanize.MiByte
+	capacityMiB := capacity / humanize.MiByte
+	switch {
+	case mib == capacityMiB:
+		return nil
+	case mib < capacityMiB:
+		return fmt.Errorf("disk %s can not shrink from %s to %s", path, formatSize(capacity), formatSize(mib*humanize.MiByte))
+	}
+
+	tflog.Debug(ctx, "resizing disk", map[string]any{
+		"path": path,
+		"from": capacity,
+		"to":   size,
+	})
+	if _, stderr, err := p.run(ctx, "modifymedium", "disk", path, "--resize", strconv.FormatUint(mib, 10)); err != nil {
+		return fmt.Errorf("unable to resize disk %s: %w: %s", path, err, stderr)
+	}
+	return nil
+}
+
+// primaryDisk returns the slot of the primary disk, which is the first disk
+// of the image. The VM boots from it.
+func (layout storageLayout) primaryDisk() storageSlot {
+	return storageSlot{Controller: layout.DiskController}
+}
+
+// growPrimaryDisk grows the disk at slot of the powered off VM to size bytes.
+// Disks in a format which can not be resized are converted to VDI first.
+func growPrimaryDisk(ctx context.Context, p *providerMeta, vmID string, slot storageSlot, size uint64) error {
+	info, err := showVMInfo(ctx, p, vmID)
+	if err != nil {
+		return err
+	}
+	path := info.medium(slot.Controller, slot.Port, slot.Device)
+	if path == "" {
+		return fmt.Errorf("VM %s has no primary disk", vmID)
+	}
+
+	if !resizable(path) {
+		converted := vdiPath(path)
+		tflog.Debug(ctx, "converting disk to VDI", map[string]any{
+			"from": path,
+			"to":   converted,
+		})
+		if _, stderr, err := p.run(ctx, "clonemedium", "disk", path, converted, "--format", "VDI"); err != nil {
+			return fmt.Errorf("unable to convert disk %s: %w: %s", path, err, stderr)
+		}
+		if _, stderr, err := p.run(ctx, "storageattach", vmID,
+			"--storagectl", slot.Controller,
+			"--port", strconv.Itoa(slot.Port),
+			"--device", strconv.Itoa(slot.Device),
+			"--type", "hdd",
+			"--medium", converted,
+		); err != nil {
+			return fmt.Errorf("unable to attach disk %s: %w: %s", converted, err, stderr)
+		}
+		if _, stderr, err := p.run(ctx, "closemedium", "disk", path, "--delete"); err != nil {
+			return fmt.Errorf("unable to delete disk %s: %w: %s", path, err, stderr)
+		}
+		path = converted
+	}
+
+	return resizeDisk(ctx, p, path, size)
+}
@@ -0,0 +1,295 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	humanize "github.com/dustin/go-humanize"
+	"github.com/go-test/deep"
+)
+
+// fakeVBoxManage records the VBoxManage calls and answers them from outputs,
+// keyed by the subcommand.
+type fakeVBoxManage struct {
+	calls   []string
+	outputs map[string]string
+}
+
+func (f *fakeVBoxManage) run(ctx context.Context, args ...string) (string, string, error) {
+	f.calls = append(f.calls, strings.Join(args, " "))
+	return f.outputs[args[0]], "", nil
+}
+
+// commands returns the recorded calls except for the showvminfo queries.
+func (f *fakeVBoxManage) commands() []string {
+	var calls []string
+	for _, call := range f.calls {
+		if !strings.HasPrefix(call, "showvminfo ") {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+const sataVMInfo = `name="vm"
+storagecontrollername0="SATA"
+storagecontrollertype0="IntelAhci"
+storagecontrollerportcount0="3"
+"SATA-0-0"="/vms/vm/box-disk001.vmdk"
+"SATA-1-0"="none"
+"SATA-2-0"="/vms/vm/disk-SATA-2.vdi"
+`
+
+func TestUpdateDataDisks(t *testing.T) {
+	folder := filepath.Join("vms", "vm")
+	kept := dataDisk{Size: "1gib", Format: "vdi", Variant: "Standard", Controller: "SATA", Port: 2,
+		Path: filepath.Join(folder, "disk-SATA-2.vdi")}
+	removed := dataDisk{Size: "1gib", Format: "vdi", Variant: "Standard", Controller: "SATA", Port: 3,
+		Path: filepath.Join(folder, "disk-SATA-3.vdi")}
+	added := dataDisk{Size: "20gib", Format: "vmdk", Variant: "Fixed", Controller: "SATA", Port: 4}
+
+	testCases := map[string]struct {
+		old, wanted []dataDisk
+		want        []dataDisk
+		wantCalls   []string
+		wantErr     bool
+	}{
+		"create": {
+			wanted: []dataDisk{added},
+			want: []dataDisk{{Size: "20gib", Format: "vmdk", Variant: "Fixed", Controller: "SATA", Port: 4,
+				Path: filepath.Join(folder, "disk-SATA-4.vmdk")}},
+			wantCalls: []string{
+				"storagectl vm --name SATA --portcount 5",
+				"createmedium disk --filename " + filepath.Join(folder, "disk-SATA-4.vmdk") +
+					" --size 20480 --format VMDK --variant Fixed",
+				"storageattach vm --storagectl SATA --port 4 --device 0 --type hdd --medium " +
+					filepath.Join(folder, "disk-SATA-4.vmdk"),
+			},
+		},
+		"keep and remove": {
+			old:    []dataDisk{kept, removed},
+			wanted: []dataDisk{{Size: "1gib", Format: "vdi", Variant: "Standard", Controller: "SATA", Port: 2}},
+			want:   []dataDisk{kept},
+			wantCalls: []string{
+				"storageattach vm --storagectl SATA --port 3 --device 0 --medium none",
+				"closemedium disk " + removed.Path + " --delete",
+			},
+		},
+		"keep imported": {
+			old:    []dataDisk{{Size: "1.0 gib", Format: "vdi", Variant: "Standard", Controller: "SATA", Port: 2, Path: kept.Path}},
+			wanted: []dataDisk{{Size: "1gib", Format: "vdi", Variant: "Standard", Controller: "SATA", Port: 2}},
+			want:   []dataDisk{{Size: "1.0 gib", Format: "vdi", Variant: "Standard", Controller: "SATA", Port: 2, Path: kept.Path}},
+		},
+		"grow": {
+			old:    []dataDisk{kept},
+			wanted: []dataDisk{{Size: "2gib", Format: "vdi", Variant: "Standard", Controller: "SATA", Port: 2}},
+			want:   []dataDisk{{Size: "2gib", Format: "vdi", Variant: "Standard", Controller: "SATA", Port: 2, Path: kept.Path}},
+			wantCalls: []string{
+				"showmediuminfo disk " + kept.Path,
+				"modifymedium disk " + kept.Path + " --resize 2048",
+			},
+		},
+		"shrink": {
+			old:     []dataDisk{kept},
+			wanted:  []dataDisk{{Size: "512mib", Format: "vdi", Variant: "Standard", Controller: "SATA", Port: 2}},
+			wantErr: true,
+		},
+		"change format": {
+			old:     []dataDisk{kept},
+			wanted:  []dataDisk{{Size: "1gib", Format: "vmdk", Variant: "Standard", Controller: "SATA", Port: 2}},
+			wantErr: true,
+		},
+		"change variant": {
+			old:     []dataDisk{kept},
+			wanted:  []dataDisk{{Size: "1gib", Format: "vdi", Variant: "Fixed", Controller: "SATA", Port: 2}},
+			wantErr: true,
+		},
+		"port in use": {
+			wanted:  []dataDisk{{Size: "1gib", Format: "vdi", Variant: "Standard", Controller: "SATA", Port: 0}},
+			wantErr: true,
+		},
+		"unknown controller": {
+			wanted:  []dataDisk{{Size: "1gib", Format: "vdi", Variant: "Standard", Controller: "NVMe", Port: 0}},
+			wantErr: true,
+		},
+		"duplicate port": {
+			wanted:  []dataDisk{added, added},
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			fake := &fakeVBoxManage{outputs: map[string]string{
+				"showvminfo":     sataVMInfo,
+				"showmediuminfo": "Capacity:       1024 MBytes\n",
+			}}
+			p := &providerMeta{run: fake.run}
+
+			got, err := updateDataDisks(context.Background(), p, "vm", folder, tc.old, tc.wanted)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("updateDataDisks() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if tc.wantErr {
+				return
+			}
+			if diff := deep.Equal(got, tc.want); diff != nil {
+				t.Errorf("updateDataDisks() diff = %v", diff)
+			}
+			if diff := deep.Equal(fake.commands(), tc.wantCalls); diff != nil {
+				t.Errorf("VBoxManage calls diff = %v", diff)
+			}
+		})
+	}
+}
+
+func TestParseVMInfo(t *testing.T) {
+	info := parseVMInfo(sataVMInfo)
+
+	if ctl, ok := info.storageController("SATA"); !ok || ctl.Ports != 3 {
+		t.Errorf("storageController(SATA) = %+v, %v", ctl, ok)
+	}
+	if _, ok := info.storageController("IDE"); ok {
+		t.Error("storageController(IDE) found a controller")
+	}
+	if got := info.medium("SATA", 0, 0); got != "/vms/vm/box-disk001.vmdk" {
+		t.Errorf("medium(SATA, 0, 0) = %q", got)
+	}
+	if got := info.medium("SATA", 1, 0); got != "" {
+		t.Errorf("medium(SATA, 1, 0) = %q, want empty", got)
+	}
+}
+
+const mediumInfo = `UUID:           0b4c1ba6-29e5-4e5b-9b8a-7b2a5a4f6d37
+Parent UUID:    base
+State:          created
+Type:           normal (base)
+Location:       /vms/vm/box-disk001.vdi
+Storage format: VDI
+Format variant: dynamic default
+Capacity:       10240 MBytes
+Size on disk:   1024 MBytes
+`
+
+func TestResizeDisk(t *testing.T) {
+	testCases := map[string]struct {
+		size      uint64
+		wantCalls []string
+		wantErr   bool
+	}{
+		"grow": {
+			size:      20 << 30,
+			wantCalls: []string{"modifymedium disk disk.vdi --resize 20480"},
+		},
+		"same size": {
+			size: 10 << 30,
+		},
+		"round up": {
+			size:      10<<30 + 1,
+			wantCalls: []string{"modifymedium disk disk.vdi --resize 10241"},
+		},
+		"shrink": {
+			size:    5 << 30,
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			fake := &fakeVBoxManage{outputs: map[string]string{"showmediuminfo": mediumInfo}}
+			p := &providerMeta{run: fake.run}
+
+			err := resizeDisk(context.Background(), p, "disk.vdi", tc.size)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("resizeDisk() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			var calls []string
+			for _, call := range fake.calls {
+				if !strings.HasPrefix(call, "showmediuminfo ") {
+					calls = append(calls, call)
+				}
+			}
+			if diff := deep.Equal(calls, tc.wantCalls); diff != nil {
+				t.Errorf("VBoxManage calls diff = %v", diff)
+			}
+		})
+	}
+}
+
+func TestGrowPrimaryDisk_convert(t *testing.T) {
+	fake := &fakeVBoxManage{outputs: map[string]string{
+		"showvminfo":     sataVMInfo,
+		"showmediuminfo": mediumInfo,
+	}}
+	p := &providerMeta{run: fake.run}
+
+	if err := growPrimaryDisk(context.Background(), p, "vm", storageSlot{Controller: "SATA"}, 20<<30); err != nil {
+		t.Fatalf("growPrimaryDisk() = %v", err)
+	}
+
+	want := []string{
+		"clonemedium disk /vms/vm/box-disk001.vmdk /vms/vm/box-disk001.vdi --format VDI",
+		"storageattach vm --storagectl SATA --port 0 --device 0 --type hdd --medium /vms/vm/box-disk001.vdi",
+		"closemedium disk /vms/vm/box-disk001.vmdk --delete",
+		"showmediuminfo disk /vms/vm/box-disk001.vdi",
+		"modifymedium disk /vms/vm/box-disk001.vdi --resize 20480",
+	}
+	if diff := deep.Equal(fake.commands(), want); diff != nil {
+		t.Errorf("VBoxManage calls diff = %v", diff)
+	}
+}
+
+func TestSuppressEquivalentSize(t *testing.T) {
+	testCases := []struct {
+		old, new string
+		want     bool
+	}{
+		{"10 gib", "10gib", true},
+		{"10 gib", "10240MiB", true},
+		{"10 gib", "20gib", false},
+		{"", "20gib", false},
+		{"95368mib", "100gb", true},
+		{"9.8 gib", "10000mib", false},
+	}
+	for _, tc := range testCases {
+		if got := suppressEquivalentSize("disk_size", tc.old, tc.new, nil); got != tc.want {
+			t.Errorf("suppressEquivalentSize(%q, %q) = %v, want %v", tc.old, tc.new, got, tc.want)
+		}
+	}
+}
+
+func TestDiskSizeRoundTrip(t *testing.T) {
+	for _, size := range []string{"100gb", "10000mib", "20.5gib", "20gib"} {
+		t.Run(size, func(t *testing.T) {
+			fake := &fakeVBoxManage{outputs: map[string]string{"showmediuminfo": "Capacity:       1024 MBytes\n"}}
+			p := &providerMeta{run: fake.run}
+			bytes, err := humanize.ParseBytes(size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := resizeDisk(context.Background(), p, "disk.vdi", bytes); err != nil {
+				t.Fatalf("resizeDisk() = %v", err)
+			}
+
+			// Read back the capacity the disk was resized to.
+			calls := fake.commands()
+			var mib uint64
+			if _, err := fmt.Sscanf(calls[len(calls)-1], "modifymedium disk disk.vdi --resize %d", &mib); err != nil {
+				t.Fatalf("unexpected VBoxManage calls %v", calls)
+			}
+			capacity := mib * humanize.MiByte
+			read := formatSize(capacity)
+			if !suppressEquivalentSize("disk_size", read, size, nil) {
+				t.Errorf("disk_size read back as %q differs from %q", read, size)
+			}
+
+			fake.outputs["showmediuminfo"] = fmt.Sprintf("Capacity:       %d MBytes\n", mib)
+			if err := resizeDisk(context.Background(), p, "disk.vdi", bytes); err != nil {
+				t.Errorf("resizeDisk() again = %v", err)
+			}
+		})
+	}
+}
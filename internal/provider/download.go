@@ -0,0 +1,572 @@
+package provider
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+	"github.com/hashicorp/go-cleanhttp"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+)
+
+// cacheEntry is the metadata stored next to every cached image, used to
+// revalidate it with the server.
+type cacheEntry struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+const (
+	// defaultDownloadAttempts is how often a download is attempted before
+	// giving up.
+	defaultDownloadAttempts = 5
+	// defaultDownloadBackoff is the wait before the first retry, it doubles
+	// with every further retry.
+	defaultDownloadBackoff = 2 * time.Second
+	// maxDownloadBackoff caps the wait between retries.
+	maxDownloadBackoff = time.Minute
+	// defaultDownloadIdleTimeout is how long a download may not receive any
+	// data before the attempt is aborted.
+	defaultDownloadIdleTimeout = 2 * time.Minute
+)
+
+// downloadSettings configure how the remote images are downloaded.
+type downloadSettings struct {
+	Username           string
+	Password           string
+	BearerToken        string
+	Headers            map[string]string
+	CABundle           string
+	InsecureSkipVerify bool
+	ProxyURL           string
+}
+
+// downloadSchema is the schema of the image_download block, which is shared
+// by the provider and the virtualbox_vm resource.
+func downloadSchema() *schema.Schema {
+	return &schema.Schema{
+		Type:        schema.TypeList,
+		Optional:    true,
+		MaxItems:    1,
+		Description: "Settings used when downloading remote images",
+		Elem: &schema.Resource{
+			Schema: map[string]*schema.Schema{
+				"username": {
+					Type:        schema.TypeString,
+					Optional:    true,
+					Description: "Username for HTTP basic authentication",
+				},
+
+				"password": {
+					Type:        schema.TypeString,
+					Optional:    true,
+					Sensitive:   true,
+					Description: "Password for HTTP basic authentication",
+				},
+
+				"bearer_token": {
+					Type:        schema.TypeString,
+					Optional:    true,
+					Sensitive:   true,
+					Description: "Token sent in the Authorization header as a bearer token",
+				},
+
+				"headers": {
+					Type:        schema.TypeMap,
+					Optional:    true,
+					Elem:        &schema.Schema{Type: schema.TypeString},
+					Description: "Additional headers sent with every request",
+				},
+
+				"ca_bundle": {
+					Type:        schema.TypeString,
+					Optional:    true,
+					Description: "Path to a PEM encoded bundle of CA certificates trusted in addition to the system ones",
+				},
+
+				"insecure_skip_verify": {
+					Type:        schema.TypeBool,
+					Optional:    true,
+					Default:     false,
+					Description: "Do not verify the TLS certificate of the server",
+				},
+
+				"proxy_url": {
+					Type:        schema.TypeString,
+					Optional:    true,
+					Description: "Proxy used for the downloads, the proxy environment variables are used when not set",
+				},
+			},
+		},
+	}
+}
+
+// expandDownloadSettings converts the image_download block into
+// downloadSettings.
+func expandDownloadSettings(v []any) downloadSettings {
+	var s downloadSettings
+	if len(v) == 0 || v[0] == nil {
+		return s
+	}
+	m := v[0].(map[string]any)
+	s.Username = m["username"].(string)
+	s.Password = m["password"].(string)
+	s.BearerToken = m["bearer_token"].(string)
+	s.CABundle = m["ca_bundle"].(string)
+	s.InsecureSkipVerify = m["insecure_skip_verify"].(bool)
+	s.ProxyURL = m["proxy_url"].(string)
+	if headers, ok := m["headers"].(map[string]any); ok && len(headers) > 0 {
+		s.Headers = make(map[string]string, len(headers))
+		for k, v := range headers {
+			s.Headers[k] = v.(string)
+		}
+	}
+	return s
+}
+
+// merge returns the settings overridden by the ones set in o. Headers are
+// merged, with the ones in o taking precedence.
+func (s downloadSettings) merge(o downloadSettings) downloadSettings {
+	if o.Username != "" || o.Password != "" {
+		s.Username, s.Password = o.Username, o.Password
+	}
+	if o.BearerToken != "" {
+		s.BearerToken = o.BearerToken
+	}
+	if o.CABundle != "" {
+		s.CABundle = o.CABundle
+	}
+	if o.InsecureSkipVerify {
+		s.InsecureSkipVerify = true
+	}
+	if o.ProxyURL != "" {
+		s.ProxyURL = o.ProxyURL
+	}
+	if len(o.Headers) > 0 {
+		headers := make(map[string]string, len(s.Headers)+len(o.Headers))
+		for k, v := range s.Headers {
+			headers[k] = v
+		}
+		for k, v := range o.Headers {
+			headers[k] = v
+		}
+		s.Headers = headers
+	}
+	return s
+}
+
+// customTransport reports whether the settings require their own transport,
+// instead of the shared default one.
+func (s downloadSettings) customTransport() bool {
+	return s.CABundle != "" || s.InsecureSkipVerify || s.ProxyURL != ""
+}
+
+// transport returns the HTTP transport for the TLS and proxy settings.
+func (s downloadSettings) transport() (*http.Transport, error) {
+	transport := cleanhttp.DefaultPooledTransport()
+
+	if s.CABundle != "" || s.InsecureSkipVerify {
+		tlsConfig := &tls.Config{
+			MinVersion:         tls.VersionTLS12,
+			InsecureSkipVerify: s.InsecureSkipVerify, // #nosec G402
+		}
+		if s.CABundle != "" {
+			pem, err := os.ReadFile(s.CABundle)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read CA bundle: %w", err)
+			}
+			pool, err := x509.SystemCertPool()
+			if err != nil || pool == nil {
+				pool = x509.NewCertPool()
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in CA bundle %s", s.CABundle)
+			}
+			tlsConfig.RootCAs = pool
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	if s.ProxyURL != "" {
+		proxy, err := url.Parse(s.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	return transport, nil
+}
+
+// apply adds the authentication and the custom headers to the request.
+func (s downloadSettings) apply(req *http.Request) {
+	for k, v := range s.Headers {
+		req.Header.Set(k, v)
+	}
+	switch {
+	case s.BearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+s.BearerToken)
+	case s.Username != "" || s.Password != "":
+		req.SetBasicAuth(s.Username, s.Password)
+	}
+}
+
+// imageCache stores downloaded images so they are reused by every VM created
+// from the same image.
+type imageCache struct {
+	// folder where the images are stored.
+	folder string
+	// client used for downloading the images.
+	client *http.Client
+	// settings are applied to every download request.
+	settings downloadSettings
+	// attempts is how often a download is attempted.
+	attempts int
+	// backoff is the wait before the first retry.
+	backoff time.Duration
+	// idleTimeout aborts attempts which do not receive any data.
+	idleTimeout time.Duration
+}
+
+// cachePath returns the path of the image downloaded from u in the cache. The
+// path is keyed by the URL and the checksum, so images with the same file name
+// do not overwrite each other and a changed checksum results in a new download.
+func (c *imageCache) cachePath(u *url.URL, checksum string) string {
+	key := sha256.Sum256([]byte(u.String() + "\n" + checksum))
+	name := path.Base(u.Path)
+	if name == "." || name == "/" {
+		name = "image"
+	}
+	return filepath.Join(c.folder, fmt.Sprintf("%x-%s", key[:8], name))
+}
+
+// fetchIfRemote returns the local path of the image. Remote images are
+// downloaded into the cache, unless a cached copy is still valid. The checksum
+// is optional, when set a cached copy matching it is used without asking the
+// server.
+func fetchIfRemote(ctx context.Context, p *providerMeta, u *url.URL, checksum, checksumType string, settings downloadSettings) (string, error) {
+	// If the schema is empty, treat it as a local path, otherwise
+	// use it as a remote.
+	if u.Scheme == "" {
+		return u.Path, nil
+	}
+
+	// TODO: Add special handing for other schemes, such as
+	//		 s3, gcs, (s)ftp(s).
+	// We want to quit if the scheme is not currently supported.
+	switch u.Scheme {
+	case "http", "https":
+		break
+	default:
+		return "", fmt.Errorf("unsupported scheme %s", u.Scheme)
+	}
+
+	c, err := p.imageCache(settings)
+	if err != nil {
+		return "", err
+	}
+	return c.fetch(ctx, u, checksum, checksumType, p.imageLockTimeout)
+}
+
+// fetch downloads the image from u into the cache, or revalidates an already
+// cached copy. Concurrent fetches of the same image are serialized with a file
+// lock.
+func (c *imageCache) fetch(ctx context.Context, u *url.URL, checksum, checksumType string, lockTimeout time.Duration) (string, error) {
+	if err := os.MkdirAll(c.folder, 0740); err != nil {
+		return "", fmt.Errorf("unable to create cache folder: %w", err)
+	}
+
+	file := c.cachePath(u, checksum)
+	lock, err := acquireLock(ctx, file+".lock", lockTimeout)
+	if err != nil {
+		return "", err
+	}
+	defer lock.Unlock() //nolint:errcheck
+
+	var entry cacheEntry
+	cached := false
+	if _, err := os.Stat(file); err == nil {
+		if b, err := os.ReadFile(file + ".json"); err == nil {
+			cached = json.Unmarshal(b, &entry) == nil
+		}
+	}
+
+	if cached && checksum != "" {
+		// The checksum pins the content, so there is no need to ask the server
+		// as long as the cached copy still matches it.
+		if err := verifyImageFile(ctx, file, checksum, checksumType); err == nil {
+			tflog.Debug(ctx, "using cached image", map[string]any{
+				"url":  u.String(),
+				"path": file,
+			})
+			return file, nil
+		}
+		cached = false
+	}
+
+	var validate *cacheEntry
+	if cached {
+		validate = &entry
+	}
+	notModified, err := c.download(ctx, u, file, validate)
+	if err != nil {
+		return "", fmt.Errorf("unable to download %s: %w", u, err)
+	}
+	if notModified {
+		tflog.Debug(ctx, "cached image is up to date", map[string]any{
+			"url":  u.String(),
+			"path": file,
+		})
+	}
+	return file, nil
+}
+
+// permanentError is a download error which is not worth retrying.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// download downloads u into file, retrying failed attempts with an exponential
+// backoff. The data is written to file+".part" first, which is resumed by
+// later attempts (or later Terraform runs) as long as the server supports
+// range requests and the remote file did not change. If cached is set, the
+// request is conditional and download reports whether the cached file is
+// still up to date instead of downloading it again.
+func (c *imageCache) download(ctx context.Context, u *url.URL, file string, cached *cacheEntry) (bool, error) {
+	part := file + ".part"
+
+	var lastErr error
+	for attempt := 0; attempt < c.attempts; attempt++ {
+		if attempt > 0 {
+			wait := c.backoff << (attempt - 1)
+			if wait > maxDownloadBackoff {
+				wait = maxDownloadBackoff
+			}
+			tflog.Warn(ctx, "retrying image download", map[string]any{
+				"url":     u.String(),
+				"attempt": attempt + 1,
+				"wait":    wait.String(),
+				"error":   lastErr.Error(),
+			})
+			select {
+			case <-ctx.Done():
+				return false, ctx.Err()
+			case <-time.After(wait):
+			}
+		}
+
+		notModified, err := c.downloadOnce(ctx, u, part, cached)
+		if err == nil {
+			if notModified {
+				return true, nil
+			}
+			if err := os.Rename(part, file); err != nil {
+				return false, err
+			}
+			return false, os.Rename(part+".json", file+".json")
+		}
+
+		var perm *permanentError
+		if errors.As(err, &perm) || ctx.Err() != nil {
+			return false, err
+		}
+		lastErr = err
+	}
+	return false, fmt.Errorf("giving up after %d attempts: %w", c.attempts, lastErr)
+}
+
+// downloadOnce makes a single attempt to download u into part, resuming
+// already downloaded data.
+func (c *imageCache) downloadOnce(ctx context.Context, u *url.URL, part string, cached *cacheEntry) (bool, error) {
+	// The request is canceled if the server stops sending data, so a stalled
+	// connection is retried instead of hanging forever.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	idle := time.AfterFunc(c.idleTimeout, cancel)
+	defer idle.Stop()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return false, &permanentError{err}
+	}
+	c.settings.apply(req)
+
+	var offset int64
+	var partEntry cacheEntry
+	if fi, err := os.Stat(part); err == nil && fi.Size() > 0 {
+		if b, err := os.ReadFile(part + ".json"); err == nil && json.Unmarshal(b, &partEntry) == nil {
+			// Only resume if it is possible to make sure that the remote file
+			// did not change in the meantime.
+			validator := partEntry.ETag
+			if validator == "" {
+				validator = partEntry.LastModified
+			}
+			if validator != "" && partEntry.URL == u.String() {
+				offset = fi.Size()
+				req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+				req.Header.Set("If-Range", validator)
+			}
+		}
+	}
+	if offset == 0 && cached != nil {
+		if cached.ETag != "" {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		if isCertificateError(err) {
+			return false, &permanentError{err}
+		}
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cached != nil:
+		return true, nil
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		var start int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start); err != nil || start != offset {
+			return false, fmt.Errorf("unexpected Content-Range %q", resp.Header.Get("Content-Range"))
+		}
+		flags |= os.O_APPEND
+		tflog.Info(ctx, "resuming image download", map[string]any{
+			"url":    u.String(),
+			"offset": offset,
+		})
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		// The partial download does not match the remote file, start over.
+		if err := os.Remove(part); err != nil {
+			return false, &permanentError{err}
+		}
+		return false, fmt.Errorf("unable to resume download: %s", resp.Status)
+	case resp.StatusCode >= 200 && resp.StatusCode <= 299:
+		// The server ignored the range, or the remote file changed.
+		offset = 0
+		flags |= os.O_TRUNC
+		partEntry = cacheEntry{
+			URL:          u.String(),
+			ETag:         resp.Header.Get("ETag"),
+			LastModified: resp.Header.Get("Last-Modified"),
+		}
+		b, err := json.Marshal(partEntry)
+		if err != nil {
+			return false, &permanentError{err}
+		}
+		if err := os.WriteFile(part+".json", b, 0640); err != nil {
+			return false, &permanentError{fmt.Errorf("unable to write cache metadata: %w", err)}
+		}
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return false, &permanentError{fmt.Errorf("access denied, check the image_download credentials: %s", resp.Status)}
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return false, fmt.Errorf("unexpected response: %s", resp.Status)
+	default:
+		return false, &permanentError{fmt.Errorf("unexpected response: %s", resp.Status)}
+	}
+
+	f, err := os.OpenFile(part, flags, 0640)
+	if err != nil {
+		return false, &permanentError{err}
+	}
+
+	total := int64(-1)
+	if resp.ContentLength >= 0 {
+		total = offset + resp.ContentLength
+	}
+	progress := &downloadProgress{
+		ctx:     ctx,
+		url:     u.String(),
+		total:   total,
+		written: offset,
+		start:   time.Now(),
+		resumed: offset,
+		onWrite: func() { idle.Reset(c.idleTimeout) },
+	}
+	progress.last = progress.start
+	if _, err := io.Copy(io.MultiWriter(f, progress), resp.Body); err != nil {
+		f.Close()
+		return false, err
+	}
+	if err := f.Close(); err != nil {
+		return false, &permanentError{err}
+	}
+	if total >= 0 && progress.written != total {
+		return false, fmt.Errorf("download incomplete, got %d of %d bytes", progress.written, total)
+	}
+
+	tflog.Debug(ctx, "downloaded image", map[string]any{
+		"url":   u.String(),
+		"bytes": progress.written,
+	})
+	return false, nil
+}
+
+// isCertificateError reports whether the error is caused by an untrusted or
+// invalid certificate, which does not go away by retrying.
+func isCertificateError(err error) bool {
+	var (
+		unknownAuthority x509.UnknownAuthorityError
+		invalid          x509.CertificateInvalidError
+		hostname         x509.HostnameError
+	)
+	return errors.As(err, &unknownAuthority) || errors.As(err, &invalid) || errors.As(err, &hostname)
+}
+
+// downloadProgress logs the progress of a download periodically.
+type downloadProgress struct {
+	ctx     context.Context
+	url     string
+	total   int64
+	written int64
+	resumed int64
+	start   time.Time
+	last    time.Time
+	onWrite func()
+}
+
+func (p *downloadProgress) Write(b []byte) (int, error) {
+	p.written += int64(len(b))
+	p.onWrite()
+
+	if now := time.Now(); now.Sub(p.last) >= progressInterval {
+		p.last = now
+		rate := float64(p.written-p.resumed) / now.Sub(p.start).Seconds()
+		fields := map[string]any{
+			"url":   p.url,
+			"bytes": humanize.IBytes(uint64(p.written)),
+			"rate":  humanize.IBytes(uint64(rate)) + "/s",
+		}
+		if p.total > 0 {
+			fields["total"] = humanize.IBytes(uint64(p.total))
+			if rate > 0 {
+				eta := time.Duration(float64(p.total-p.written)/rate) * time.Second
+				fields["eta"] = eta.String()
+			}
+		}
+		tflog.Info(p.ctx, "downloading image", fields)
+	}
+	return len(b), nil
+}
@@ -0,0 +1,338 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+)
+
+const helloTarGzSHA256 = "a213cfed68038b2dc6ac00e94bfb0b3659f6db8a04b6ad6a877a08f08c27604d"
+
+// newImageServer serves testdata/hello.tar.gz with an ETag on every path and
+// counts the requests and full downloads.
+func newImageServer(t *testing.T) (*httptest.Server, *int32, *int32) {
+	t.Helper()
+
+	body, err := os.ReadFile("testdata/hello.tar.gz")
+	if err != nil {
+		t.Fatalf("unable to read test image: %v", err)
+	}
+
+	var requests, downloads int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.URL.Path == "/missing/virtualbox.box" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("ETag", `"hello"`)
+		if r.Header.Get("If-None-Match") == `"hello"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		atomic.AddInt32(&downloads, 1)
+		_, _ = w.Write(body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests, &downloads
+}
+
+func newTestMeta(t *testing.T) *providerMeta {
+	t.Helper()
+	return &providerMeta{
+		cacheFolder:      t.TempDir(),
+		imageLockTimeout: time.Second,
+		httpClient:       http.DefaultClient,
+	}
+}
+
+func mustParseURL(t *testing.T, s string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(s)
+	if err != nil {
+		t.Fatalf("url.Parse(%q) = %v", s, err)
+	}
+	return u
+}
+
+func TestFetchIfRemote_local(t *testing.T) {
+	got, err := fetchIfRemote(context.Background(), newTestMeta(t), mustParseURL(t, "testdata/hello.tar.gz"), "", "", downloadSettings{})
+	if err != nil {
+		t.Fatalf("fetchIfRemote() = %v", err)
+	}
+	if got != "testdata/hello.tar.gz" {
+		t.Errorf("fetchIfRemote() = %q, want %q", got, "testdata/hello.tar.gz")
+	}
+}
+
+func TestFetchIfRemote_revalidate(t *testing.T) {
+	srv, requests, downloads := newImageServer(t)
+	p := newTestMeta(t)
+	u := mustParseURL(t, srv.URL+"/a/virtualbox.box")
+
+	first, err := fetchIfRemote(context.Background(), p, u, "", "", downloadSettings{})
+	if err != nil {
+		t.Fatalf("fetchIfRemote() = %v", err)
+	}
+	second, err := fetchIfRemote(context.Background(), p, u, "", "", downloadSettings{})
+	if err != nil {
+		t.Fatalf("fetchIfRemote() = %v", err)
+	}
+
+	if first != second {
+		t.Errorf("cached path changed from %q to %q", first, second)
+	}
+	if *requests != 2 || *downloads != 1 {
+		t.Errorf("got %d requests and %d downloads, want 2 and 1", *requests, *downloads)
+	}
+	if err := verifyImageFile(context.Background(), second, helloTarGzSHA256, "sha256"); err != nil {
+		t.Errorf("cached image is corrupt: %v", err)
+	}
+
+	other, err := fetchIfRemote(context.Background(), p, mustParseURL(t, srv.URL+"/b/virtualbox.box"), "", "", downloadSettings{})
+	if err != nil {
+		t.Fatalf("fetchIfRemote() = %v", err)
+	}
+	if other == first {
+		t.Errorf("images with the same file name share the cache path %q", other)
+	}
+}
+
+func TestFetchIfRemote_checksum(t *testing.T) {
+	srv, requests, _ := newImageServer(t)
+	p := newTestMeta(t)
+	u := mustParseURL(t, srv.URL+"/a/virtualbox.box")
+
+	for i := 0; i < 2; i++ {
+		if _, err := fetchIfRemote(context.Background(), p, u, "sha256:"+helloTarGzSHA256, "", downloadSettings{}); err != nil {
+			t.Fatalf("fetchIfRemote() = %v", err)
+		}
+	}
+	if *requests != 1 {
+		t.Errorf("got %d requests, want the checksum pinned image to be reused without asking", *requests)
+	}
+}
+
+func TestFetchIfRemote_notFound(t *testing.T) {
+	srv, _, _ := newImageServer(t)
+
+	if _, err := fetchIfRemote(context.Background(), newTestMeta(t), mustParseURL(t, srv.URL+"/missing/virtualbox.box"), "", "", downloadSettings{}); err == nil {
+		t.Errorf("fetchIfRemote() of a missing image succeeded")
+	}
+}
+
+func newTestImageCache(t *testing.T) *imageCache {
+	t.Helper()
+	return &imageCache{
+		folder:      t.TempDir(),
+		client:      http.DefaultClient,
+		attempts:    3,
+		backoff:     time.Millisecond,
+		idleTimeout: time.Second,
+	}
+}
+
+func TestImageCacheFetch_resume(t *testing.T) {
+	body, err := os.ReadFile("testdata/hello.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var requests int32
+	var ranges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		w.Header().Set("ETag", `"hello"`)
+		if atomic.AddInt32(&requests, 1) == 1 {
+			// Send only half of the image and drop the connection.
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			_, _ = w.Write(body[:len(body)/2])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		http.ServeContent(w, r, "virtualbox.box", time.Time{}, bytes.NewReader(body))
+	}))
+	defer srv.Close()
+
+	c := newTestImageCache(t)
+	file, err := c.fetch(context.Background(), mustParseURL(t, srv.URL+"/virtualbox.box"), "", "", time.Second)
+	if err != nil {
+		t.Fatalf("fetch() = %v", err)
+	}
+
+	if err := verifyImageFile(context.Background(), file, helloTarGzSHA256, "sha256"); err != nil {
+		t.Errorf("resumed image is corrupt: %v", err)
+	}
+	want := []string{"", fmt.Sprintf("bytes=%d-", len(body)/2)}
+	if diff := deep.Equal(ranges, want); diff != nil {
+		t.Errorf("requested ranges diff = %v", diff)
+	}
+	if _, err := os.Stat(file + ".part"); !os.IsNotExist(err) {
+		t.Errorf("partial download was left behind: %v", err)
+	}
+}
+
+func TestImageCacheFetch_retry(t *testing.T) {
+	testCases := map[string]struct {
+		statuses []int
+		wantErr  bool
+		want     int32
+	}{
+		"server error is retried":     {[]int{500, 503, 200}, false, 3},
+		"too many requests":           {[]int{429, 200}, false, 2},
+		"gives up after all attempts": {[]int{500, 500, 500, 200}, true, 3},
+		"client error is not retried": {[]int{403, 200}, true, 1},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			var requests int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := atomic.AddInt32(&requests, 1)
+				if status := tc.statuses[n-1]; status != http.StatusOK {
+					http.Error(w, http.StatusText(status), status)
+					return
+				}
+				_, _ = w.Write([]byte("image"))
+			}))
+			defer srv.Close()
+
+			_, err := newTestImageCache(t).fetch(context.Background(), mustParseURL(t, srv.URL+"/virtualbox.box"), "", "", time.Second)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("fetch() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if requests != tc.want {
+				t.Errorf("got %d requests, want %d", requests, tc.want)
+			}
+		})
+	}
+}
+
+func TestImageCacheFetch_canceled(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	c := newTestImageCache(t)
+	c.backoff = time.Minute
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	if _, err := c.fetch(ctx, mustParseURL(t, srv.URL+"/virtualbox.box"), "", "", time.Second); !errors.Is(err, context.Canceled) {
+		t.Errorf("fetch() = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestDownloadSettings_merge(t *testing.T) {
+	provider := downloadSettings{
+		Username: "user",
+		Password: "secret",
+		Headers:  map[string]string{"X-Team": "infra", "X-Env": "ci"},
+		ProxyURL: "http://proxy:3128",
+	}
+	resource := downloadSettings{
+		BearerToken: "token",
+		Headers:     map[string]string{"X-Env": "dev"},
+	}
+
+	want := downloadSettings{
+		Username:    "user",
+		Password:    "secret",
+		BearerToken: "token",
+		Headers:     map[string]string{"X-Team": "infra", "X-Env": "dev"},
+		ProxyURL:    "http://proxy:3128",
+	}
+	if diff := deep.Equal(provider.merge(resource), want); diff != nil {
+		t.Errorf("merge() diff = %v", diff)
+	}
+}
+
+func TestFetchIfRemote_settings(t *testing.T) {
+	var gotAuth, gotHeader string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+		gotHeader = r.Header.Get("X-Artifact-Repo")
+		if gotAuth != "Bearer s3cr3t" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte("image"))
+	}))
+	defer srv.Close()
+
+	caBundle := filepath.Join(t.TempDir(), "ca.pem")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(caBundle, cert, 0600); err != nil {
+		t.Fatal(err)
+	}
+	u := mustParseURL(t, srv.URL+"/virtualbox.box")
+
+	testCases := map[string]struct {
+		provider downloadSettings
+		resource downloadSettings
+		wantErr  bool
+	}{
+		"untrusted certificate": {
+			resource: downloadSettings{BearerToken: "s3cr3t"},
+			wantErr:  true,
+		},
+		"missing token": {
+			provider: downloadSettings{CABundle: caBundle},
+			wantErr:  true,
+		},
+		"ca bundle and token": {
+			provider: downloadSettings{CABundle: caBundle, Headers: map[string]string{"X-Artifact-Repo": "boxes"}},
+			resource: downloadSettings{BearerToken: "s3cr3t"},
+		},
+		"insecure skip verify": {
+			resource: downloadSettings{InsecureSkipVerify: true, BearerToken: "s3cr3t"},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			p := newTestMeta(t)
+			p.downloadSettings = tc.provider
+
+			_, err := fetchIfRemote(context.Background(), p, u, "", "", tc.resource)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("fetchIfRemote() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if name == "ca bundle and token" && gotHeader != "boxes" {
+				t.Errorf("X-Artifact-Repo header = %q, want %q", gotHeader, "boxes")
+			}
+		})
+	}
+}
+
+func TestFetchIfRemote_proxy(t *testing.T) {
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Requests to a proxy carry the absolute URL.
+		proxied = r.URL.String()
+		_, _ = w.Write([]byte("image"))
+	}))
+	defer proxy.Close()
+
+	u := mustParseURL(t, "http://boxes.invalid/virtualbox.box")
+	if _, err := fetchIfRemote(context.Background(), newTestMeta(t), u, "", "", downloadSettings{ProxyURL: proxy.URL}); err != nil {
+		t.Fatalf("fetchIfRemote() = %v", err)
+	}
+	if proxied != u.String() {
+		t.Errorf("proxy got request for %q, want %q", proxied, u)
+	}
+}
@@ -0,0 +1,76 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+)
+
+// getGuestProperty returns the value of the guest property key of the VM, and
+// false if it is not set.
+func getGuestProperty(ctx context.Context, p *providerMeta, vmID, key string) (string, bool, error) {
+	stdout, stderr, err := p.run(ctx, "guestproperty", "get", vmID, key)
+	if err != nil {
+		return "", false, fmt.Errorf("unable to get guest property %s: %w: %s", key, err, stderr)
+	}
+	value, ok := parseValue(stdout)
+	return value, ok, nil
+}
+
+// readGuestProperties returns the current values of the guest properties
+// keys, leaving out the ones which are not set.
+func readGuestProperties(ctx context.Context, p *providerMeta, vmID string, keys []string) (map[string]any, error) {
+	props := make(map[string]any, len(keys))
+	for _, key := range keys {
+		value, ok, err := getGuestProperty(ctx, p, vmID, key)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			props[key] = value
+		}
+	}
+	return props, nil
+}
+
+// updateGuestProperties sets the guest properties of wanted which differ from
+// old and deletes the ones which are gone. Guest properties can be changed
+// whether the VM is running or not.
+func updateGuestProperties(ctx context.Context, p *providerMeta, vmID string, old, wanted map[string]any) error {
+	for _, key := range sortedKeys(old) {
+		if _, ok := wanted[key]; ok {
+			continue
+		}
+		tflog.Debug(ctx, "deleting guest property", map[string]any{
+			"key": key,
+		})
+		if _, stderr, err := p.run(ctx, "guestproperty", "delete", vmID, key); err != nil {
+			return fmt.Errorf("unable to delete guest property %s: %w: %s", key, err, stderr)
+		}
+	}
+	for _, key := range sortedKeys(wanted) {
+		value := wanted[key].(string)
+		if v, ok := old[key]; ok && v.(string) == value {
+			continue
+		}
+		tflog.Debug(ctx, "setting guest property", map[string]any{
+			"key":   key,
+			"value": value,
+		})
+		if _, stderr, err := p.run(ctx, "guestproperty", "set", vmID, key, value); err != nil {
+			return fmt.Errorf("unable to set guest property %s: %w: %s", key, err, stderr)
+		}
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,50 @@
+package provider
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+func TestUpdateGuestProperties(t *testing.T) {
+	fake := &fakeVBoxManage{}
+	p := &providerMeta{run: fake.run}
+
+	old := map[string]any{"/a": "1", "/b": "2", "/c": "3"}
+	wanted := map[string]any{"/a": "1", "/b": "two", "/d": "4"}
+	if err := updateGuestProperties(context.Background(), p, "vm", old, wanted); err != nil {
+		t.Fatalf("updateGuestProperties() = %v", err)
+	}
+
+	want := []string{
+		"guestproperty delete vm /c",
+		"guestproperty set vm /b two",
+		"guestproperty set vm /d 4",
+	}
+	if diff := deep.Equal(fake.calls, want); diff != nil {
+		t.Errorf("VBoxManage calls diff = %v", diff)
+	}
+}
+
+func TestReadGuestProperties(t *testing.T) {
+	fake := &fakeVBoxManage{outputs: map[string]string{"guestproperty": "Value: 42\n"}}
+	p := &providerMeta{run: fake.run}
+
+	got, err := readGuestProperties(context.Background(), p, "vm", []string{"/answer"})
+	if err != nil {
+		t.Fatalf("readGuestProperties() = %v", err)
+	}
+	if diff := deep.Equal(got, map[string]any{"/answer": "42"}); diff != nil {
+		t.Errorf("readGuestProperties() diff = %v", diff)
+	}
+
+	fake.outputs["guestproperty"] = "No value set!\n"
+	got, err = readGuestProperties(context.Background(), p, "vm", []string{"/answer"})
+	if err != nil {
+		t.Fatalf("readGuestProperties() = %v", err)
+	}
+	if len(got) != 0 {
+		t.Errorf("readGuestProperties() = %v, want no properties", got)
+	}
+}
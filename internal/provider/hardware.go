@@ -0,0 +1,339 @@
+package provider
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	vbox "github.com/terra-farm/go-virtualbox"
+)
+
+// Values of the hardware attributes, as accepted by "VBoxManage modifyvm".
+var (
+	firmwares         = []string{"bios", "efi", "efi32", "efi64"}
+	chipsets          = []string{"piix3", "ich9"}
+	paravirtProviders = []string{"none", "default", "legacy", "minimal", "hyperv", "kvm"}
+)
+
+// Defaults of the hardware attributes, which match the settings VMs got
+// before they were configurable. The firmware, chipset and paravirtualization
+// interface default to the settings of the image instead.
+const (
+	defaultVRAM            = 20
+	defaultCPUExecutionCap = 100
+)
+
+// cpuFeature is a CPU feature of the cpu_features block.
+type cpuFeature struct {
+	// Attr is the attribute of the cpu_features block.
+	Attr string
+	// Key is the showvminfo property.
+	Key  string
+	Flag vbox.Flag
+	// Description is the schema description.
+	Description string
+}
+
+// cpuFeatures are the CPU features which can be toggled, all of them are
+// enabled by default.
+var cpuFeatures = []cpuFeature{
+	{"pae", "pae", vbox.PAE, "Physical address extension"},
+	{"long_mode", "longmode", vbox.LONGMODE, "64-bit long mode"},
+	{"hw_virtualization", "hwvirtex", vbox.HWVIRTEX, "Hardware virtualization, VT-x or AMD-V"},
+	{"nested_paging", "nestedpaging", vbox.NESTEDPAGING, "Nested paging, EPT or RVI"},
+	{"large_pages", "largepages", vbox.LARGEPAGES, "Large pages for the nested paging tables"},
+	{"vtx_vpid", "vtxvpid", vbox.VTXVPID, "VT-x tagged TLB"},
+	{"vtx_ux", "vtxux", vbox.VTXUX, "VT-x unrestricted execution"},
+}
+
+// boardFlags are the flags which are always enabled.
+const boardFlags = vbox.ACPI | vbox.IOAPIC | vbox.RTCUSEUTC
+
+// cpuFeaturesSchema is the schema of the cpu_features block of the
+// virtualbox_vm resource.
+func cpuFeaturesSchema() *schema.Schema {
+	features := make(map[string]*schema.Schema, len(cpuFeatures))
+	for _, f := range cpuFeatures {
+		features[f.Attr] = &schema.Schema{
+			Type:        schema.TypeBool,
+			Optional:    true,
+			Default:     true,
+			Description: f.Description,
+		}
+	}
+
+	return &schema.Schema{
+		Type:        schema.TypeList,
+		Optional:    true,
+		Computed:    true,
+		MaxItems:    1,
+		Description: "CPU features exposed to the guest, all of them are enabled by default",
+		Elem:        &schema.Resource{Schema: features},
+	}
+}
+
+// expandCPUFlags returns the flags of the VM, with the CPU features of the
+// cpu_features block.
+func expandCPUFlags(v []any) vbox.Flag {
+	var m map[string]any
+	if len(v) > 0 {
+		m, _ = v[0].(map[string]any)
+	}
+
+	flags := boardFlags
+	for _, f := range cpuFeatures {
+		enabled, ok := m[f.Attr].(bool)
+		if !ok || enabled {
+			flags |= f.Flag
+		}
+	}
+	return flags
+}
+
+// flattenCPUFeatures returns the cpu_features block from the VM info.
+func flattenCPUFeatures(info vmInfo) []any {
+	m := make(map[string]any, len(cpuFeatures))
+	for _, f := range cpuFeatures {
+		m[f.Attr] = info[f.Key] == "on"
+	}
+	return []any{m}
+}
+
+// modifyHardware applies the hardware settings which modifyMachine does not
+// know about to the powered off VM. The chipset and paravirtualization
+// interface are left alone unless configured.
+func modifyHardware(ctx context.Context, p *providerMeta, vmID string, d *schema.ResourceData) error {
+	args := []string{"modifyvm", vmID,
+		"--nested-hw-virt", onOff(d.Get("nested_virtualization").(bool)),
+		"--cpuexecutioncap", strconv.Itoa(d.Get("cpu_execution_cap").(int)),
+	}
+	if chipset := d.Get("chipset").(string); chipset != "" {
+		args = append(args, "--chipset", chipset)
+	}
+	if provider := d.Get("paravirt_provider").(string); provider != "" {
+		args = append(args, "--paravirtprovider", provider)
+	}
+	// modifyMachine connects the cables of all adapters. The link speed is
+	// only passed when set or reset to the default.
+	for i, raw := range d.Get("network_adapter").([]any) {
+		m, ok := raw.(map[string]any)
+		if !ok {
+			continue
+		}
+		if !m["cable_connected"].(bool) {
+			args = append(args, fmt.Sprintf("--cableconnected%d", i+1), "off")
+		}
+		if speed := m["link_speed"].(int); speed > 0 || d.HasChange(fmt.Sprintf("network_adapter.%d.link_speed", i)) {
+			args = append(args, fmt.Sprintf("--nicspeed%d", i+1), strconv.Itoa(speed))
+		}
+	}
+	if _, stderr, err := p.run(ctx, args...); err != nil {
+		return fmt.Errorf("unable to modify hardware of %s: %w: %s", vmID, err, stderr)
+	}
+	return nil
+}
+
+// setHardware reads the hardware attributes back from the VM info.
+func setHardware(ctx context.Context, p *providerMeta, d *schema.ResourceData, info vmInfo) error {
+	osType, err := p.osTypeID(ctx, info["ostype"])
+	if err != nil {
+		// The attribute is kept rather than failing the refresh.
+		tflog.Warn(ctx, "unable to look up OS type", map[string]any{
+			"ostype": info["ostype"],
+			"error":  err.Error(),
+		})
+	} else if osType != "" {
+		if err := d.Set("os_type", osType); err != nil {
+			return fmt.Errorf("can't set os_type: %w", err)
+		}
+	}
+
+	values := map[string]any{
+		"firmware":              strings.ToLower(info["firmware"]),
+		"chipset":               strings.ToLower(info["chipset"]),
+		"paravirt_provider":     strings.ToLower(info["paravirtprovider"]),
+		"nested_virtualization": info["nested-hw-virt"] == "on",
+		"cpu_features":          flattenCPUFeatures(info),
+	}
+	cpus, err := strconv.Atoi(info["cpus"])
+	switch {
+	case err != nil:
+		// Not reported, the attributes are kept.
+	case info["cpuhotplug"] == "on":
+		// The CPU count is the number of sockets, the number of CPUs is the
+		// number of attached ones.
+		values["cpu_hotplug"] = true
+		if n := info.attachedCPUs(); n > 0 {
+			values["cpus"] = n
+		}
+		if d.Get("max_cpus").(int) > 0 {
+			values["max_cpus"] = cpus
+		}
+	default:
+		values["cpu_hotplug"] = false
+		values["cpus"] = cpus
+	}
+	for key, attr := range map[string]string{"vram": "vram", "cpuexecutioncap": "cpu_execution_cap"} {
+		if v, err := strconv.Atoi(info[key]); err == nil {
+			values[attr] = v
+		}
+	}
+	for attr, v := range values {
+		if s, ok := v.(string); ok && s == "" {
+			// Not reported by this VirtualBox version.
+			continue
+		}
+		if err := d.Set(attr, v); err != nil {
+			return fmt.Errorf("can't set %s: %w", attr, err)
+		}
+	}
+	return nil
+}
+
+// osType is a guest OS type known to VirtualBox.
+type osType struct {
+	ID          string
+	Description string
+}
+
+// parseOSTypes parses the output of "VBoxManage list ostypes".
+func parseOSTypes(out string) []osType {
+	var types []osType
+	s := bufio.NewScanner(strings.NewReader(out))
+	for s.Scan() {
+		key, value, ok := strings.Cut(s.Text(), ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.TrimSpace(key) {
+		case "ID":
+			types = append(types, osType{ID: value})
+		case "Description":
+			if len(types) > 0 {
+				types[len(types)-1].Description = value
+			}
+		}
+	}
+	return types
+}
+
+// listOSTypes returns the guest OS types known to VirtualBox, which are only
+// listed once per provider instance.
+func (m *providerMeta) listOSTypes(ctx context.Context) ([]osType, error) {
+	m.osTypesMu.Lock()
+	defer m.osTypesMu.Unlock()
+	if m.osTypes != nil {
+		return m.osTypes, nil
+	}
+
+	stdout, stderr, err := m.run(ctx, "list", "ostypes")
+	if err != nil {
+		return nil, fmt.Errorf("unable to list OS types: %w: %s", err, stderr)
+	}
+	m.osTypes = parseOSTypes(stdout)
+	return m.osTypes, nil
+}
+
+// osTypeID returns the ID of the OS type reported by showvminfo, which is its
+// description, or the value itself if it already is an ID.
+func (m *providerMeta) osTypeID(ctx context.Context, v string) (string, error) {
+	if v == "" {
+		return "", nil
+	}
+	types, err := m.listOSTypes(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, t := range types {
+		if t.Description == v || t.ID == v {
+			return t.ID, nil
+		}
+	}
+	return "", fmt.Errorf("unknown OS type %q", v)
+}
+
+// validateOSType checks that VirtualBox knows the OS type ID. The check is
+// skipped if the OS types can not be listed, VirtualBox rejects unknown types
+// itself.
+func (m *providerMeta) validateOSType(ctx context.Context, id string) error {
+	if id == "" {
+		return nil
+	}
+	types, err := m.listOSTypes(ctx)
+	if err != nil {
+		tflog.Warn(ctx, "unable to validate os_type", map[string]any{
+			"error": err.Error(),
+		})
+		return nil
+	}
+	for _, t := range types {
+		if t.ID == id {
+			return nil
+		}
+	}
+	return fmt.Errorf("os_type %q is not known to VirtualBox, see \"VBoxManage list ostypes\"", id)
+}
+
+// maxCPUs returns the number of CPU sockets of a VM with CPU hot-plugging,
+// which defaults to the number of CPUs.
+func maxCPUs(d interface{ Get(string) any }) int {
+	if n := d.Get("max_cpus").(int); n > 0 {
+		return n
+	}
+	return d.Get("cpus").(int)
+}
+
+// plugCPUs plugs CPUs into or unplugs them from the VM with CPU hot-plugging,
+// so that to CPUs are attached instead of from. The CPUs are attached in
+// order, CPU 0 is always attached. The CPUs of a running VM are changed live.
+func plugCPUs(ctx context.Context, p *providerMeta, vmID string, from, to int, running bool) error {
+	run := func(op string, id int) error {
+		args := []string{"modifyvm", vmID, "--" + op, strconv.Itoa(id)}
+		if running {
+			args = []string{"controlvm", vmID, op, strconv.Itoa(id)}
+		}
+		tflog.Debug(ctx, "changing CPUs", map[string]any{
+			"op":  op,
+			"cpu": id,
+		})
+		if _, stderr, err := p.run(ctx, args...); err != nil {
+			return fmt.Errorf("unable to %s CPU %d: %w: %s", op, id, err, stderr)
+		}
+		return nil
+	}
+
+	if from < 1 {
+		from = 1
+	}
+	if to < 1 {
+		to = 1
+	}
+	for id := from; id < to; id++ {
+		if err := run("plugcpu", id); err != nil {
+			return err
+		}
+	}
+	for id := from - 1; id >= to; id-- {
+		if err := run("unplugcpu", id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// attachedCPUs returns the number of CPUs attached to a VM with CPU
+// hot-plugging, 0 if it is not reported.
+func (info vmInfo) attachedCPUs() int {
+	n := 0
+	for key, value := range info {
+		if strings.HasPrefix(key, "hotplugcpu") && value == "on" {
+			n++
+		}
+	}
+	return n
+}
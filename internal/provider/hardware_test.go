@@ -0,0 +1,155 @@
+package provider
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-test/deep"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	vbox "github.com/terra-farm/go-virtualbox"
+)
+
+const osTypesList = `ID:          Windows10_64
+Description: Windows 10 (64-bit)
+Family ID:   Windows
+Family Desc: Microsoft Windows
+64 bit:      true
+
+ID:          Ubuntu_64
+Description: Ubuntu (64-bit)
+Family ID:   Linux
+Family Desc: Linux
+64 bit:      true
+`
+
+func TestParseOSTypes(t *testing.T) {
+	want := []osType{
+		{ID: "Windows10_64", Description: "Windows 10 (64-bit)"},
+		{ID: "Ubuntu_64", Description: "Ubuntu (64-bit)"},
+	}
+	if diff := deep.Equal(parseOSTypes(osTypesList), want); diff != nil {
+		t.Errorf("parseOSTypes() diff = %v", diff)
+	}
+}
+
+func TestExpandCPUFlags(t *testing.T) {
+	all := boardFlags | vbox.PAE | vbox.LONGMODE | vbox.HWVIRTEX | vbox.NESTEDPAGING |
+		vbox.LARGEPAGES | vbox.VTXVPID | vbox.VTXUX
+
+	testCases := map[string]struct {
+		in   []any
+		want vbox.Flag
+	}{
+		"not configured": {want: all},
+		"no virtualization": {
+			in: []any{map[string]any{
+				"pae": true, "long_mode": true, "hw_virtualization": false, "nested_paging": false,
+				"large_pages": true, "vtx_vpid": false, "vtx_ux": false,
+			}},
+			want: boardFlags | vbox.PAE | vbox.LONGMODE | vbox.LARGEPAGES,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			if got := expandCPUFlags(tc.in); got != tc.want {
+				t.Errorf("expandCPUFlags() = %b, want %b", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSetHardware(t *testing.T) {
+	fake := &fakeVBoxManage{outputs: map[string]string{"list": osTypesList}}
+	p := &providerMeta{run: fake.run}
+	d := schema.TestResourceDataRaw(t, resourceVM().Schema, map[string]any{"name": "vm"})
+
+	info := parseVMInfo(`ostype="Windows 10 (64-bit)"
+vram="128"
+firmware="EFI"
+chipset="ich9"
+paravirtprovider="HyperV"
+nested-hw-virt="on"
+cpuexecutioncap="50"
+pae="on"
+longmode="on"
+hwvirtex="on"
+nestedpaging="off"
+largepages="off"
+vtxvpid="on"
+vtxux="on"
+`)
+	for i := 0; i < 2; i++ {
+		if err := setHardware(context.Background(), p, d, info); err != nil {
+			t.Fatalf("setHardware() = %v", err)
+		}
+	}
+
+	want := map[string]any{
+		"os_type":               "Windows10_64",
+		"vram":                  128,
+		"firmware":              "efi",
+		"chipset":               "ich9",
+		"paravirt_provider":     "hyperv",
+		"nested_virtualization": true,
+		"cpu_execution_cap":     50,
+		"cpu_features": []any{map[string]any{
+			"pae": true, "long_mode": true, "hw_virtualization": true, "nested_paging": false,
+			"large_pages": false, "vtx_vpid": true, "vtx_ux": true,
+		}},
+	}
+	for attr, v := range want {
+		if diff := deep.Equal(d.Get(attr), v); diff != nil {
+			t.Errorf("%s diff = %v", attr, diff)
+		}
+	}
+	// The OS types are listed once.
+	if diff := deep.Equal(fake.calls, []string{"list ostypes"}); diff != nil {
+		t.Errorf("VBoxManage calls diff = %v", diff)
+	}
+}
+
+func TestValidateOSType(t *testing.T) {
+	p := &providerMeta{run: (&fakeVBoxManage{outputs: map[string]string{"list": osTypesList}}).run}
+
+	for id, wantErr := range map[string]bool{"Ubuntu_64": false, "": false, "Ubuntu (64-bit)": true, "Plan9": true} {
+		if err := p.validateOSType(context.Background(), id); (err != nil) != wantErr {
+			t.Errorf("validateOSType(%q) error = %v, wantErr %v", id, err, wantErr)
+		}
+	}
+}
+
+func TestPlugCPUs(t *testing.T) {
+	testCases := map[string]struct {
+		from, to int
+		running  bool
+		want     []string
+	}{
+		"plug": {
+			from: 2, to: 4,
+			want: []string{"modifyvm vm --plugcpu 2", "modifyvm vm --plugcpu 3"},
+		},
+		"unplug live": {
+			from: 4, to: 2, running: true,
+			want: []string{"controlvm vm unplugcpu 3", "controlvm vm unplugcpu 2"},
+		},
+		"keep CPU 0": {
+			from: 2, to: 0,
+			want: []string{"modifyvm vm --unplugcpu 1"},
+		},
+		"unchanged": {from: 2, to: 2},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			fake := &fakeVBoxManage{}
+			p := &providerMeta{run: fake.run}
+			if err := plugCPUs(context.Background(), p, "vm", tc.from, tc.to, tc.running); err != nil {
+				t.Fatalf("plugCPUs() = %v", err)
+			}
+			if diff := deep.Equal(fake.calls, tc.want); diff != nil {
+				t.Errorf("VBoxManage calls diff = %v", diff)
+			}
+		})
+	}
+}
@@ -6,11 +6,13 @@ import (
 	"crypto/sha1"
 	"crypto/sha256"
 	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"hash"
 	"io"
+	"io/fs"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"sort"
 	"strings"
@@ -26,7 +28,79 @@ func (e InvalidChecksumTypeError) Error() string {
 	return fmt.Sprintf("invalid checksum algorithm: %q", string(e))
 }
 
-//nolint:unused
+// ChecksumMismatchError is returned when the checksum of the image does not
+// match the expected one.
+type ChecksumMismatchError struct {
+	Result   string
+	Expected string
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("checksum does not match\n Result: %s\n Expected: %s", e.Result, e.Expected)
+}
+
+// checksumTypes are the supported checksum algorithms.
+var checksumTypes = []string{"md5", "sha1", "sha256", "sha384", "sha512"}
+
+// parseChecksum returns the checksum algorithm and the checksum itself. The
+// checksum can either be passed together with its type, or in the
+// "<type>:<hex>" shorthand form, in which case checksumType has to be either
+// empty or match the shorthand type.
+func parseChecksum(checksum, checksumType string) (string, string, error) {
+	if typ, sum, ok := strings.Cut(checksum, ":"); ok {
+		if checksumType != "" && checksumType != typ {
+			return "", "", fmt.Errorf("checksum type %q does not match checksum_type %q", typ, checksumType)
+		}
+		checksum, checksumType = sum, typ
+	}
+
+	if checksum == "" {
+		return "", "", fmt.Errorf("checksum is empty")
+	}
+	if checksumType == "" {
+		return "", "", fmt.Errorf("checksum_type must be set, or checksum must be in the \"<type>:<hex>\" form")
+	}
+	if !isSupportedChecksumType(checksumType) {
+		return "", "", InvalidChecksumTypeError(checksumType)
+	}
+	if _, err := hex.DecodeString(checksum); err != nil {
+		return "", "", fmt.Errorf("checksum is not a hex encoded string: %w", err)
+	}
+
+	return checksumType, strings.ToLower(checksum), nil
+}
+
+func isSupportedChecksumType(checksumType string) bool {
+	for _, typ := range checksumTypes {
+		if typ == checksumType {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyImageFile checks the checksum of the image file at path.
+func verifyImageFile(ctx context.Context, path, checksum, checksumType string) error {
+	typ, sum, err := parseChecksum(checksum, checksumType)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("unable to open image: %w", err)
+	}
+	defer f.Close()
+
+	img := &image{
+		URL:          path,
+		Checksum:     sum,
+		ChecksumType: typ,
+		file:         f,
+	}
+	return img.verify(ctx)
+}
+
 type image struct {
 	// Image URL where to download from
 	URL string
@@ -38,65 +112,257 @@ type image struct {
 	file io.ReadSeeker
 }
 
+// goldMarkerFile is written into the gold folder of an image once it has been
+// completely unpacked. Folders without it are leftovers of an interrupted
+// unpack and are not used.
+const goldMarkerFile = ".terraform-virtualbox"
+
+// goldMarker is the content of the goldMarkerFile.
+type goldMarker struct {
+	// Image which was unpacked.
+	Image string `json:"image"`
+	// SHA256 checksum of the unpacked image.
+	SHA256 string `json:"sha256"`
+}
+
+// unpackImage unpacks the image into the toDir folder, replacing it if it
+// already exists. The image is unpacked into a temporary sibling folder first
+// and only moved into place after it has been completely unpacked and the
+// marker file has been written, so toDir never contains a partial image.
 func unpackImage(ctx context.Context, image, toDir string) error {
-	/* Check if toDir exists */
-	_, err := os.Stat(toDir)
-	finfo, _ := os.ReadDir(toDir)
-	dirEmpty := len(finfo) == 0
-	if os.IsNotExist(err) || dirEmpty {
-		err := os.MkdirAll(toDir, 0740)
-		if err != nil {
-			return fmt.Errorf("unable to create %s directory: %w", toDir, err)
-		}
-		fp, err := os.Open(image)
-		if err != nil {
-			return err
-		}
-		defer fp.Close()
-
-		/* Unpack */
-		tflog.Debug(ctx, "unpacking gold virtual image", map[string]any{
-			"image": image,
-			"toDir": toDir,
-		})
-		cmd := exec.Command("tar", "-xv", "-C", toDir, "-f", image)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-
-		if err := cmd.Run(); err != nil {
-			return fmt.Errorf("error unpacking gold image %s: %w", fp.Name(), err)
-		}
+	parent, base := filepath.Split(filepath.Clean(toDir))
+	if err := os.MkdirAll(parent, 0740); err != nil {
+		return fmt.Errorf("unable to create %s directory: %w", parent, err)
+	}
+	tmpDir, err := os.MkdirTemp(parent, "."+base+".tmp-")
+	if err != nil {
+		return fmt.Errorf("unable to create temporary directory: %w", err)
+	}
+	// After a successful rename there is nothing to remove anymore.
+	defer os.RemoveAll(tmpDir)
+
+	fp, err := os.Open(image)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	/* Unpack */
+	tflog.Debug(ctx, "unpacking gold virtual image", map[string]any{
+		"image": image,
+		"toDir": toDir,
+	})
+	hasher := sha256.New()
+	src := io.TeeReader(fp, hasher)
+	if err := extractArchiveFrom(ctx, src, image, tmpDir); err != nil {
+		return fmt.Errorf("error unpacking gold image %s: %w", image, err)
+	}
+	// The archive might have trailing data (like tar padding) which is not
+	// read during extraction but is part of the checksum.
+	if _, err := io.Copy(io.Discard, src); err != nil {
+		return fmt.Errorf("unable to read image %s: %w", image, err)
+	}
+
+	marker := goldMarker{
+		Image:  image,
+		SHA256: fmt.Sprintf("%x", hasher.Sum(nil)),
+	}
+	if err := writeGoldMarker(tmpDir, marker); err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(toDir); err != nil {
+		return fmt.Errorf("unable to remove stale gold image %s: %w", toDir, err)
+	}
+	if err := os.Rename(tmpDir, toDir); err != nil {
+		return fmt.Errorf("unable to move gold image into place: %w", err)
 	}
 	return nil
 }
 
-func gatherDisks(path string) ([]string, error) {
-	VDIs, err := filepath.Glob(filepath.Join(path, "**.vdi"))
+func writeGoldMarker(dir string, marker goldMarker) error {
+	b, err := json.Marshal(marker)
 	if err != nil {
-		return nil, fmt.Errorf("get *.vdi in %q: %w", path, err)
+		return err
 	}
-	VMDKs, err := filepath.Glob(filepath.Join(path, "**.vmdk"))
+	f, err := os.Create(filepath.Join(dir, goldMarkerFile))
 	if err != nil {
-		return nil, fmt.Errorf("get *.vmdk in path %q: %w", path, err)
+		return fmt.Errorf("unable to create marker file: %w", err)
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return fmt.Errorf("unable to write marker file: %w", err)
+	}
+	// Make sure the marker hits the disk before the folder is moved into
+	// place.
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("unable to sync marker file: %w", err)
+	}
+	return f.Close()
+}
+
+// goldImageUpToDate reports whether dir contains a completely unpacked image
+// with the given SHA256 checksum.
+func goldImageUpToDate(dir, sha256sum string) (bool, error) {
+	b, err := os.ReadFile(filepath.Join(dir, goldMarkerFile))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("unable to read marker file: %w", err)
+	}
+	var marker goldMarker
+	if err := json.Unmarshal(b, &marker); err != nil {
+		// A corrupted marker is treated like an incomplete image.
+		return false, nil
+	}
+	return strings.EqualFold(marker.SHA256, sha256sum), nil
+}
+
+// imageSHA256 returns the SHA256 checksum of the image file. If the configured
+// checksum is already a verified SHA256 one, it is used instead of hashing the
+// file again.
+func imageSHA256(path, checksum, checksumType string) (string, error) {
+	if checksum != "" {
+		if typ, sum, err := parseChecksum(checksum, checksumType); err == nil && typ == "sha256" {
+			return sum, nil
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("unable to open image: %w", err)
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", fmt.Errorf("cannot hash image file: %w", err)
+	}
+	return fmt.Sprintf("%x", hasher.Sum(nil)), nil
+}
+
+// diskManifestFile is an optional file in the image which lists its disks in
+// the order they are attached, the first one being the boot disk.
+const diskManifestFile = "disks.json"
+
+// diskManifest is the format of the disks.json file. The disks are paths
+// relative to the image root, using forward slashes.
+type diskManifest struct {
+	Disks []string `json:"disks"`
+}
+
+// gatherDisks returns the *.vdi and *.vmdk files anywhere below path, in the
+// order they are attached to the VM. The order is taken from the disks.json
+// manifest or the disk section of the OVF descriptor of the image, disks not
+// listed there come last sorted by ByDiskPriority.
+func gatherDisks(path string) ([]string, error) {
+	var disks []string
+	err := filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		switch strings.ToLower(filepath.Ext(p)) {
+		case ".vdi", ".vmdk":
+			disks = append(disks, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("get *.vdi and *.vmdk in %q: %w", path, err)
 	}
-	disks := append(VDIs, VMDKs...)
 	if len(disks) == 0 {
 		return nil, fmt.Errorf(
 			"no VM disk files (*.vdi, *.vmdk) found in path %q", path)
 	}
-	prioritized := ByDiskPriority(disks)
-	sort.Sort(prioritized)
-	return prioritized, nil
+	sort.Sort(ByDiskPriority(disks))
+
+	order, err := diskOrder(path)
+	if err != nil {
+		return nil, err
+	}
+	return orderDisks(disks, order)
+}
+
+// diskOrder returns the disks listed by the disks.json manifest or the OVF
+// descriptor in path, nil if there is neither.
+func diskOrder(path string) ([]string, error) {
+	b, err := os.ReadFile(filepath.Join(path, diskManifestFile))
+	switch {
+	case err == nil:
+		var manifest diskManifest
+		if err := json.Unmarshal(b, &manifest); err != nil {
+			return nil, fmt.Errorf("unable to parse %s: %w", diskManifestFile, err)
+		}
+		order := make([]string, 0, len(manifest.Disks))
+		for _, disk := range manifest.Disks {
+			order = append(order, filepath.Join(path, filepath.FromSlash(disk)))
+		}
+		return order, nil
+	case !os.IsNotExist(err):
+		return nil, err
+	}
+
+	ovfPath, err := findOVF(path)
+	if err != nil || ovfPath == "" {
+		return nil, err
+	}
+	desc, err := parseOVF(ovfPath)
+	if err != nil {
+		return nil, err
+	}
+	order := make([]string, 0, len(desc.Disks))
+	for _, disk := range desc.Disks {
+		order = append(order, filepath.Join(filepath.Dir(ovfPath), filepath.FromSlash(disk)))
+	}
+	return order, nil
 }
 
-// ByDiskPriority adds a simple sort to make sure that configdisk is not first
-// in the returned boot order.
+// orderDisks moves the disks listed in order to the front, in that order.
+// Every listed disk must exist.
+func orderDisks(disks, order []string) ([]string, error) {
+	found := make(map[string]bool, len(disks))
+	for _, disk := range disks {
+		found[disk] = true
+	}
+
+	ordered := make([]string, 0, len(disks))
+	listed := make(map[string]bool, len(order))
+	for _, disk := range order {
+		if !found[disk] {
+			return nil, fmt.Errorf("disk %q listed by the image is missing", disk)
+		}
+		if listed[disk] {
+			return nil, fmt.Errorf("disk %q is listed twice by the image", disk)
+		}
+		listed[disk] = true
+		ordered = append(ordered, disk)
+	}
+	for _, disk := range disks {
+		if !listed[disk] {
+			ordered = append(ordered, disk)
+		}
+	}
+	return ordered, nil
+}
+
+// ByDiskPriority sorts disks by path, except for config drives which come last
+// so they are never the boot disk.
 type ByDiskPriority []string
 
 func (ss ByDiskPriority) Len() int      { return len(ss) }
 func (ss ByDiskPriority) Swap(i, j int) { ss[i], ss[j] = ss[j], ss[i] }
 func (ss ByDiskPriority) Less(i, j int) bool {
-	return !strings.Contains(ss[i], "configdrive")
+	ci := strings.Contains(ss[i], "configdrive")
+	cj := strings.Contains(ss[j], "configdrive")
+	if ci != cj {
+		return cj
+	}
+	return ss[i] < ss[j]
 }
 
 func (img *image) verify(ctx context.Context) error {
@@ -110,6 +376,8 @@ func (img *image) verify(ctx context.Context) error {
 		hasher = sha1.New()
 	case "sha256":
 		hasher = sha256.New()
+	case "sha384":
+		hasher = sha512.New384()
 	case "sha512":
 		hasher = sha512.New()
 	default:
@@ -126,8 +394,8 @@ func (img *image) verify(ctx context.Context) error {
 	}
 
 	result := fmt.Sprintf("%x", hasher.Sum(nil))
-	if result != img.Checksum {
-		return fmt.Errorf("checksum does not match\n Result: %s\n Expected: %s", result, img.Checksum)
+	if result != strings.ToLower(img.Checksum) {
+		return &ChecksumMismatchError{Result: result, Expected: img.Checksum}
 	}
 
 	return nil
@@ -75,6 +75,27 @@ func TestUnpackImage_xz(t *testing.T) {
 	})
 }
 
+func TestUnpackImage_zstd(t *testing.T) {
+	Convey("Unpack image to a temporary directory", t, func() {
+		dir, err := os.MkdirTemp("", "tfvbox-test-")
+		So(err, ShouldBeNil)
+		err = unpackImage(context.Background(), "testdata/hello.tar.zst", dir)
+		So(err, ShouldBeNil)
+
+		Convey("The unpacked file should be there", func() {
+			bytes, err := os.ReadFile(filepath.Join(dir, "hello"))
+			So(err, ShouldBeNil)
+
+			Convey("And the uncompressed content should match the original file", func() {
+				origin, err := os.ReadFile(filepath.Join("testdata", "hello"))
+				So(err, ShouldBeNil)
+				So(string(bytes), ShouldEqual, string(origin))
+			})
+		})
+
+	})
+}
+
 func TestVerify(t *testing.T) {
 	testCases := map[string]struct {
 		img image
@@ -86,13 +107,62 @@ func TestVerify(t *testing.T) {
 			},
 			err: InvalidChecksumTypeError("invalid"),
 		},
-		// TODO: Fill this with actual test cases which test verification of the
-		//       checksums.
+		"md5": {
+			img: image{
+				ChecksumType: "md5",
+				Checksum:     "6cd3556deb0da54bca060b4c39479839",
+			},
+		},
+		"sha1": {
+			img: image{
+				ChecksumType: "sha1",
+				Checksum:     "943a702d06f34599aee1f8da8ef9f7296031d699",
+			},
+		},
+		"sha256": {
+			img: image{
+				ChecksumType: "sha256",
+				Checksum:     "315f5bdb76d078c43b8ac0064e4a0164612b1fce77c869345bfc94c75894edd3",
+			},
+		},
+		"sha256 upper case": {
+			img: image{
+				ChecksumType: "sha256",
+				Checksum:     "315F5BDB76D078C43B8AC0064E4A0164612B1FCE77C869345BFC94C75894EDD3",
+			},
+		},
+		"sha512": {
+			img: image{
+				ChecksumType: "sha512",
+				Checksum:     "c1527cd893c124773d811911970c8fe6e857d6df5dc9226bd8a160614c0cd963a4ddea2b94bb7d36021ef9d865d5cea294a82dd49a0bb269f51f6e7a57f79421",
+			},
+		},
+		"mismatch": {
+			img: image{
+				ChecksumType: "md5",
+				Checksum:     "00000000000000000000000000000000",
+			},
+			err: &ChecksumMismatchError{},
+		},
 	}
 
 	for name, tc := range testCases {
 		t.Run(name, func(t *testing.T) {
-			if err := tc.img.verify(context.Background()); !errors.Is(err, tc.err) {
+			f, err := os.Open(filepath.Join("testdata", "hello"))
+			if err != nil {
+				t.Fatalf("unable to open test file: %v", err)
+			}
+			defer f.Close()
+			tc.img.file = f
+
+			err = tc.img.verify(context.Background())
+			var mismatch *ChecksumMismatchError
+			switch {
+			case errors.As(tc.err, &mismatch):
+				if !errors.As(err, &mismatch) {
+					t.Errorf("verify() = %v, want checksum mismatch", err)
+				}
+			case !errors.Is(err, tc.err):
 				t.Errorf("verify() = %v, want %v", err, tc.err)
 			}
 		})
@@ -100,6 +170,52 @@ func TestVerify(t *testing.T) {
 
 }
 
+func TestParseChecksum(t *testing.T) {
+	testCases := map[string]struct {
+		checksum     string
+		checksumType string
+		wantType     string
+		wantSum      string
+		wantErr      bool
+	}{
+		"separate type":      {"ABCDEF", "sha256", "sha256", "abcdef", false},
+		"shorthand":          {"sha256:abcdef", "", "sha256", "abcdef", false},
+		"shorthand and type": {"sha1:abcdef", "sha1", "sha1", "abcdef", false},
+		"type mismatch":      {"sha1:abcdef", "md5", "", "", true},
+		"missing type":       {"abcdef", "", "", "", true},
+		"invalid type":       {"crc32:abcdef", "", "", "", true},
+		"not hex":            {"sha256:xyz", "", "", "", true},
+		"empty checksum":     {"sha256:", "", "", "", true},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			typ, sum, err := parseChecksum(tc.checksum, tc.checksumType)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("parseChecksum() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if typ != tc.wantType || sum != tc.wantSum {
+				t.Errorf("parseChecksum() = (%q, %q), want (%q, %q)", typ, sum, tc.wantType, tc.wantSum)
+			}
+		})
+	}
+}
+
+func TestVerifyImageFile(t *testing.T) {
+	path := filepath.Join("testdata", "hello.tar.gz")
+
+	err := verifyImageFile(context.Background(), path, "sha256:a213cfed68038b2dc6ac00e94bfb0b3659f6db8a04b6ad6a877a08f08c27604d", "")
+	if err != nil {
+		t.Errorf("verifyImageFile() = %v, want nil", err)
+	}
+
+	var mismatch *ChecksumMismatchError
+	err = verifyImageFile(context.Background(), path, "6cd3556deb0da54bca060b4c39479839", "md5")
+	if !errors.As(err, &mismatch) {
+		t.Errorf("verifyImageFile() = %v, want checksum mismatch", err)
+	}
+}
+
 func TestGatherDisks(t *testing.T) {
 	disks, err := gatherDisks("./testdata/fakedisks")
 	if err != nil {
@@ -116,6 +232,93 @@ func TestGatherDisks(t *testing.T) {
 	}
 }
 
+// writeDisks creates empty files at the slash separated paths below dir.
+func writeDisks(t *testing.T, dir string, paths ...string) {
+	t.Helper()
+	for _, p := range paths {
+		path := filepath.Join(dir, filepath.FromSlash(p))
+		if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestGatherDisks_order(t *testing.T) {
+	testCases := map[string]struct {
+		files    []string
+		manifest string
+		ovf      bool
+		want     []string
+		wantErr  bool
+	}{
+		"recursive": {
+			files: []string{"disks/b.vmdk", "a-configdrive.vmdk", "disks/a.VDI", "README"},
+			want:  []string{"disks/a.VDI", "disks/b.vmdk", "a-configdrive.vmdk"},
+		},
+		"manifest": {
+			files:    []string{"a.vmdk", "b.vmdk", "data/c.vdi"},
+			manifest: `{"disks": ["data/c.vdi", "b.vmdk"]}`,
+			want:     []string{"data/c.vdi", "b.vmdk", "a.vmdk"},
+		},
+		"manifest with missing disk": {
+			files:    []string{"a.vmdk"},
+			manifest: `{"disks": ["b.vmdk"]}`,
+			wantErr:  true,
+		},
+		"manifest with duplicate disk": {
+			files:    []string{"a.vmdk"},
+			manifest: `{"disks": ["a.vmdk", "a.vmdk"]}`,
+			wantErr:  true,
+		},
+		"invalid manifest": {
+			files:    []string{"a.vmdk"},
+			manifest: `{"disks": "a.vmdk"}`,
+			wantErr:  true,
+		},
+		"ovf": {
+			files: []string{"box-disk002.vmdk", "box-disk001.vmdk"},
+			ovf:   true,
+			want:  []string{"box-disk001.vmdk", "box-disk002.vmdk"},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeDisks(t, dir, tc.files...)
+			if tc.manifest != "" {
+				if err := os.WriteFile(filepath.Join(dir, diskManifestFile), []byte(tc.manifest), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tc.ovf {
+				b, err := os.ReadFile(filepath.Join("testdata", "ovf", "box.ovf"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filepath.Join(dir, "box.ovf"), b, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := gatherDisks(dir)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("gatherDisks() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			var want []string
+			for _, p := range tc.want {
+				want = append(want, filepath.Join(dir, filepath.FromSlash(p)))
+			}
+			if diff := deep.Equal(got, want); diff != nil {
+				t.Errorf("gatherDisks() diff = %v", diff)
+			}
+		})
+	}
+}
+
 func TestByDiskPriority(t *testing.T) {
 	testCases := map[string]struct {
 		in   []string
@@ -129,6 +332,10 @@ func TestByDiskPriority(t *testing.T) {
 			[]string{"ubuntu-cloudimg-configdrive.vmdk", "ubuntu-cloudimg.vmdk"},
 			[]string{"ubuntu-cloudimg.vmdk", "ubuntu-cloudimg-configdrive.vmdk"},
 		},
+		"sorted by name": {
+			[]string{"c.vmdk", "b-configdrive.vmdk", "a.vdi", "a-configdrive.vmdk", "b.vmdk"},
+			[]string{"a.vdi", "b.vmdk", "c.vmdk", "a-configdrive.vmdk", "b-configdrive.vmdk"},
+		},
 	}
 
 	for name, tc := range testCases {
@@ -141,3 +348,73 @@ func TestByDiskPriority(t *testing.T) {
 		})
 	}
 }
+
+func TestUnpackImage_marker(t *testing.T) {
+	const helloSHA256 = "a213cfed68038b2dc6ac00e94bfb0b3659f6db8a04b6ad6a877a08f08c27604d"
+	dir := filepath.Join(t.TempDir(), "hello")
+
+	upToDate, err := goldImageUpToDate(dir, helloSHA256)
+	if err != nil || upToDate {
+		t.Fatalf("goldImageUpToDate() before unpack = %v, %v, want false, nil", upToDate, err)
+	}
+
+	if err := unpackImage(context.Background(), filepath.Join("testdata", "hello.tar.gz"), dir); err != nil {
+		t.Fatalf("unpackImage() = %v", err)
+	}
+
+	upToDate, err = goldImageUpToDate(dir, helloSHA256)
+	if err != nil || !upToDate {
+		t.Errorf("goldImageUpToDate() = %v, %v, want true, nil", upToDate, err)
+	}
+	upToDate, err = goldImageUpToDate(dir, "0000")
+	if err != nil || upToDate {
+		t.Errorf("goldImageUpToDate() with other checksum = %v, %v, want false, nil", upToDate, err)
+	}
+
+	sum, err := imageSHA256(filepath.Join("testdata", "hello.tar.gz"), "", "")
+	if err != nil || sum != helloSHA256 {
+		t.Errorf("imageSHA256() = %q, %v, want %q, nil", sum, err, helloSHA256)
+	}
+}
+
+func TestUnpackImage_incomplete(t *testing.T) {
+	parent := t.TempDir()
+	dir := filepath.Join(parent, "hello")
+
+	// A previous unpack which died halfway left a non-empty folder behind.
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "partial.vmdk"), []byte("partial"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if upToDate, _ := goldImageUpToDate(dir, ""); upToDate {
+		t.Fatalf("goldImageUpToDate() = true for an incomplete image")
+	}
+
+	// A failing unpack must not touch the existing folder.
+	if err := unpackImage(context.Background(), filepath.Join("testdata", "hello"), dir); err == nil {
+		t.Fatalf("unpackImage() of a non archive succeeded")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "partial.vmdk")); err != nil {
+		t.Errorf("existing folder was modified by a failed unpack: %v", err)
+	}
+
+	if err := unpackImage(context.Background(), filepath.Join("testdata", "hello.tar.gz"), dir); err != nil {
+		t.Fatalf("unpackImage() = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "partial.vmdk")); !os.IsNotExist(err) {
+		t.Errorf("stale file was not removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "hello")); err != nil {
+		t.Errorf("unpacked file is missing: %v", err)
+	}
+
+	entries, err := os.ReadDir(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("temporary folders were left behind: %v", entries)
+	}
+}
@@ -0,0 +1,217 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+)
+
+// importedImage is the image of imported VMs, which were not created by the
+// provider.
+const importedImage = "imported"
+
+// resourceVMImport imports the VM with the UUID or name of the import ID. The
+// attributes are read back by resourceVMRead afterwards.
+func resourceVMImport(ctx context.Context, d *schema.ResourceData, meta any) ([]*schema.ResourceData, error) {
+	p := meta.(*providerMeta)
+	vm, err := getMachine(ctx, p, d.Id())
+	if err != nil {
+		return nil, fmt.Errorf("unable to get machine %s: %w", d.Id(), err)
+	}
+	info, err := showVMInfo(ctx, p, vm.UUID)
+	if err != nil {
+		return nil, err
+	}
+	tflog.Debug(ctx, "importing VM", map[string]any{
+		"id":   d.Id(),
+		"uuid": vm.UUID,
+	})
+	d.SetId(vm.UUID)
+
+	// Attributes which are not read back get their defaults, so that the
+	// next plan only shows actual differences.
+	values := map[string]any{}
+	for key, s := range resourceVM().Schema {
+		if s.Default != nil {
+			values[key] = s.Default
+		}
+	}
+	values["name"] = vm.Name
+	values["image"] = importedImage
+	values["pending_restart"] = []string{}
+	values["copy_optical_disks"] = false
+	if _, linked, err := getExtraData(ctx, p, vm.UUID, extraDataTemplate); err != nil {
+		return nil, fmt.Errorf("unable to get template of the VM: %w", err)
+	} else if linked {
+		values["clone_mode"] = cloneModeLinked
+	}
+	controllers, diskController, opticalController := importStorage(info)
+	disks, err := importDataDisks(ctx, p, info)
+	if err != nil {
+		return nil, err
+	}
+	values["disk"] = flattenDataDisks(disks)
+	values["storage_controller"] = controllers
+	values["disk_controller"] = diskController
+	values["optical_disk_controller"] = opticalController
+	if cpus, err := strconv.Atoi(info["cpus"]); err == nil && info["cpuhotplug"] == "on" {
+		values["max_cpus"] = cpus
+	}
+
+	for key, v := range values {
+		if err := d.Set(key, v); err != nil {
+			return nil, fmt.Errorf("can't set %s: %w", key, err)
+		}
+	}
+	return []*schema.ResourceData{d}, nil
+}
+
+// importStorage returns the storage_controller blocks of the VM, and the
+// controllers of its first hard disk and of its first optical drive.
+func importStorage(info vmInfo) ([]any, string, string) {
+	var controllers []any
+	var diskController, opticalController string
+	for i := 0; ; i++ {
+		name, ok := info[fmt.Sprintf("storagecontrollername%d", i)]
+		if !ok {
+			break
+		}
+		ctl, _ := info.storageController(name)
+		bus := chipsetBus(ctl.Type)
+		controllers = append(controllers, map[string]any{
+			"name":          name,
+			"bus":           bus,
+			"chipset":       canonicalChipset(ctl.Type),
+			"port_count":    ctl.Ports,
+			"host_io_cache": true,
+			"bootable":      info[fmt.Sprintf("storagecontrollerbootable%d", i)] != "off",
+		})
+		if bus == "floppy" {
+			continue
+		}
+
+		for _, slot := range info.slots(name) {
+			_, optical := info[fmt.Sprintf("%s-IsEjected-%d-%d", name, slot.Port, slot.Device)]
+			switch {
+			case optical && opticalController == "":
+				opticalController = name
+			case !optical && diskController == "" && info.medium(name, slot.Port, slot.Device) != "":
+				diskController = name
+			}
+		}
+	}
+	if opticalController == "" {
+		opticalController = diskController
+	}
+	return controllers, diskController, opticalController
+}
+
+// importDataDisks returns the hard disks of the VM as data disks, except for
+// the first one which is the primary disk.
+func importDataDisks(ctx context.Context, p *providerMeta, info vmInfo) ([]dataDisk, error) {
+	var disks []dataDisk
+	primary := true
+	for i := 0; ; i++ {
+		name, ok := info[fmt.Sprintf("storagecontrollername%d", i)]
+		if !ok {
+			break
+		}
+		if ctl, _ := info.storageController(name); chipsetBus(ctl.Type) == "floppy" {
+			continue
+		}
+
+		for _, slot := range info.slots(name) {
+			path := info.medium(name, slot.Port, slot.Device)
+			if _, optical := info[fmt.Sprintf("%s-IsEjected-%d-%d", name, slot.Port, slot.Device)]; optical || path == "" {
+				continue
+			}
+			if primary {
+				primary = false
+				continue
+			}
+
+			disk, err := importDataDisk(ctx, p, path)
+			if err != nil {
+				return nil, err
+			}
+			disk.Controller, disk.Port, disk.Device = name, slot.Port, slot.Device
+			disks = append(disks, disk)
+		}
+	}
+	return disks, nil
+}
+
+// importDataDisk returns the size, format and variant of the disk at path.
+func importDataDisk(ctx context.Context, p *providerMeta, path string) (dataDisk, error) {
+	stdout, err := showMediumInfo(ctx, p, path)
+	if err != nil {
+		return dataDisk{}, err
+	}
+	capacity, err := parseMediumCapacity(path, stdout)
+	if err != nil {
+		return dataDisk{}, err
+	}
+
+	disk := dataDisk{Size: formatSize(capacity), Format: "vdi", Variant: "Standard", Path: path}
+	if m := reMediumFormat.FindStringSubmatch(stdout); m != nil {
+		disk.Format = strings.ToLower(m[1])
+	}
+	if m := reMediumVariant.FindStringSubmatch(stdout); m != nil && strings.Contains(strings.ToLower(m[1]), "fixed") {
+		disk.Variant = "Fixed"
+	}
+	return disk, nil
+}
+
+// chipsetBus returns the bus of controllers with the chipset reported by
+// showvminfo.
+func chipsetBus(chipset string) string {
+	switch strings.ToLower(chipset) {
+	case "piix3", "piix4", "ich6":
+		return "ide"
+	case "buslogic":
+		return "scsi"
+	}
+	for bus, c := range storageBuses {
+		if strings.EqualFold(c, chipset) {
+			return bus
+		}
+	}
+	return ""
+}
+
+// canonicalChipset returns the chipset reported by showvminfo, e.g.
+// IntelAhci, as accepted by the chipset attribute.
+func canonicalChipset(chipset string) string {
+	for _, c := range storageChipsets {
+		if strings.EqualFold(c, chipset) {
+			return c
+		}
+	}
+	return chipset
+}
+
+// suppressImported suppresses the diffs of the attributes which only matter
+// when the VM is created, for imported VMs.
+func suppressImported(k, old, new string, d *schema.ResourceData) bool {
+	o, _ := d.GetChange("image")
+	return o.(string) == importedImage
+}
+
+// suppressImportedDiffs adds suppressImported to the schema and the
+// attributes of its blocks.
+func suppressImportedDiffs(s *schema.Schema) *schema.Schema {
+	suppress := s.DiffSuppressFunc
+	s.DiffSuppressFunc = func(k, old, new string, d *schema.ResourceData) bool {
+		return suppressImported(k, old, new, d) || (suppress != nil && suppress(k, old, new, d))
+	}
+	if r, ok := s.Elem.(*schema.Resource); ok {
+		for _, attr := range r.Schema {
+			suppressImportedDiffs(attr)
+		}
+	}
+	return s
+}
@@ -0,0 +1,216 @@
+package provider
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/go-test/deep"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/terraform"
+)
+
+const vagrantVMInfo = `name="vagrant_default"
+storagecontrollername0="IDE Controller"
+storagecontrollertype0="PIIX4"
+storagecontrollerportcount0="2"
+storagecontrollerbootable0="on"
+storagecontrollername1="SATA Controller"
+storagecontrollertype1="IntelAhci"
+storagecontrollerportcount1="2"
+storagecontrollerbootable1="off"
+"IDE Controller-0-0"="none"
+"IDE Controller-1-0"="/isos/tools.iso"
+"IDE Controller-IsEjected-1-0"="off"
+"SATA Controller-0-0"="/vms/vagrant_default/box-disk001.vmdk"
+"SATA Controller-1-0"="none"
+`
+
+func TestImportStorage(t *testing.T) {
+	controllers, diskController, opticalController := importStorage(parseVMInfo(vagrantVMInfo))
+
+	want := []any{
+		map[string]any{
+			"name": "IDE Controller", "bus": "ide", "chipset": "PIIX4",
+			"port_count": 2, "host_io_cache": true, "bootable": true,
+		},
+		map[string]any{
+			"name": "SATA Controller", "bus": "sata", "chipset": "IntelAHCI",
+			"port_count": 2, "host_io_cache": true, "bootable": false,
+		},
+	}
+	if diff := deep.Equal(controllers, want); diff != nil {
+		t.Errorf("importStorage() controllers diff = %v", diff)
+	}
+	if diskController != "SATA Controller" {
+		t.Errorf("importStorage() disk controller = %q, want %q", diskController, "SATA Controller")
+	}
+	if opticalController != "IDE Controller" {
+		t.Errorf("importStorage() optical controller = %q, want %q", opticalController, "IDE Controller")
+	}
+}
+
+const dataDisksVMInfo = `name="vm"
+storagecontrollername0="IDE"
+storagecontrollertype0="PIIX4"
+storagecontrollerportcount0="2"
+storagecontrollername1="SATA"
+storagecontrollertype1="IntelAhci"
+storagecontrollerportcount1="3"
+"IDE-0-0"="/vms/vm/seed.iso"
+"IDE-IsEjected-0-0"="off"
+"IDE-0-1"="none"
+"IDE-1-0"="none"
+"IDE-1-1"="none"
+"SATA-0-0"="/vms/vm/box-disk001.vmdk"
+"SATA-1-0"="/vms/vm/data.vdi"
+"SATA-2-0"="/vms/vm/logs.vmdk"
+`
+
+func TestImportDataDisks(t *testing.T) {
+	media := map[string]string{
+		"/vms/vm/data.vdi":  "Storage format: VDI\nFormat variant: dynamic default\nCapacity:       20480 MBytes\n",
+		"/vms/vm/logs.vmdk": "Storage format: VMDK\nFormat variant: fixed default\nCapacity:       1024 MBytes\n",
+	}
+	var calls []string
+	p := &providerMeta{run: func(ctx context.Context, args ...string) (string, string, error) {
+		calls = append(calls, strings.Join(args, " "))
+		return media[args[len(args)-1]], "", nil
+	}}
+
+	got, err := importDataDisks(context.Background(), p, parseVMInfo(dataDisksVMInfo))
+	if err != nil {
+		t.Fatalf("importDataDisks() = %v", err)
+	}
+	want := []dataDisk{
+		{Size: "20480mib", Format: "vdi", Variant: "Standard", Controller: "SATA", Port: 1, Path: "/vms/vm/data.vdi"},
+		{Size: "1024mib", Format: "vmdk", Variant: "Fixed", Controller: "SATA", Port: 2, Path: "/vms/vm/logs.vmdk"},
+	}
+	if diff := deep.Equal(got, want); diff != nil {
+		t.Errorf("importDataDisks() diff = %v", diff)
+	}
+	wantCalls := []string{
+		"showmediuminfo disk /vms/vm/data.vdi",
+		"showmediuminfo disk /vms/vm/logs.vmdk",
+	}
+	if diff := deep.Equal(calls, wantCalls); diff != nil {
+		t.Errorf("VBoxManage calls diff = %v", diff)
+	}
+}
+
+func TestSuppressImported(t *testing.T) {
+	config := terraform.NewResourceConfigRaw(map[string]any{
+		"name":        "vagrant_default",
+		"vagrant_box": []any{map[string]any{"name": "hashicorp/bionic64"}},
+		"clone_mode":  "linked",
+	})
+
+	for image, wantNew := range map[string]bool{importedImage: false, "ubuntu.box": true} {
+		state := &terraform.InstanceState{
+			ID: "uuid",
+			Attributes: map[string]string{
+				"name":                      "vagrant_default",
+				"image":                     image,
+				"clone_mode":                "full",
+				"storage_controller.#":      "1",
+				"storage_controller.0.name": "SATA Controller",
+				"storage_controller.0.bus":  "sata",
+				"disk_controller":           "SATA Controller",
+			},
+		}
+		diff, err := resourceVM().Diff(context.Background(), state, config, nil)
+		if err != nil {
+			t.Fatalf("Diff() = %v", err)
+		}
+		if diff.RequiresNew() != wantNew {
+			t.Errorf("image %q: Diff() requires new = %v, want %v", image, diff.RequiresNew(), wantNew)
+		}
+	}
+}
+
+// importVBoxManage fakes VBoxManage for a powered off VM with a primary
+// disk and two data disks.
+func importVBoxManage(ctx context.Context, args ...string) (string, string, error) {
+	switch args[0] {
+	case "showvminfo":
+		return `name="vm"
+UUID="c8b4a2c1-0d4e-4a8b-9d0a-1f2e3d4c5b6a"
+CfgFile="/vms/vm/vm.vbox"
+ostype="Ubuntu (64-bit)"
+firmware="BIOS"
+chipset="piix3"
+paravirtprovider="default"
+VMState="poweroff"
+memory=1024
+vram=20
+cpus=2
+cpuexecutioncap=100
+nested-hw-virt="off"
+pae="on"
+longmode="on"
+hwvirtex="on"
+nestedpaging="on"
+largepages="on"
+vtxvpid="on"
+vtxux="on"
+nic1="nat"
+nictype1="82545EM"
+macaddress1="080027000001"
+cableconnected1="on"
+` + dataDisksVMInfo[len(`name="vm"`)+1:], "", nil
+	case "showmediuminfo":
+		switch args[2] {
+		case "/vms/vm/data.vdi":
+			return "Storage format: VDI\nFormat variant: dynamic default\nCapacity:       20480 MBytes\n", "", nil
+		case "/vms/vm/logs.vmdk":
+			return "Storage format: VMDK\nFormat variant: fixed default\nCapacity:       1024 MBytes\n", "", nil
+		}
+		return "Storage format: VMDK\nCapacity:       10240 MBytes\n", "", nil
+	case "list":
+		return "ID:          Ubuntu_64\nDescription: Ubuntu (64-bit)\n", "", nil
+	case "getextradata", "guestproperty":
+		return "No value set!\n", "", nil
+	}
+	return "", "", nil
+}
+
+func TestResourceVMImport_plan(t *testing.T) {
+	p := &providerMeta{run: importVBoxManage}
+	r := resourceVM()
+	d := r.TestResourceData()
+	d.SetId("vm")
+
+	imported, err := resourceVMImport(context.Background(), d, p)
+	if err != nil {
+		t.Fatalf("resourceVMImport() = %v", err)
+	}
+	d = imported[0]
+	if diags := resourceVMRead(context.Background(), d, p); diags.HasError() {
+		t.Fatalf("resourceVMRead() = %v", diags)
+	}
+
+	config := terraform.NewResourceConfigRaw(map[string]any{
+		"name":          "vm",
+		"image":         "https://example.com/ubuntu.box",
+		"checksum":      "sha256:9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",
+		"user_data":     "#cloud-config\n",
+		"cpus":          2,
+		"memory":        "1.0 gib",
+		"os_type":       "Ubuntu_64",
+		"status":        "poweroff",
+		"optical_disks": []any{"/vms/vm/seed.iso"},
+		"disk": []any{
+			map[string]any{"size": "20gib", "controller": "SATA", "port": 1},
+			map[string]any{"size": "1024mib", "format": "vmdk", "variant": "Fixed", "controller": "SATA", "port": 2},
+		},
+		"network_adapter": []any{map[string]any{"type": "nat"}},
+	})
+	diff, err := r.Diff(context.Background(), d.State(), config, p)
+	if err != nil {
+		t.Fatalf("Diff() = %v", err)
+	}
+	if diff != nil && !diff.Empty() {
+		for k, a := range diff.Attributes {
+			t.Errorf("Diff() after import changes %s: %+v", k, *a)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package provider
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// isoSectorSize is the logical block size of ISO9660 images.
+const isoSectorSize = 2048
+
+// Sector layout of the images written by writeISO. The file data follows the
+// root directories.
+const (
+	isoPrimaryDescriptor = 16
+	isoJolietDescriptor  = 17
+	isoTerminator        = 18
+	isoPrimaryPathL      = 19
+	isoPrimaryPathM      = 20
+	isoJolietPathL       = 21
+	isoJolietPathM       = 22
+	isoPrimaryRoot       = 23
+	isoJolietRoot        = 24
+	isoFirstFile         = 25
+)
+
+// isoFile is a file in the root directory of an ISO9660 image.
+type isoFile struct {
+	Name string
+	Data []byte
+}
+
+// writeISO writes a single directory ISO9660 image with the volume label and
+// files to w. The file names are kept as is in the Joliet extension, the
+// primary volume descriptor gets their uppercase form, which Linux maps back
+// to lowercase when Joliet is not used.
+func writeISO(w io.Writer, label string, files []isoFile, modTime time.Time) error {
+	files = append([]isoFile(nil), files...)
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+
+	// Both root directories must fit into a single sector.
+	extents := make([]uint32, len(files))
+	next := uint32(isoFirstFile)
+	for i, f := range files {
+		extents[i] = next
+		next += isoSectors(len(f.Data))
+	}
+	total := next
+
+	primaryRoot, err := isoRootDirectory(isoPrimaryRoot, files, extents, modTime, isoPrimaryName)
+	if err != nil {
+		return err
+	}
+	jolietRoot, err := isoRootDirectory(isoJolietRoot, files, extents, modTime, isoJolietName)
+	if err != nil {
+		return err
+	}
+
+	img := make([]byte, int(total)*isoSectorSize)
+	sector := func(n uint32) []byte {
+		return img[int(n)*isoSectorSize : int(n+1)*isoSectorSize]
+	}
+
+	isoVolumeDescriptor(sector(isoPrimaryDescriptor), 1, label, total, isoPrimaryPathL, isoPrimaryPathM, isoPrimaryRoot, modTime)
+	isoVolumeDescriptor(sector(isoJolietDescriptor), 2, label, total, isoJolietPathL, isoJolietPathM, isoJolietRoot, modTime)
+	terminator := sector(isoTerminator)
+	terminator[0] = 255
+	copy(terminator[1:6], "CD001")
+	terminator[6] = 1
+
+	isoPathTable(sector(isoPrimaryPathL), binary.LittleEndian, isoPrimaryRoot)
+	isoPathTable(sector(isoPrimaryPathM), binary.BigEndian, isoPrimaryRoot)
+	isoPathTable(sector(isoJolietPathL), binary.LittleEndian, isoJolietRoot)
+	isoPathTable(sector(isoJolietPathM), binary.BigEndian, isoJolietRoot)
+
+	copy(sector(isoPrimaryRoot), primaryRoot)
+	copy(sector(isoJolietRoot), jolietRoot)
+
+	for i, f := range files {
+		copy(img[int(extents[i])*isoSectorSize:], f.Data)
+	}
+
+	_, err = w.Write(img)
+	return err
+}
+
+// isoSectors returns the number of sectors needed for size bytes.
+func isoSectors(size int) uint32 {
+	return uint32((size + isoSectorSize - 1) / isoSectorSize)
+}
+
+// isoPrimaryName returns the file identifier of the primary volume
+// descriptor.
+func isoPrimaryName(name string) []byte {
+	name = strings.ToUpper(name)
+	if !strings.Contains(name, ".") {
+		name += "."
+	}
+	return []byte(name + ";1")
+}
+
+// isoJolietName returns the file identifier of the Joliet volume descriptor,
+// which is UCS-2 big endian.
+func isoJolietName(name string) []byte {
+	return isoUCS2(name)
+}
+
+func isoUCS2(s string) []byte {
+	units := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(units))
+	for i, u := range units {
+		binary.BigEndian.PutUint16(b[2*i:], u)
+	}
+	return b
+}
+
+// isoRootDirectory returns the records of the root directory at sector root.
+func isoRootDirectory(root uint32, files []isoFile, extents []uint32, modTime time.Time, name func(string) []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(isoDirectoryRecord([]byte{0}, root, isoSectorSize, true, modTime))
+	buf.Write(isoDirectoryRecord([]byte{1}, root, isoSectorSize, true, modTime))
+	for i, f := range files {
+		buf.Write(isoDirectoryRecord(name(f.Name), extents[i], uint32(len(f.Data)), false, modTime))
+	}
+	if buf.Len() > isoSectorSize {
+		return nil, fmt.Errorf("too many files for an ISO9660 root directory")
+	}
+	return buf.Bytes(), nil
+}
+
+// isoDirectoryRecord returns a directory record, padded to an even length.
+func isoDirectoryRecord(name []byte, extent, size uint32, dir bool, modTime time.Time) []byte {
+	n := 33 + len(name)
+	if n%2 == 1 {
+		n++
+	}
+	r := make([]byte, n)
+	r[0] = byte(n)
+	isoBothUint32(r[2:10], extent)
+	isoBothUint32(r[10:18], size)
+	t := modTime.UTC()
+	r[18] = byte(t.Year() - 1900)
+	r[19] = byte(t.Month())
+	r[20] = byte(t.Day())
+	r[21] = byte(t.Hour())
+	r[22] = byte(t.Minute())
+	r[23] = byte(t.Second())
+	if dir {
+		r[25] = 2
+	}
+	isoBothUint16(r[28:32], 1)
+	r[32] = byte(len(name))
+	copy(r[33:], name)
+	return r
+}
+
+// isoVolumeDescriptor fills a primary (typ 1) or Joliet supplementary (typ 2)
+// volume descriptor.
+func isoVolumeDescriptor(b []byte, typ byte, label string, total, pathL, pathM, root uint32, modTime time.Time) {
+	text := func(s string, size int) []byte {
+		if typ == 2 {
+			out := isoUCS2(s)
+			for len(out) < size {
+				out = append(out, 0, ' ')
+			}
+			return out[:size]
+		}
+		return []byte(fmt.Sprintf("%-*s", size, s)[:size])
+	}
+
+	b[0] = typ
+	copy(b[1:6], "CD001")
+	b[6] = 1
+	copy(b[8:40], text("", 32))
+	copy(b[40:72], text(label, 32))
+	isoBothUint32(b[80:88], total)
+	if typ == 2 {
+		// UCS-2 level 3 escape sequence.
+		copy(b[88:91], "%/E")
+	}
+	isoBothUint16(b[120:124], 1)
+	isoBothUint16(b[124:128], 1)
+	isoBothUint16(b[128:132], isoSectorSize)
+	isoBothUint32(b[132:140], 10)
+	binary.LittleEndian.PutUint32(b[140:144], pathL)
+	binary.BigEndian.PutUint32(b[148:152], pathM)
+	copy(b[156:190], isoDirectoryRecord([]byte{0}, root, isoSectorSize, true, modTime))
+	copy(b[190:318], text("", 128))
+	copy(b[318:446], text("", 128))
+	copy(b[446:574], text("", 128))
+	copy(b[574:702], text("", 128))
+	copy(b[702:739], text("", 37))
+	copy(b[739:776], text("", 37))
+	copy(b[776:813], text("", 37))
+	date := []byte(modTime.UTC().Format("20060102150405") + "00")
+	copy(b[813:830], date)
+	copy(b[830:847], date)
+	copy(b[847:864], "0000000000000000")
+	copy(b[864:881], "0000000000000000")
+	b[881] = 1
+}
+
+// isoPathTable fills a path table with the root directory as only entry.
+func isoPathTable(b []byte, order binary.ByteOrder, root uint32) {
+	b[0] = 1
+	order.PutUint32(b[2:6], root)
+	order.PutUint16(b[6:8], 1)
+}
+
+func isoBothUint32(b []byte, v uint32) {
+	binary.LittleEndian.PutUint32(b[0:4], v)
+	binary.BigEndian.PutUint32(b[4:8], v)
+}
+
+func isoBothUint16(b []byte, v uint16) {
+	binary.LittleEndian.PutUint16(b[0:2], v)
+	binary.BigEndian.PutUint16(b[2:4], v)
+}
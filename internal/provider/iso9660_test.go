@@ -0,0 +1,94 @@
+package provider
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf16"
+
+	"github.com/go-test/deep"
+)
+
+// readISORoot returns the files of the root directory described by the volume
+// descriptor at sector, decoding the names with decode.
+func readISORoot(t *testing.T, img []byte, sector int, decode func([]byte) string) map[string]string {
+	t.Helper()
+	vd := img[sector*isoSectorSize:]
+	if string(vd[1:6]) != "CD001" {
+		t.Fatalf("sector %d is no volume descriptor", sector)
+	}
+	root := binary.LittleEndian.Uint32(vd[156+2:])
+	size := binary.LittleEndian.Uint32(vd[156+10:])
+
+	files := map[string]string{}
+	dir := img[int(root)*isoSectorSize : int(root)*isoSectorSize+int(size)]
+	for len(dir) > 0 && dir[0] > 0 {
+		n := int(dir[0])
+		rec := dir[:n]
+		dir = dir[n:]
+		if rec[25]&2 != 0 {
+			continue
+		}
+		extent := binary.LittleEndian.Uint32(rec[2:])
+		length := binary.LittleEndian.Uint32(rec[10:])
+		name := decode(rec[33 : 33+int(rec[32])])
+		files[name] = string(img[int(extent)*isoSectorSize : int(extent)*isoSectorSize+int(length)])
+	}
+	return files
+}
+
+func decodeUCS2(b []byte) string {
+	units := make([]uint16, len(b)/2)
+	for i := range units {
+		units[i] = binary.BigEndian.Uint16(b[2*i:])
+	}
+	return string(utf16.Decode(units))
+}
+
+func TestWriteISO(t *testing.T) {
+	large := strings.Repeat("x", 3*isoSectorSize+1)
+	files := []isoFile{
+		{Name: "user-data", Data: []byte("#cloud-config\n")},
+		{Name: "meta-data", Data: []byte("instance-id: vm\n")},
+		{Name: "network-config", Data: []byte(large)},
+	}
+
+	var buf bytes.Buffer
+	if err := writeISO(&buf, "cidata", files, time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)); err != nil {
+		t.Fatalf("writeISO() = %v", err)
+	}
+	img := buf.Bytes()
+	if len(img)%isoSectorSize != 0 {
+		t.Fatalf("image size %d is not a multiple of the sector size", len(img))
+	}
+	if got := binary.LittleEndian.Uint32(img[isoPrimaryDescriptor*isoSectorSize+80:]); int(got)*isoSectorSize != len(img) {
+		t.Errorf("volume space size = %d sectors, image has %d bytes", got, len(img))
+	}
+
+	label := strings.TrimSpace(string(img[isoPrimaryDescriptor*isoSectorSize+40 : isoPrimaryDescriptor*isoSectorSize+72]))
+	if label != "cidata" {
+		t.Errorf("volume label = %q, want cidata", label)
+	}
+	if img[isoTerminator*isoSectorSize] != 255 {
+		t.Error("missing volume descriptor set terminator")
+	}
+
+	want := map[string]string{
+		"user-data":      "#cloud-config\n",
+		"meta-data":      "instance-id: vm\n",
+		"network-config": large,
+	}
+	joliet := readISORoot(t, img, isoJolietDescriptor, decodeUCS2)
+	if diff := deep.Equal(joliet, want); diff != nil {
+		t.Errorf("Joliet files diff = %v", diff)
+	}
+
+	primary := readISORoot(t, img, isoPrimaryDescriptor, func(b []byte) string {
+		return strings.TrimSuffix(strings.ToLower(string(b)), ".;1")
+	})
+	if diff := deep.Equal(primary, want); diff != nil {
+		t.Errorf("primary files diff = %v", diff)
+	}
+}
@@ -0,0 +1,210 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	vbox "github.com/terra-farm/go-virtualbox"
+)
+
+// resourceChanges is implemented by both schema.ResourceData and
+// schema.ResourceDiff.
+type resourceChanges interface {
+	Id() string
+	Get(key string) any
+	GetChange(key string) (any, any)
+	HasChange(key string) bool
+}
+
+// coldAttributes are the attributes whose changes are only applied to a
+// powered off VM. Changes of network_adapter and cpus are only cold in some
+// cases, see coldChanges. Changes of the remaining attributes are applied to
+// the running VM, replace the VM, or only matter when it is created.
+var coldAttributes = []string{
+	"boot_order",
+	"chipset",
+	"cpu_features",
+	"cpu_hotplug",
+	"cpus",
+	"disk",
+	"disk_size",
+	"firmware",
+	"max_cpus",
+	"memory",
+	"meta_data",
+	"nested_virtualization",
+	"network_adapter",
+	"network_config",
+	"os_type",
+	"paravirt_provider",
+	"user_data",
+	"vram",
+}
+
+// storedAttributes are the attributes whose changes are only stored without
+// touching the VM, they either only matter when the VM is created or are
+// planned by the provider.
+var storedAttributes = []string{"image_download", "checksum", "checksum_type", "pending_restart"}
+
+// liveNetworkAdapterAttributes are the attributes of the network adapters
+// which are either changed live or computed.
+var liveNetworkAdapterAttributes = map[string]bool{
+	"cable_connected":        true,
+	"link_speed":             true,
+	"status":                 true,
+	"mac_address":            true,
+	"ipv4_address":           true,
+	"ipv4_address_available": true,
+}
+
+// coldChanges returns the changed attributes which can only be applied to a
+// powered off VM, sorted.
+func coldChanges(d resourceChanges) []string {
+	var changes []string
+	for _, key := range coldAttributes {
+		if !d.HasChange(key) {
+			continue
+		}
+		switch key {
+		case "network_adapter":
+			if !networkAdaptersChangeLive(d.GetChange(key)) {
+				changes = append(changes, key)
+			}
+		case "cpus":
+			if !cpusChangeLive(d) {
+				changes = append(changes, key)
+			}
+		default:
+			changes = append(changes, key)
+		}
+	}
+	return changes
+}
+
+// networkAdaptersChangeLive reports whether the network adapters only differ
+// in the attributes which are changed live.
+func networkAdaptersChangeLive(o, n any) bool {
+	old, wanted := o.([]any), n.([]any)
+	if len(old) != len(wanted) {
+		return false
+	}
+	for i := range old {
+		oa, _ := old[i].(map[string]any)
+		na, _ := wanted[i].(map[string]any)
+		for key, v := range na {
+			if !liveNetworkAdapterAttributes[key] && v != oa[key] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// cpusChangeLive reports whether the CPUs can be plugged into or unplugged
+// from the running VM, which needs CPU hot-plugging before and after the
+// change.
+func cpusChangeLive(d resourceChanges) bool {
+	o, n := d.GetChange("cpu_hotplug")
+	if !o.(bool) || !n.(bool) || d.HasChange("max_cpus") {
+		return false
+	}
+	return d.Get("cpus").(int) <= maxCPUs(d)
+}
+
+// applyLiveChanges applies the changes of the live attributes to the running
+// VM. errOpticalDrivesMissing is returned before anything is changed if the
+// optical disks need more drives.
+func applyLiveChanges(ctx context.Context, p *providerMeta, d *schema.ResourceData, vm *vbox.Machine, layout storageLayout) error {
+	if d.HasChanges("optical_disks", "copy_optical_disks") {
+		if err := updateOpticalDisks(ctx, p, vm.UUID, vm.BaseFolder, layout.OpticalController,
+			expandStrings(d.Get("optical_disks").([]any)), d.Get("copy_optical_disks").(bool), true); err != nil {
+			return err
+		}
+	}
+
+	if d.HasChange("network_adapter") {
+		o, n := d.GetChange("network_adapter")
+		old := o.([]any)
+		for i, raw := range n.([]any) {
+			var oa map[string]any
+			if i < len(old) {
+				oa, _ = old[i].(map[string]any)
+			}
+			na := raw.(map[string]any)
+			if connected := na["cable_connected"].(bool); oa == nil || oa["cable_connected"] != connected {
+				tflog.Debug(ctx, "changing link state", map[string]any{
+					"adapter":   i + 1,
+					"connected": connected,
+				})
+				if _, stderr, err := p.run(ctx, "controlvm", vm.UUID, "setlinkstate"+strconv.Itoa(i+1), onOff(connected)); err != nil {
+					return fmt.Errorf("unable to change link state of network adapter %d: %w: %s", i+1, err, stderr)
+				}
+			}
+			if speed := na["link_speed"].(int); oa == nil || oa["link_speed"] != speed {
+				tflog.Debug(ctx, "changing link speed", map[string]any{
+					"adapter": i + 1,
+					"speed":   speed,
+				})
+				if _, stderr, err := p.run(ctx, "controlvm", vm.UUID, "nicspeed"+strconv.Itoa(i+1), strconv.Itoa(speed)); err != nil {
+					return fmt.Errorf("unable to change link speed of network adapter %d: %w: %s", i+1, err, stderr)
+				}
+			}
+		}
+	}
+
+	if d.HasChange("cpu_execution_cap") {
+		if _, stderr, err := p.run(ctx, "controlvm", vm.UUID,
+			"cpuexecutioncap", strconv.Itoa(d.Get("cpu_execution_cap").(int))); err != nil {
+			return fmt.Errorf("unable to change CPU execution cap: %w: %s", err, stderr)
+		}
+	}
+
+	if d.HasChange("cpus") {
+		o, n := d.GetChange("cpus")
+		if err := plugCPUs(ctx, p, vm.UUID, o.(int), n.(int), true); err != nil {
+			return err
+		}
+	}
+
+	if d.HasChange("guest_properties") {
+		o, n := d.GetChange("guest_properties")
+		if err := updateGuestProperties(ctx, p, vm.UUID, o.(map[string]any), n.(map[string]any)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setPendingRestart plans the pending_restart attribute with the changes
+// which power the VM off and bring it back into its state. The attribute is
+// kept after the apply, and only planned again with the next change.
+func setPendingRestart(ctx context.Context, d *schema.ResourceDiff) error {
+	if d.Id() == "" || !hasChanges(d) {
+		return nil
+	}
+	var changes []string
+	if d.Get("status").(string) != "poweroff" && !d.HasChange("status") {
+		changes = coldChanges(d)
+	}
+
+	if len(changes) > 0 {
+		tflog.Warn(ctx, "the VM will be restarted to apply the changes", map[string]any{
+			"vm":      d.Get("name"),
+			"changes": changes,
+		})
+	}
+	return d.SetNew("pending_restart", changes)
+}
+
+// hasChanges reports whether any attribute besides pending_restart changes.
+func hasChanges(d *schema.ResourceDiff) bool {
+	for key := range resourceVM().Schema {
+		if key != "pending_restart" && d.HasChange(key) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,150 @@
+package provider
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-test/deep"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/terraform"
+	vbox "github.com/terra-farm/go-virtualbox"
+)
+
+// fakeChanges is a resourceChanges with the old and new values of the
+// attributes, unset attributes are unchanged.
+type fakeChanges struct {
+	old, new map[string]any
+}
+
+func (f fakeChanges) Id() string { return "vm" }
+
+func (f fakeChanges) Get(key string) any {
+	if v, ok := f.new[key]; ok {
+		return v
+	}
+	return resourceVM().Schema[key].ZeroValue()
+}
+
+func (f fakeChanges) GetChange(key string) (any, any) {
+	o, ok := f.old[key]
+	if !ok {
+		o = f.Get(key)
+	}
+	return o, f.Get(key)
+}
+
+func (f fakeChanges) HasChange(key string) bool {
+	o, n := f.GetChange(key)
+	return deep.Equal(o, n) != nil
+}
+
+func TestColdChanges(t *testing.T) {
+	nic := func(connected bool, device string) []any {
+		return []any{map[string]any{"type": "nat", "device": device, "cable_connected": connected, "status": "up"}}
+	}
+
+	testCases := map[string]struct {
+		old, new map[string]any
+		want     []string
+	}{
+		"live": {
+			old: map[string]any{
+				"status":            "poweroff",
+				"guest_properties":  map[string]any{},
+				"cpu_execution_cap": 100,
+				"network_adapter":   nic(true, "IntelPro1000MT_Desktop"),
+			},
+			new: map[string]any{
+				"status":            "running",
+				"guest_properties":  map[string]any{"/a": "b"},
+				"cpu_execution_cap": 50,
+				"network_adapter":   nic(false, "IntelPro1000MT_Desktop"),
+			},
+		},
+		"network device": {
+			old:  map[string]any{"network_adapter": nic(true, "IntelPro1000MT_Desktop")},
+			new:  map[string]any{"network_adapter": nic(true, "VirtIO")},
+			want: []string{"network_adapter"},
+		},
+		"cold": {
+			old:  map[string]any{"memory": "512 mib", "vram": 20},
+			new:  map[string]any{"memory": "1 gib", "vram": 128},
+			want: []string{"memory", "vram"},
+		},
+		"link speed": {
+			old: map[string]any{"network_adapter": []any{map[string]any{"type": "nat", "link_speed": 0}}},
+			new: map[string]any{"network_adapter": []any{map[string]any{"type": "nat", "link_speed": 100000}}},
+		},
+		"create only": {
+			old: map[string]any{"checksum": "", "image_download": []any{}},
+			new: map[string]any{"checksum": "sha256:abc", "image_download": []any{map[string]any{"retries": 5}}},
+		},
+		"force new": {
+			old: map[string]any{"image": "a.box"},
+			new: map[string]any{"image": "b.box"},
+		},
+		"cpus with hotplug": {
+			old: map[string]any{"cpu_hotplug": true, "max_cpus": 4, "cpus": 2},
+			new: map[string]any{"cpu_hotplug": true, "max_cpus": 4, "cpus": 3},
+		},
+		"cpus above max": {
+			old:  map[string]any{"cpu_hotplug": true, "max_cpus": 4, "cpus": 2},
+			new:  map[string]any{"cpu_hotplug": true, "max_cpus": 8, "cpus": 6},
+			want: []string{"cpus", "max_cpus"},
+		},
+		"cpus without hotplug": {
+			old:  map[string]any{"cpus": 2},
+			new:  map[string]any{"cpus": 3},
+			want: []string{"cpus"},
+		},
+		"enable hotplug": {
+			old:  map[string]any{"cpu_hotplug": false, "cpus": 2},
+			new:  map[string]any{"cpu_hotplug": true, "cpus": 2},
+			want: []string{"cpu_hotplug"},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			got := coldChanges(fakeChanges{old: tc.old, new: tc.new})
+			if diff := deep.Equal(got, tc.want); diff != nil {
+				t.Errorf("coldChanges() diff = %v", diff)
+			}
+		})
+	}
+}
+
+func TestApplyLiveChanges_networkAdapter(t *testing.T) {
+	r := resourceVM()
+	raw := func(adapter map[string]any) map[string]any {
+		return map[string]any{
+			"name":            "vm",
+			"image":           "image.box",
+			"network_adapter": []any{adapter},
+		}
+	}
+	old := schema.TestResourceDataRaw(t, r.Schema, raw(map[string]any{"type": "nat"}))
+	old.SetId("vm")
+	config := terraform.NewResourceConfigRaw(raw(map[string]any{"type": "nat", "cable_connected": false, "link_speed": 100000}))
+	diff, err := r.Diff(context.Background(), old.State(), config, nil)
+	if err != nil {
+		t.Fatalf("Diff() = %v", err)
+	}
+	d, err := schema.InternalMap(r.Schema).Data(old.State(), diff)
+	if err != nil {
+		t.Fatalf("Data() = %v", err)
+	}
+
+	fake := &fakeVBoxManage{}
+	p := &providerMeta{run: fake.run}
+	if err := applyLiveChanges(context.Background(), p, d, &vbox.Machine{UUID: "vm"}, expandStorageLayout(d.Get)); err != nil {
+		t.Fatalf("applyLiveChanges() = %v", err)
+	}
+	want := []string{
+		"controlvm vm setlinkstate1 off",
+		"controlvm vm nicspeed1 100000",
+	}
+	if diff := deep.Equal(fake.calls, want); diff != nil {
+		t.Errorf("VBoxManage calls diff = %v", diff)
+	}
+}
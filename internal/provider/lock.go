@@ -0,0 +1,145 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+)
+
+// defaultImageLockTimeout is how long to wait for the lock of a gold image
+// when the provider does not configure it.
+const defaultImageLockTimeout = 30 * time.Minute
+
+// lockRetryInterval is how often a held lock is retried.
+const lockRetryInterval = 500 * time.Millisecond
+
+// errLocked is returned by the platform specific tryLock when the lock is held
+// by someone else.
+var errLocked = errors.New("lock is held by another process")
+
+// LockTimeoutError is returned when the lock could not be acquired in time.
+type LockTimeoutError struct {
+	Path   string
+	Holder lockHolder
+}
+
+func (e *LockTimeoutError) Error() string {
+	return fmt.Sprintf("timed out waiting for lock %s held by pid %d on %s since %s",
+		e.Path, e.Holder.PID, e.Holder.Hostname, e.Holder.Acquired.Format(time.RFC3339))
+}
+
+// lockHolder is written into the lock file by the process holding the lock, so
+// waiting processes can report who they are waiting for. It is not cleared on
+// unlock, so it may describe a previous holder.
+type lockHolder struct {
+	PID      int       `json:"pid"`
+	Hostname string    `json:"hostname"`
+	Acquired time.Time `json:"acquired"`
+}
+
+// fileLock is an advisory lock held on a file, which serializes access to a
+// resource across processes. This allows multiple Terraform runs to share the
+// same gold folder.
+type fileLock struct {
+	path string
+	f    *os.File
+}
+
+// imageLockPath returns the path of the lock file protecting the gold image in
+// goldPath. It lives next to the gold image, as the image folder itself is
+// replaced when it is unpacked.
+func imageLockPath(goldPath string) string {
+	return goldPath + ".lock"
+}
+
+// acquireLock acquires the lock on path, waiting for at most timeout. Locks
+// are released by the operating system when their holder exits, so they are
+// never stale.
+func acquireLock(ctx context.Context, path string, timeout time.Duration) (*fileLock, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	hostname, _ := os.Hostname()
+	logged := false
+	for {
+		l, err := tryLockFile(path)
+		if err == nil {
+			l.writeHolder(lockHolder{
+				PID:      os.Getpid(),
+				Hostname: hostname,
+				Acquired: time.Now(),
+			})
+			return l, nil
+		}
+		if !errors.Is(err, errLocked) {
+			return nil, fmt.Errorf("unable to lock %s: %w", path, err)
+		}
+
+		holder := readLockHolder(path)
+		if !logged {
+			tflog.Info(ctx, "waiting for lock", map[string]any{
+				"path":     path,
+				"pid":      holder.PID,
+				"hostname": holder.Hostname,
+			})
+			logged = true
+		}
+
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return nil, &LockTimeoutError{Path: path, Holder: holder}
+			}
+			return nil, ctx.Err()
+		case <-time.After(lockRetryInterval):
+		}
+	}
+}
+
+// tryLockFile makes a single attempt to lock the file at path.
+func tryLockFile(path string) (*fileLock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &fileLock{path: path, f: f}, nil
+}
+
+func (l *fileLock) writeHolder(holder lockHolder) {
+	b, err := json.Marshal(holder)
+	if err != nil {
+		return
+	}
+	// The holder information is only informational, so errors are ignored.
+	if err := l.f.Truncate(0); err != nil {
+		return
+	}
+	_, _ = l.f.WriteAt(b, 0)
+}
+
+func readLockHolder(path string) lockHolder {
+	var holder lockHolder
+	if b, err := os.ReadFile(path); err == nil {
+		_ = json.Unmarshal(b, &holder)
+	}
+	return holder
+}
+
+// Unlock releases the lock. The lock file is kept, removing it would race with
+// other processes which already opened it.
+func (l *fileLock) Unlock() error {
+	if err := unlockFile(l.f); err != nil {
+		l.f.Close()
+		return fmt.Errorf("unable to unlock %s: %w", l.path, err)
+	}
+	return l.f.Close()
+}
@@ -0,0 +1,83 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAcquireLock(t *testing.T) {
+	path := imageLockPath(filepath.Join(t.TempDir(), "gold"))
+
+	lock, err := acquireLock(context.Background(), path, time.Second)
+	if err != nil {
+		t.Fatalf("acquireLock() = %v", err)
+	}
+
+	holder := readLockHolder(path)
+	if holder.PID != os.Getpid() {
+		t.Errorf("lock holder pid = %d, want %d", holder.PID, os.Getpid())
+	}
+
+	var timeout *LockTimeoutError
+	if _, err := acquireLock(context.Background(), path, time.Second); !errors.As(err, &timeout) {
+		t.Fatalf("acquireLock() of a held lock = %v, want LockTimeoutError", err)
+	}
+	if timeout.Holder.PID != os.Getpid() {
+		t.Errorf("LockTimeoutError holder pid = %d, want %d", timeout.Holder.PID, os.Getpid())
+	}
+
+	if err := lock.Unlock(); err != nil {
+		t.Fatalf("Unlock() = %v", err)
+	}
+
+	lock, err = acquireLock(context.Background(), path, time.Second)
+	if err != nil {
+		t.Fatalf("acquireLock() after unlock = %v", err)
+	}
+	if err := lock.Unlock(); err != nil {
+		t.Fatalf("Unlock() = %v", err)
+	}
+}
+
+func TestAcquireLock_canceled(t *testing.T) {
+	path := imageLockPath(filepath.Join(t.TempDir(), "gold"))
+
+	lock, err := acquireLock(context.Background(), path, time.Second)
+	if err != nil {
+		t.Fatalf("acquireLock() = %v", err)
+	}
+	defer lock.Unlock() //nolint:errcheck
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	if _, err := acquireLock(ctx, path, time.Minute); !errors.Is(err, context.Canceled) {
+		t.Errorf("acquireLock() = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestAcquireLock_deadHolder(t *testing.T) {
+	path := imageLockPath(filepath.Join(t.TempDir(), "gold"))
+
+	lock, err := acquireLock(context.Background(), path, time.Second)
+	if err != nil {
+		t.Fatalf("acquireLock() = %v", err)
+	}
+	defer lock.Unlock() //nolint:errcheck
+
+	// The holder information may name a process which has exited while the
+	// lock is held by another one, which must not be broken.
+	hostname, _ := os.Hostname()
+	lock.writeHolder(lockHolder{PID: 1 << 22, Hostname: hostname, Acquired: time.Now()})
+
+	var timeout *LockTimeoutError
+	if _, err := acquireLock(context.Background(), path, time.Second); !errors.As(err, &timeout) {
+		t.Fatalf("acquireLock() = %v, want LockTimeoutError", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("lock file = %v, want it kept", err)
+	}
+}
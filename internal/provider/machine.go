@@ -0,0 +1,191 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+	vbox "github.com/terra-farm/go-virtualbox"
+)
+
+// getMachine returns the VM with the UUID or name id, and
+// vbox.ErrMachineNotExist if there is none.
+func getMachine(ctx context.Context, p *providerMeta, id string) (*vbox.Machine, error) {
+	stdout, stderr, err := p.run(ctx, "showvminfo", id, "--machinereadable")
+	if err != nil {
+		if strings.Contains(stderr, "Could not find a registered machine") {
+			return nil, vbox.ErrMachineNotExist
+		}
+		return nil, fmt.Errorf("unable to get VM info of %s: %w: %s", id, err, stderr)
+	}
+	return parseMachine(parseVMInfo(stdout))
+}
+
+// parseMachine returns the VM described by the showvminfo output, with the
+// properties the go-virtualbox library knows about.
+func parseMachine(info vmInfo) (*vbox.Machine, error) {
+	vm := &vbox.Machine{
+		Name:       info["name"],
+		Firmware:   info["firmware"],
+		UUID:       info["UUID"],
+		State:      vbox.MachineState(info["VMState"]),
+		CfgFile:    info["CfgFile"],
+		BaseFolder: filepath.Dir(info["CfgFile"]),
+		BootOrder:  make([]string, 0, 4),
+		NICs:       make([]vbox.NIC, 0, 4),
+	}
+	for key, n := range map[string]*uint{"memory": &vm.Memory, "cpus": &vm.CPUs, "vram": &vm.VRAM} {
+		v, ok := info[key]
+		if !ok {
+			continue
+		}
+		u, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s of %s: %w", key, vm.Name, err)
+		}
+		*n = uint(u)
+	}
+
+	for i := 1; i <= 4; i++ {
+		network, ok := info[fmt.Sprintf("nic%d", i)]
+		if !ok || network == "none" {
+			break
+		}
+		nic := vbox.NIC{
+			Network:  vbox.NICNetwork(network),
+			Hardware: vbox.NICHardware(info[fmt.Sprintf("nictype%d", i)]),
+			MacAddr:  info[fmt.Sprintf("macaddress%d", i)],
+		}
+		if nic.Hardware == "" || nic.MacAddr == "" {
+			return nil, fmt.Errorf("network adapter %d of %s has no type or MAC address", i, vm.Name)
+		}
+		switch nic.Network {
+		case vbox.NICNetHostonly:
+			nic.HostInterface = info[fmt.Sprintf("hostonlyadapter%d", i)]
+		case vbox.NICNetBridged:
+			nic.HostInterface = info[fmt.Sprintf("bridgeadapter%d", i)]
+		}
+		vm.NICs = append(vm.NICs, nic)
+	}
+	return vm, nil
+}
+
+// modifyArgs returns the "VBoxManage modifyvm" arguments applying the
+// settings of the VM, which connect the cables of all network adapters.
+func modifyArgs(vm *vbox.Machine) []string {
+	args := []string{"modifyvm", vm.UUID,
+		"--firmware", vm.Firmware,
+		"--bioslogofadein", "off",
+		"--bioslogofadeout", "off",
+		"--bioslogodisplaytime", "0",
+		"--biosbootmenu", "disabled",
+
+		"--ostype", vm.OSType,
+		"--cpus", strconv.FormatUint(uint64(vm.CPUs), 10),
+		"--memory", strconv.FormatUint(uint64(vm.Memory), 10),
+		"--vram", strconv.FormatUint(uint64(vm.VRAM), 10),
+	}
+	for _, f := range []struct {
+		name string
+		flag vbox.Flag
+	}{
+		{"acpi", vbox.ACPI},
+		{"ioapic", vbox.IOAPIC},
+		{"rtcuseutc", vbox.RTCUSEUTC},
+		{"cpuhotplug", vbox.CPUHOTPLUG},
+		{"pae", vbox.PAE},
+		{"longmode", vbox.LONGMODE},
+		{"hpet", vbox.HPET},
+		{"hwvirtex", vbox.HWVIRTEX},
+		{"triplefaultreset", vbox.TRIPLEFAULTRESET},
+		{"nestedpaging", vbox.NESTEDPAGING},
+		{"largepages", vbox.LARGEPAGES},
+		{"vtxvpid", vbox.VTXVPID},
+		{"vtxux", vbox.VTXUX},
+		{"accelerate3d", vbox.ACCELERATE3D},
+	} {
+		args = append(args, "--"+f.name, vm.Flag.Get(f.flag))
+	}
+
+	for i, dev := range vm.BootOrder {
+		if i > 3 {
+			break // Only four slots --boot{1,2,3,4}
+		}
+		args = append(args, fmt.Sprintf("--boot%d", i+1), dev)
+	}
+	for i, nic := range vm.NICs {
+		n := i + 1
+		args = append(args,
+			fmt.Sprintf("--nic%d", n), string(nic.Network),
+			fmt.Sprintf("--nictype%d", n), string(nic.Hardware),
+			fmt.Sprintf("--cableconnected%d", n), "on")
+		switch nic.Network {
+		case vbox.NICNetHostonly:
+			args = append(args, fmt.Sprintf("--hostonlyadapter%d", n), nic.HostInterface)
+		case vbox.NICNetBridged:
+			args = append(args, fmt.Sprintf("--bridgeadapter%d", n), nic.HostInterface)
+		}
+	}
+	return args
+}
+
+// modifyMachine applies the settings of the powered off VM.
+func modifyMachine(ctx context.Context, p *providerMeta, vm *vbox.Machine) error {
+	if _, stderr, err := p.run(ctx, modifyArgs(vm)...); err != nil {
+		return fmt.Errorf("unable to modify VM %s: %w: %s", vm.UUID, err, stderr)
+	}
+	return nil
+}
+
+// createMachine creates and registers an empty VM in folder.
+func createMachine(ctx context.Context, p *providerMeta, name, folder string) (*vbox.Machine, error) {
+	if _, stderr, err := p.run(ctx, "createvm", "--name", name, "--basefolder", folder, "--register"); err != nil {
+		return nil, fmt.Errorf("unable to create VM %s: %w: %s", name, err, stderr)
+	}
+	return getMachine(ctx, p, name)
+}
+
+// deleteMachine unregisters the powered off VM and deletes its files,
+// including the attached disks.
+func deleteMachine(ctx context.Context, p *providerMeta, vmID string) error {
+	tflog.Debug(ctx, "deleting VM", map[string]any{
+		"vm": vmID,
+	})
+	if _, stderr, err := p.run(ctx, "unregistervm", vmID, "--delete"); err != nil {
+		return fmt.Errorf("unable to delete VM %s: %w: %s", vmID, err, stderr)
+	}
+	return nil
+}
+
+// getExtraData returns the value of the extra data key of the VM, and false
+// if it is not set.
+func getExtraData(ctx context.Context, p *providerMeta, vmID, key string) (string, bool, error) {
+	stdout, stderr, err := p.run(ctx, "getextradata", vmID, key)
+	if err != nil {
+		return "", false, fmt.Errorf("unable to get extra data %s of %s: %w: %s", key, vmID, err, stderr)
+	}
+	value, ok := parseValue(stdout)
+	return value, ok, nil
+}
+
+// parseValue returns the value printed by "VBoxManage getextradata" and
+// "VBoxManage guestproperty get" as "Value: <value>", and false if they print
+// that no value is set. Only the line break is trimmed, values may be empty.
+func parseValue(stdout string) (string, bool) {
+	out := strings.TrimRight(stdout, "\r\n")
+	if !strings.HasPrefix(out, "Value: ") {
+		return "", false
+	}
+	return strings.TrimPrefix(out, "Value: "), true
+}
+
+// setExtraData sets the extra data key of the VM.
+func setExtraData(ctx context.Context, p *providerMeta, vmID, key, value string) error {
+	if _, stderr, err := p.run(ctx, "setextradata", vmID, key, value); err != nil {
+		return fmt.Errorf("unable to set extra data %s of %s: %w: %s", key, vmID, err, stderr)
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/go-test/deep"
+	vbox "github.com/terra-farm/go-virtualbox"
+)
+
+const machineVMInfo = `name="vm"
+UUID="c8b4a2c1-0d4e-4a8b-9d0a-1f2e3d4c5b6a"
+CfgFile="/vms/vm/vm.vbox"
+firmware="BIOS"
+VMState="poweroff"
+memory=1024
+vram=16
+cpus=2
+nic1="nat"
+nictype1="82540EM"
+macaddress1="080027000001"
+nic2="hostonly"
+nictype2="virtio"
+macaddress2="080027000002"
+hostonlyadapter2="vboxnet0"
+nic3="none"
+`
+
+func TestGetMachine(t *testing.T) {
+	fake := &fakeVBoxManage{outputs: map[string]string{"showvminfo": machineVMInfo}}
+	p := &providerMeta{run: fake.run}
+
+	got, err := getMachine(context.Background(), p, "vm")
+	if err != nil {
+		t.Fatalf("getMachine() = %v", err)
+	}
+	want := &vbox.Machine{
+		Name:       "vm",
+		Firmware:   "BIOS",
+		UUID:       "c8b4a2c1-0d4e-4a8b-9d0a-1f2e3d4c5b6a",
+		State:      vbox.Poweroff,
+		CPUs:       2,
+		Memory:     1024,
+		VRAM:       16,
+		CfgFile:    "/vms/vm/vm.vbox",
+		BaseFolder: "/vms/vm",
+		BootOrder:  []string{},
+		NICs: []vbox.NIC{
+			{Network: vbox.NICNetNAT, Hardware: vbox.IntelPro1000MTDesktop, MacAddr: "080027000001"},
+			{Network: vbox.NICNetHostonly, Hardware: vbox.VirtIO, MacAddr: "080027000002", HostInterface: "vboxnet0"},
+		},
+	}
+	if diff := deep.Equal(got, want); diff != nil {
+		t.Errorf("getMachine() diff = %v", diff)
+	}
+	if diff := deep.Equal(fake.calls, []string{"showvminfo vm --machinereadable"}); diff != nil {
+		t.Errorf("VBoxManage calls diff = %v", diff)
+	}
+}
+
+func TestGetMachineNotExist(t *testing.T) {
+	p := &providerMeta{run: func(ctx context.Context, args ...string) (string, string, error) {
+		return "", "VBoxManage: error: Could not find a registered machine named 'vm'", errors.New("exit status 1")
+	}}
+
+	if _, err := getMachine(context.Background(), p, "vm"); err != vbox.ErrMachineNotExist {
+		t.Errorf("getMachine() = %v, want %v", err, vbox.ErrMachineNotExist)
+	}
+}
+
+func TestModifyArgs(t *testing.T) {
+	vm := &vbox.Machine{
+		UUID:      "vm",
+		Firmware:  "efi",
+		OSType:    "Ubuntu_64",
+		CPUs:      2,
+		Memory:    512,
+		VRAM:      20,
+		Flag:      vbox.ACPI | vbox.PAE,
+		BootOrder: []string{"disk", "none", "none", "none", "net"},
+		NICs: []vbox.NIC{
+			{Network: vbox.NICNetNAT, Hardware: vbox.IntelPro1000MTServer},
+			{Network: vbox.NICNetBridged, Hardware: vbox.VirtIO, HostInterface: "eth0"},
+		},
+	}
+
+	want := []string{"modifyvm", "vm",
+		"--firmware", "efi",
+		"--bioslogofadein", "off",
+		"--bioslogofadeout", "off",
+		"--bioslogodisplaytime", "0",
+		"--biosbootmenu", "disabled",
+		"--ostype", "Ubuntu_64",
+		"--cpus", "2",
+		"--memory", "512",
+		"--vram", "20",
+		"--acpi", "on",
+		"--ioapic", "off",
+		"--rtcuseutc", "off",
+		"--cpuhotplug", "off",
+		"--pae", "on",
+		"--longmode", "off",
+		"--hpet", "off",
+		"--hwvirtex", "off",
+		"--triplefaultreset", "off",
+		"--nestedpaging", "off",
+		"--largepages", "off",
+		"--vtxvpid", "off",
+		"--vtxux", "off",
+		"--accelerate3d", "off",
+		"--boot1", "disk",
+		"--boot2", "none",
+		"--boot3", "none",
+		"--boot4", "none",
+		"--nic1", "nat", "--nictype1", "82545EM", "--cableconnected1", "on",
+		"--nic2", "bridged", "--nictype2", "virtio", "--cableconnected2", "on", "--bridgeadapter2", "eth0",
+	}
+	if diff := deep.Equal(modifyArgs(vm), want); diff != nil {
+		t.Errorf("modifyArgs() diff = %v", diff)
+	}
+}
+
+func TestGetExtraData(t *testing.T) {
+	testCases := map[string]struct {
+		out    string
+		want   string
+		wantOK bool
+	}{
+		"set":     {out: "Value: vm-template\n", want: "vm-template", wantOK: true},
+		"not set": {out: "No value set!\n"},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			fake := &fakeVBoxManage{outputs: map[string]string{"getextradata": tc.out}}
+			p := &providerMeta{run: fake.run}
+			got, ok, err := getExtraData(context.Background(), p, "vm", extraDataTemplate)
+			if err != nil {
+				t.Fatalf("getExtraData() = %v", err)
+			}
+			if got != tc.want || ok != tc.wantOK {
+				t.Errorf("getExtraData() = %q, %v, want %q, %v", got, ok, tc.want, tc.wantOK)
+			}
+		})
+	}
+}
+
+func TestParseValue(t *testing.T) {
+	testCases := map[string]struct {
+		out    string
+		want   string
+		wantOK bool
+	}{
+		"value":         {out: "Value: 1\n", want: "1", wantOK: true},
+		"windows":       {out: "Value: 1\r\n", want: "1", wantOK: true},
+		"spaces":        {out: "Value: a b \n", want: "a b ", wantOK: true},
+		"empty":         {out: "Value: \n", wantOK: true},
+		"not set":       {out: "No value set!\n"},
+		"no properties": {out: ""},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			got, ok := parseValue(tc.out)
+			if got != tc.want || ok != tc.wantOK {
+				t.Errorf("parseValue(%q) = %q, %v, want %q, %v", tc.out, got, ok, tc.want, tc.wantOK)
+			}
+		})
+	}
+}
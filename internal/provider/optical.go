@@ -0,0 +1,238 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+)
+
+// emptyDrive is the medium of an optical drive without a disk.
+const emptyDrive = "emptydrive"
+
+// errOpticalDrivesMissing is returned when optical disks can not be inserted
+// into a running VM, as it does not have enough optical drives.
+var errOpticalDrivesMissing = errors.New("not enough optical drives")
+
+// opticalDrive is an optical drive of the VM.
+type opticalDrive struct {
+	Slot   storageSlot
+	Medium string
+}
+
+// opticalDrives returns the optical drives of the storage controller ordered
+// by slot, except for the one holding the cloud-init seed image.
+func (info vmInfo) opticalDrives(folder, controller string) []opticalDrive {
+	seed := filepath.Join(folder, seedFile)
+
+	var drives []opticalDrive
+	for _, slot := range info.slots(controller) {
+		// Only optical drives report whether their medium is ejected.
+		if _, ok := info[fmt.Sprintf("%s-IsEjected-%d-%d", controller, slot.Port, slot.Device)]; !ok {
+			continue
+		}
+		medium := info[fmt.Sprintf("%s-%d-%d", controller, slot.Port, slot.Device)]
+		if medium == seed {
+			continue
+		}
+		drives = append(drives, opticalDrive{Slot: slot, Medium: medium})
+	}
+	return drives
+}
+
+// opticalMedium returns the medium attached for the optical disk image, which
+// is a copy in the VM folder if copy is set.
+func opticalMedium(image, folder string, copy bool) (string, error) {
+	if copy {
+		return filepath.Join(folder, filepath.Base(image)), nil
+	}
+	return filepath.Abs(image)
+}
+
+// copyOpticalDisk copies the optical disk image to target.
+func copyOpticalDisk(image, target string) error {
+	src, err := os.Open(image)
+	if err != nil {
+		return fmt.Errorf("failed to open source optical disk image: %w", err)
+	}
+	defer src.Close()
+
+	dst, err := os.Create(target)
+	if err != nil {
+		return fmt.Errorf("failed to create target optical disk image: %w", err)
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return fmt.Errorf("copy optical disk image failed: %w", err)
+	}
+	// Explicitly sync & close the file now, so virtualbox can read it
+	// immediately, if we do not do this, attaching the iso will fail.
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		return fmt.Errorf("sync target optical disk image to filesystem: %w", err)
+	}
+	if err := dst.Close(); err != nil {
+		return fmt.Errorf("close target optical disk image: %w", err)
+	}
+	return nil
+}
+
+// updateOpticalDisks inserts the optical disk images into the optical drives
+// of the storage controller, in order, and ejects the disks of the remaining drives. Drives
+// are added as needed, unless the VM is running in which case
+// errOpticalDrivesMissing is returned before anything is changed. Copies of
+// images in the VM folder which are no longer used are deleted.
+func updateOpticalDisks(ctx context.Context, p *providerMeta, vmID, folder, controller string, images []string, copy, running bool) error {
+	info, err := showVMInfo(ctx, p, vmID)
+	if err != nil {
+		return err
+	}
+	drives := info.opticalDrives(folder, controller)
+	if running && len(images) > len(drives) {
+		return errOpticalDrivesMissing
+	}
+
+	attach := func(slot storageSlot, medium string) error {
+		args := []string{"storageattach", vmID,
+			"--storagectl", slot.Controller,
+			"--port", strconv.Itoa(slot.Port),
+			"--device", strconv.Itoa(slot.Device),
+			"--type", "dvddrive",
+			"--medium", medium,
+		}
+		if running {
+			// The guest might have locked the drive.
+			args = append(args, "--forceunmount")
+		}
+		if _, stderr, err := p.run(ctx, args...); err != nil {
+			return fmt.Errorf("unable to attach optical disk %s: %w: %s", medium, err, stderr)
+		}
+		return nil
+	}
+
+	used := make(map[string]bool, len(images))
+	for i, image := range images {
+		medium, err := opticalMedium(image, folder, copy)
+		if err != nil {
+			return err
+		}
+		used[medium] = true
+
+		if i < len(drives) && drives[i].Medium == medium {
+			continue
+		}
+		if copy {
+			if err := copyOpticalDisk(image, medium); err != nil {
+				return err
+			}
+		}
+
+		var slot storageSlot
+		if i < len(drives) {
+			slot = drives[i].Slot
+		} else {
+			if info, err = showVMInfo(ctx, p, vmID); err != nil {
+				return err
+			}
+			if slot, err = info.freeSlot(controller); err != nil {
+				return err
+			}
+			if err := ensurePort(ctx, p, info, vmID, controller, slot.Port); err != nil {
+				return err
+			}
+		}
+		tflog.Debug(ctx, "inserting optical disk", map[string]any{
+			"image":  medium,
+			"port":   slot.Port,
+			"device": slot.Device,
+		})
+		if err := attach(slot, medium); err != nil {
+			return err
+		}
+	}
+
+	for i := len(images); i < len(drives); i++ {
+		if drives[i].Medium == emptyDrive {
+			continue
+		}
+		tflog.Debug(ctx, "ejecting optical disk", map[string]any{
+			"image":  drives[i].Medium,
+			"port":   drives[i].Slot.Port,
+			"device": drives[i].Slot.Device,
+		})
+		if err := attach(drives[i].Slot, emptyDrive); err != nil {
+			return err
+		}
+	}
+
+	// Forget the copies which were replaced.
+	for _, drive := range drives {
+		if used[drive.Medium] || drive.Medium == emptyDrive || filepath.Dir(drive.Medium) != filepath.Clean(folder) {
+			continue
+		}
+		if _, stderr, err := p.run(ctx, "closemedium", "dvd", drive.Medium, "--delete"); err != nil {
+			return fmt.Errorf("unable to delete optical disk copy %s: %w: %s", drive.Medium, err, stderr)
+		}
+	}
+	return nil
+}
+
+// opticalDiskImages returns the images of the optical drives, mapping the
+// media back to the configured images they were attached from. Trailing
+// empty drives are left out.
+func opticalDiskImages(drives []opticalDrive, folder string, configured []string, copy bool) []string {
+	images := make([]string, 0, len(drives))
+	for _, drive := range drives {
+		image := drive.Medium
+		for _, c := range configured {
+			if medium, err := opticalMedium(c, folder, copy); err == nil && medium == drive.Medium {
+				image = c
+				break
+			}
+		}
+		images = append(images, image)
+	}
+	for len(images) > 0 && images[len(images)-1] == emptyDrive {
+		images = images[:len(images)-1]
+	}
+	return images
+}
+
+// opticalDisksCopied reports whether the configured images are attached as
+// copies in the VM folder, as they were for all VMs created before
+// copy_optical_disks existed. ok is false if the drives do not tell, e.g. as
+// none of the images are attached or they are located in the VM folder.
+func opticalDisksCopied(drives []opticalDrive, folder string, configured []string) (copied, ok bool) {
+	for _, image := range configured {
+		inPlace, err := filepath.Abs(image)
+		if err != nil {
+			continue
+		}
+		copy := filepath.Join(folder, filepath.Base(image))
+		if copy == inPlace {
+			continue
+		}
+		for _, drive := range drives {
+			switch drive.Medium {
+			case copy:
+				return true, true
+			case inPlace:
+				return false, true
+			}
+		}
+	}
+	return false, false
+}
+
+func expandStrings(v []any) []string {
+	s := make([]string, 0, len(v))
+	for _, e := range v {
+		s = append(s, e.(string))
+	}
+	return s
+}
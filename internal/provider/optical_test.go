@@ -0,0 +1,249 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/go-test/deep"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/terraform"
+)
+
+// opticalVMInfo returns VM info with the gold disk on port 0, optical drives
+// on ports 1 and 2 and the seed image on port 3.
+func opticalVMInfo(folder, medium1, medium2 string) string {
+	return `storagecontrollername0="SATA"
+storagecontrollerportcount0="4"
+"SATA-0-0"="/vms/vm/box-disk001.vmdk"
+"SATA-1-0"="` + medium1 + `"
+"SATA-IsEjected-1-0"="off"
+"SATA-2-0"="` + medium2 + `"
+"SATA-IsEjected-2-0"="off"
+"SATA-3-0"="` + filepath.Join(folder, seedFile) + `"
+"SATA-IsEjected-3-0"="off"
+`
+}
+
+func TestOpticalDrives(t *testing.T) {
+	folder := filepath.Join("vms", "vm")
+	info := parseVMInfo(opticalVMInfo(folder, "/isos/a.iso", emptyDrive))
+
+	want := []opticalDrive{
+		{Slot: storageSlot{Controller: "SATA", Port: 1}, Medium: "/isos/a.iso"},
+		{Slot: storageSlot{Controller: "SATA", Port: 2}, Medium: emptyDrive},
+	}
+	if diff := deep.Equal(info.opticalDrives(folder, "SATA"), want); diff != nil {
+		t.Errorf("opticalDrives() diff = %v", diff)
+	}
+}
+
+func TestUpdateOpticalDisks(t *testing.T) {
+	folder := t.TempDir()
+	dir := t.TempDir()
+	a, b, c := filepath.Join(dir, "a.iso"), filepath.Join(dir, "b.iso"), filepath.Join(dir, "c.iso")
+	for _, iso := range []string{a, b, c} {
+		if err := os.WriteFile(iso, []byte("iso"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	copied := filepath.Join(folder, "a.iso")
+
+	testCases := map[string]struct {
+		info      string
+		images    []string
+		copy      bool
+		running   bool
+		wantCalls []string
+		wantErr   error
+	}{
+		"hot swap and eject": {
+			info:    opticalVMInfo(folder, a, b),
+			images:  []string{c},
+			running: true,
+			wantCalls: []string{
+				"storageattach vm --storagectl SATA --port 1 --device 0 --type dvddrive --medium " + c + " --forceunmount",
+				"storageattach vm --storagectl SATA --port 2 --device 0 --type dvddrive --medium emptydrive --forceunmount",
+			},
+		},
+		"unchanged": {
+			info:    opticalVMInfo(folder, a, emptyDrive),
+			images:  []string{a},
+			running: true,
+		},
+		"missing drives while running": {
+			info:    opticalVMInfo(folder, a, b),
+			images:  []string{a, b, c},
+			running: true,
+			wantErr: errOpticalDrivesMissing,
+		},
+		"add drive": {
+			info:   opticalVMInfo(folder, a, b),
+			images: []string{a, b, c},
+			wantCalls: []string{
+				"storagectl vm --name SATA --portcount 5",
+				"storageattach vm --storagectl SATA --port 4 --device 0 --type dvddrive --medium " + c,
+			},
+		},
+		"stop copying": {
+			info:   opticalVMInfo(folder, copied, emptyDrive),
+			images: []string{a},
+			wantCalls: []string{
+				"storageattach vm --storagectl SATA --port 1 --device 0 --type dvddrive --medium " + a,
+				"closemedium dvd " + copied + " --delete",
+			},
+		},
+		"copy": {
+			info:   opticalVMInfo(folder, emptyDrive, emptyDrive),
+			images: []string{a},
+			copy:   true,
+			wantCalls: []string{
+				"storageattach vm --storagectl SATA --port 1 --device 0 --type dvddrive --medium " + copied,
+			},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			fake := &fakeVBoxManage{outputs: map[string]string{"showvminfo": tc.info}}
+			p := &providerMeta{run: fake.run}
+
+			err := updateOpticalDisks(context.Background(), p, "vm", folder, "SATA", tc.images, tc.copy, tc.running)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("updateOpticalDisks() error = %v, want %v", err, tc.wantErr)
+			}
+			if diff := deep.Equal(fake.commands(), tc.wantCalls); diff != nil {
+				t.Errorf("VBoxManage calls diff = %v", diff)
+			}
+		})
+	}
+
+	if _, err := os.Stat(copied); err != nil {
+		t.Errorf("optical disk was not copied: %v", err)
+	}
+}
+
+func TestOpticalDiskImages(t *testing.T) {
+	folder := filepath.Join("vms", "vm")
+	abs, err := filepath.Abs("a.iso")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := map[string]struct {
+		drives []opticalDrive
+		copy   bool
+		want   []string
+	}{
+		"in place": {
+			drives: []opticalDrive{{Slot: storageSlot{Port: 1}, Medium: abs}, {Slot: storageSlot{Port: 2}, Medium: "/isos/other.iso"}},
+			want:   []string{"a.iso", "/isos/other.iso"},
+		},
+		"copied": {
+			drives: []opticalDrive{{Slot: storageSlot{Port: 1}, Medium: filepath.Join(folder, "a.iso")}},
+			copy:   true,
+			want:   []string{"a.iso"},
+		},
+		"trailing empty drives": {
+			drives: []opticalDrive{{Slot: storageSlot{Port: 1}, Medium: emptyDrive}, {Slot: storageSlot{Port: 2}, Medium: abs}, {Slot: storageSlot{Port: 3}, Medium: emptyDrive}},
+			want:   []string{emptyDrive, "a.iso"},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			got := opticalDiskImages(tc.drives, folder, []string{"a.iso"}, tc.copy)
+			if diff := deep.Equal(got, tc.want); diff != nil {
+				t.Errorf("opticalDiskImages() diff = %v", diff)
+			}
+		})
+	}
+}
+
+func TestOpticalDisksCopied(t *testing.T) {
+	folder := filepath.Join(string(filepath.Separator), "vms", "vm")
+	image := filepath.Join(string(filepath.Separator), "isos", "tools.iso")
+	drive := func(medium string) []opticalDrive {
+		return []opticalDrive{{Slot: storageSlot{Controller: "IDE", Port: 0, Device: 1}, Medium: medium}}
+	}
+
+	testCases := map[string]struct {
+		drives     []opticalDrive
+		configured []string
+		wantCopied bool
+		wantOK     bool
+	}{
+		"copied":       {drives: drive(filepath.Join(folder, "tools.iso")), configured: []string{image}, wantCopied: true, wantOK: true},
+		"in place":     {drives: drive(image), configured: []string{image}, wantOK: true},
+		"not attached": {drives: drive(emptyDrive), configured: []string{image}},
+		"in VM folder": {drives: drive(filepath.Join(folder, "tools.iso")), configured: []string{filepath.Join(folder, "tools.iso")}},
+		"none":         {drives: drive(image)},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			copied, ok := opticalDisksCopied(tc.drives, folder, tc.configured)
+			if copied != tc.wantCopied || ok != tc.wantOK {
+				t.Errorf("opticalDisksCopied() = %v, %v, want %v, %v", copied, ok, tc.wantCopied, tc.wantOK)
+			}
+		})
+	}
+}
+
+func TestResourceVMRead_copiedOpticalDisks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the VM info uses Unix paths")
+	}
+	// VMs created before copy_optical_disks existed have copies of the
+	// optical disk images in their folder, and no copy_optical_disks in
+	// their state.
+	run := func(ctx context.Context, args ...string) (string, string, error) {
+		stdout, stderr, err := importVBoxManage(ctx, args...)
+		if args[0] == "showvminfo" {
+			stdout = strings.Replace(stdout, "/vms/vm/seed.iso", "/vms/vm/tools.iso", 1)
+		}
+		return stdout, stderr, err
+	}
+	p := &providerMeta{run: run}
+
+	raw := map[string]any{
+		"name":  "vm",
+		"image": "ubuntu.box",
+		"storage_controller": []any{
+			map[string]any{"name": "IDE", "bus": "ide"},
+			map[string]any{"name": "SATA", "bus": "sata"},
+		},
+		"disk_controller":         "SATA",
+		"optical_disk_controller": "IDE",
+		"optical_disks":           []any{"/isos/tools.iso"},
+	}
+	r := resourceVM()
+	d := schema.TestResourceDataRaw(t, r.Schema, raw)
+	d.SetId("vm")
+	if diags := resourceVMRead(context.Background(), d, p); diags.HasError() {
+		t.Fatalf("resourceVMRead() = %v", diags)
+	}
+
+	if !d.Get("copy_optical_disks").(bool) {
+		t.Error("copy_optical_disks = false for copied optical disks")
+	}
+	if diff := deep.Equal(d.Get("optical_disks"), []any{"/isos/tools.iso"}); diff != nil {
+		t.Errorf("optical_disks diff = %v", diff)
+	}
+
+	diff, err := r.Diff(context.Background(), d.State(), terraform.NewResourceConfigRaw(raw), p)
+	if err != nil {
+		t.Fatalf("Diff() = %v", err)
+	}
+	if diff != nil {
+		for key := range diff.Attributes {
+			if strings.HasPrefix(key, "optical_disks") || key == "copy_optical_disks" {
+				t.Errorf("Diff() changes %s of the existing VM", key)
+			}
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package provider
+
+import (
+	"bufio"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	humanize "github.com/dustin/go-humanize"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+)
+
+// OVF resource types of the virtual hardware items, as defined by the CIM
+// schema.
+const (
+	ovfResourceCPU      = 3
+	ovfResourceMemory   = 4
+	ovfResourceEthernet = 10
+)
+
+// ovfEnvelope is the subset of an OVF descriptor used by the provider.
+type ovfEnvelope struct {
+	XMLName    xml.Name `xml:"Envelope"`
+	References struct {
+		Files []struct {
+			ID   string `xml:"id,attr"`
+			Href string `xml:"href,attr"`
+		} `xml:"File"`
+	} `xml:"References"`
+	DiskSection struct {
+		Disks []struct {
+			DiskID   string `xml:"diskId,attr"`
+			FileRef  string `xml:"fileRef,attr"`
+			Capacity string `xml:"capacity,attr"`
+		} `xml:"Disk"`
+	} `xml:"DiskSection"`
+	VirtualSystem struct {
+		ID                     string `xml:"id,attr"`
+		OperatingSystemSection struct {
+			ID string `xml:"id,attr"`
+			// OSType is the vbox:OSType element VirtualBox adds.
+			OSType string `xml:"http://www.virtualbox.org/ovf/machine OSType"`
+		} `xml:"OperatingSystemSection"`
+		VirtualHardwareSection struct {
+			Items []ovfItem `xml:"Item"`
+		} `xml:"VirtualHardwareSection"`
+	} `xml:"VirtualSystem"`
+}
+
+// ovfItem is a virtual hardware item, the elements live in the rasd
+// namespace.
+type ovfItem struct {
+	ResourceType    int    `xml:"ResourceType"`
+	ResourceSubType string `xml:"ResourceSubType"`
+	VirtualQuantity uint64 `xml:"VirtualQuantity"`
+	AllocationUnits string `xml:"AllocationUnits"`
+	Connection      string `xml:"Connection"`
+}
+
+// ovfDescriptor is the hardware profile of the appliance described by an OVF
+// descriptor.
+type ovfDescriptor struct {
+	// OSType is the VirtualBox OS type, empty if the descriptor was not
+	// written by VirtualBox.
+	OSType string
+	CPUs   uint
+	// Memory in MiB.
+	Memory uint
+	// Disks are the disk files in the order of the disk section, which is
+	// the order they are attached in.
+	Disks []string
+	NICs  []ovfNIC
+}
+
+// ovfNIC is a network adapter of the appliance.
+type ovfNIC struct {
+	// Connection is the network the adapter is connected to, e.g. NAT.
+	Connection string
+	// Device is the emulated hardware, e.g. E1000.
+	Device string
+}
+
+// findOVF returns the OVF descriptor in dir, or an empty string if there is
+// none.
+func findOVF(dir string) (string, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, "*.ovf"))
+	if err != nil {
+		return "", fmt.Errorf("get *.ovf in %q: %w", dir, err)
+	}
+	switch len(matches) {
+	case 0:
+		return "", nil
+	case 1:
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("multiple OVF descriptors found in %q: %v", dir, matches)
+	}
+}
+
+// parseOVF parses the OVF descriptor at path.
+func parseOVF(path string) (*ovfDescriptor, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var env ovfEnvelope
+	if err := xml.Unmarshal(b, &env); err != nil {
+		return nil, fmt.Errorf("unable to parse OVF descriptor %s: %w", path, err)
+	}
+
+	desc := &ovfDescriptor{
+		OSType: env.VirtualSystem.OperatingSystemSection.OSType,
+	}
+
+	for _, item := range env.VirtualSystem.VirtualHardwareSection.Items {
+		switch item.ResourceType {
+		case ovfResourceCPU:
+			desc.CPUs = uint(item.VirtualQuantity)
+		case ovfResourceMemory:
+			mib, err := ovfMemoryMiB(item.VirtualQuantity, item.AllocationUnits)
+			if err != nil {
+				return nil, err
+			}
+			desc.Memory = mib
+		case ovfResourceEthernet:
+			desc.NICs = append(desc.NICs, ovfNIC{
+				Connection: item.Connection,
+				Device:     item.ResourceSubType,
+			})
+		}
+	}
+
+	files := make(map[string]string, len(env.References.Files))
+	for _, f := range env.References.Files {
+		files[f.ID] = f.Href
+	}
+	for _, disk := range env.DiskSection.Disks {
+		href, ok := files[disk.FileRef]
+		if !ok {
+			return nil, fmt.Errorf("disk %q references unknown file %q", disk.DiskID, disk.FileRef)
+		}
+		desc.Disks = append(desc.Disks, href)
+	}
+
+	return desc, nil
+}
+
+// ovfMemoryMiB converts the memory quantity into MiB based on its allocation
+// units, e.g. "MegaBytes" or "byte * 2^20".
+func ovfMemoryMiB(quantity uint64, units string) (uint, error) {
+	u := strings.ToLower(strings.ReplaceAll(units, " ", ""))
+	switch u {
+	case "", "megabytes", "mb", "byte*2^20":
+		return uint(quantity), nil
+	case "gigabytes", "gb", "byte*2^30":
+		return uint(quantity * 1024), nil
+	case "kilobytes", "kb", "byte*2^10":
+		return uint(quantity / 1024), nil
+	case "byte", "bytes":
+		return uint(quantity >> 20), nil
+	default:
+		return 0, fmt.Errorf("unsupported memory allocation units %q", units)
+	}
+}
+
+// reImportUnit matches the units listed by a dry run of "VBoxManage import".
+var reImportUnit = regexp.MustCompile(`^\s*(\d+):\s+(.+)$`)
+
+// reImportStorageUnit matches the units describing storage, which are not
+// imported as the disks are cloned from the gold image instead.
+var reImportStorageUnit = regexp.MustCompile(`(?i)^((IDE|SATA|SCSI|SAS|NVMe|VirtioSCSI|virtio-scsi|Floppy) controller|Hard disk image|CD-ROM|Floppy)`)
+
+// importStorageUnits returns the units of a "VBoxManage import --dry-run" output
+// which describe storage controllers and media.
+func importStorageUnits(dryRun string) []string {
+	var units []string
+	s := bufio.NewScanner(strings.NewReader(dryRun))
+	for s.Scan() {
+		m := reImportUnit.FindStringSubmatch(s.Text())
+		if m == nil {
+			continue
+		}
+		if reImportStorageUnit.MatchString(m[2]) {
+			units = append(units, m[1])
+		}
+	}
+	return units
+}
+
+// importOVF registers a VM called name from the OVF descriptor at path,
+// keeping all of the appliance settings except for its storage. The storage
+// is set up the same way as for any other image, by cloning the gold disks.
+func importOVF(ctx context.Context, p *providerMeta, path, name, baseFolder string) error {
+	dryRun, stderr, err := p.run(ctx, "import", path, "--dry-run")
+	if err != nil {
+		return fmt.Errorf("unable to inspect appliance %s: %w: %s", path, err, stderr)
+	}
+
+	args := []string{"import", path,
+		"--vsys", "0",
+		"--vmname", name,
+		"--basefolder", baseFolder,
+	}
+	for _, unit := range importStorageUnits(dryRun) {
+		args = append(args, "--vsys", "0", "--unit", unit, "--ignore")
+	}
+
+	tflog.Debug(ctx, "importing appliance", map[string]any{
+		"ovf":  path,
+		"args": strings.Join(args, " "),
+	})
+	if _, stderr, err := p.run(ctx, args...); err != nil {
+		return fmt.Errorf("unable to import appliance %s: %w: %s", path, err, stderr)
+	}
+	return nil
+}
+
+// formatMemory formats the memory in MiB the same way it is read back.
+func formatMemory(mib uint) string {
+	return strings.ToLower(humanize.IBytes(uint64(mib) * humanize.MiByte))
+}
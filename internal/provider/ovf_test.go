@@ -0,0 +1,143 @@
+package provider
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+func TestParseOVF(t *testing.T) {
+	got, err := parseOVF(filepath.Join("testdata", "ovf", "box.ovf"))
+	if err != nil {
+		t.Fatalf("parseOVF() = %v", err)
+	}
+
+	want := &ovfDescriptor{
+		OSType: "Ubuntu_64",
+		CPUs:   2,
+		Memory: 1024,
+		Disks:  []string{"box-disk001.vmdk"},
+		NICs:   []ovfNIC{{Connection: "NAT", Device: "E1000"}},
+	}
+	if diff := deep.Equal(got, want); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestFindOVF(t *testing.T) {
+	dir := t.TempDir()
+	got, err := findOVF(dir)
+	if err != nil || got != "" {
+		t.Fatalf("findOVF() = %q, %v, want no descriptor", got, err)
+	}
+
+	path := filepath.Join(dir, "box.ovf")
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	got, err = findOVF(dir)
+	if err != nil || got != path {
+		t.Fatalf("findOVF() = %q, %v, want %q", got, err, path)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "other.ovf"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := findOVF(dir); err == nil {
+		t.Error("findOVF() with two descriptors succeeded")
+	}
+}
+
+func TestOVFMemoryMiB(t *testing.T) {
+	testCases := []struct {
+		quantity uint64
+		units    string
+		want     uint
+		wantErr  bool
+	}{
+		{quantity: 1024, units: "MegaBytes", want: 1024},
+		{quantity: 1024, units: "byte * 2^20", want: 1024},
+		{quantity: 2, units: "byte * 2^30", want: 2048},
+		{quantity: 1 << 30, units: "byte", want: 1024},
+		{quantity: 1, units: "parsecs", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.units, func(t *testing.T) {
+			got, err := ovfMemoryMiB(tc.quantity, tc.units)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("ovfMemoryMiB() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("ovfMemoryMiB() = %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+const importDryRun = `Interpreting /gold/box.ovf...
+OK.
+Virtual system 0:
+ 0: Suggested OS type: "Ubuntu_64"
+    (change with "--vsys 0 --ostype <type>"; use "list ostypes" to list all possible values)
+ 1: Suggested VM name "ubuntu-bionic"
+    (change with "--vsys 0 --vmname <name>")
+ 2: Number of CPUs: 2
+    (change with "--vsys 0 --cpus <n>")
+ 3: Guest memory: 1024 MB
+    (change with "--vsys 0 --memory <MB>")
+ 4: USB controller
+    (disable with "--vsys 0 --unit 4 --ignore")
+ 5: Network adapter: orig NAT, config 3, extra type=NAT
+ 6: SATA controller, type AHCI
+    (disable with "--vsys 0 --unit 6 --ignore")
+ 7: Hard disk image: source image=box-disk001.vmdk, target path=/vms/box-disk001.vmdk, controller=6;channel=0
+    (change target path with "--vsys 0 --unit 7 --disk path";
+    disable with "--vsys 0 --unit 7 --ignore")
+ 8: Hard disk image: source image=box-disk002.vmdk, target path=/vms/box-disk002.vmdk, controller=6;channel=1
+    (change target path with "--vsys 0 --unit 8 --disk path";
+    disable with "--vsys 0 --unit 8 --ignore")
+`
+
+func TestImportStorageUnits(t *testing.T) {
+	got := importStorageUnits(importDryRun)
+	if diff := deep.Equal(got, []string{"6", "7", "8"}); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestImportOVF(t *testing.T) {
+	var calls []string
+	p := &providerMeta{
+		run: func(ctx context.Context, args ...string) (string, string, error) {
+			calls = append(calls, strings.Join(args, " "))
+			if args[len(args)-1] == "--dry-run" {
+				return importDryRun, "", nil
+			}
+			return "", "", nil
+		},
+	}
+
+	if err := importOVF(context.Background(), p, "/gold/box.ovf", "vm", "/vms"); err != nil {
+		t.Fatalf("importOVF() = %v", err)
+	}
+
+	want := []string{
+		"import /gold/box.ovf --dry-run",
+		"import /gold/box.ovf --vsys 0 --vmname vm --basefolder /vms" +
+			" --vsys 0 --unit 6 --ignore --vsys 0 --unit 7 --ignore --vsys 0 --unit 8 --ignore",
+	}
+	if diff := deep.Equal(calls, want); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestFormatMemory(t *testing.T) {
+	if got := formatMemory(1024); got != "1.0 gib" {
+		t.Errorf("formatMemory(1024) = %q", got)
+	}
+}
@@ -0,0 +1,176 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+)
+
+// shutdownModes are the values of shutdown_mode.
+var shutdownModes = []string{"acpi", "poweroff", "savestate"}
+
+// How long a graceful shutdown may take before the VM is powered off, and
+// how often its state is polled meanwhile.
+const (
+	defaultShutdownTimeout = 2 * time.Minute
+	shutdownPollInterval   = time.Second
+)
+
+// vmState returns the state of the VM as reported by showvminfo, e.g.
+// "running" or "poweroff".
+func vmState(ctx context.Context, p *providerMeta, vmID string) (string, error) {
+	info, err := showVMInfo(ctx, p, vmID)
+	if err != nil {
+		return "", err
+	}
+	return info["VMState"], nil
+}
+
+// shutdownVM shuts the running VM down by pressing its ACPI power button, and
+// powers it off if the guest does not shut down within timeout.
+func shutdownVM(ctx context.Context, p *providerMeta, vmID string, timeout time.Duration) error {
+	tflog.Debug(ctx, "shutting down VM", map[string]any{
+		"vm":      vmID,
+		"timeout": timeout.String(),
+	})
+	if _, stderr, err := p.run(ctx, "controlvm", vmID, "acpipowerbutton"); err != nil {
+		return fmt.Errorf("unable to press the power button of %s: %w: %s", vmID, err, stderr)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		state, err := vmState(ctx, p, vmID)
+		if err != nil {
+			return err
+		}
+		if state != "running" && state != "stopping" {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(shutdownPollInterval):
+		}
+	}
+
+	tflog.Warn(ctx, "VM did not shut down in time, powering it off", map[string]any{
+		"vm":      vmID,
+		"timeout": timeout.String(),
+	})
+	if _, stderr, err := p.run(ctx, "controlvm", vmID, "poweroff"); err != nil {
+		return fmt.Errorf("unable to power off %s: %w: %s", vmID, err, stderr)
+	}
+	return nil
+}
+
+// expandShutdown returns the shutdown_mode and shutdown_timeout of the VM.
+func expandShutdown(d *schema.ResourceData) (string, time.Duration, error) {
+	timeout, err := time.ParseDuration(d.Get("shutdown_timeout").(string))
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid shutdown_timeout: %w", err)
+	}
+	return d.Get("shutdown_mode").(string), timeout, nil
+}
+
+// stopVM stops the running VM with the shutdown mode, the timeout only
+// applies to ACPI shutdowns.
+func stopVM(ctx context.Context, p *providerMeta, vmID, mode string, timeout time.Duration) error {
+	switch mode {
+	case "poweroff", "savestate":
+		tflog.Debug(ctx, "stopping VM", map[string]any{
+			"vm":   vmID,
+			"mode": mode,
+		})
+		if _, stderr, err := p.run(ctx, "controlvm", vmID, mode); err != nil {
+			return fmt.Errorf("unable to %s %s: %w: %s", mode, vmID, err, stderr)
+		}
+		return nil
+	default:
+		return shutdownVM(ctx, p, vmID, timeout)
+	}
+}
+
+// errSavedState is returned for changes which would discard the saved state
+// of the VM, which only happens when its status is set to poweroff.
+var errSavedState = errors.New("the VM has a saved state, which powering it off to apply the changes would discard; start the VM or set status to poweroff first")
+
+// stateTransitions are the steps taking the VM from its state, the inner key,
+// to the wanted status, the outer key. VMs which are already in the wanted
+// state, and aborted VMs which should be powered off, need no steps. Saved
+// states are only discarded when the status is set to poweroff.
+var stateTransitions = map[string]map[string][]string{
+	"running": {
+		"poweroff": {"start"},
+		"aborted":  {"start"},
+		"paused":   {"resume"},
+		"saved":    {"start"},
+	},
+	"poweroff": {
+		"running": {"stop"},
+		"paused":  {"resume", "stop"},
+		"saved":   {"discardstate"},
+		"aborted": nil,
+	},
+	"paused": {
+		"running":  {"pause"},
+		"poweroff": {"start", "pause"},
+		"aborted":  {"start", "pause"},
+		"saved":    {"start", "pause"},
+	},
+	"saved": {
+		"running":  {"savestate"},
+		"paused":   {"savestate"},
+		"poweroff": {"start", "savestate"},
+		"aborted":  {"start", "savestate"},
+	},
+}
+
+// changeState takes the VM from state to the wanted status. Running VMs are
+// stopped with the shutdown mode, or with an ACPI shutdown if the mode saves
+// the state.
+func changeState(ctx context.Context, p *providerMeta, vmID, state, wanted, mode string, timeout time.Duration) error {
+	if state == wanted {
+		return nil
+	}
+	steps, ok := stateTransitions[wanted][state]
+	if !ok {
+		return fmt.Errorf("unable to change the state of %s from %s to %s", vmID, state, wanted)
+	}
+
+	tflog.Debug(ctx, "changing VM state", map[string]any{
+		"vm":    vmID,
+		"from":  state,
+		"to":    wanted,
+		"steps": steps,
+	})
+	for _, step := range steps {
+		var args []string
+		switch step {
+		case "start":
+			args = []string{"startvm", vmID, "--type", "headless"}
+		case "stop":
+			if mode == "savestate" {
+				mode = "acpi"
+			}
+			if err := stopVM(ctx, p, vmID, mode, timeout); err != nil {
+				return err
+			}
+			continue
+		case "discardstate":
+			args = []string{"discardstate", vmID}
+		default:
+			args = []string{"controlvm", vmID, step}
+		}
+		if _, stderr, err := p.run(ctx, args...); err != nil {
+			return fmt.Errorf("unable to %s %s: %w: %s", step, vmID, err, stderr)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package provider
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+func TestShutdownVM(t *testing.T) {
+	testCases := map[string]struct {
+		state string
+		want  []string
+	}{
+		"graceful": {
+			state: "poweroff",
+			want:  []string{"controlvm vm acpipowerbutton"},
+		},
+		"timeout": {
+			state: "running",
+			want:  []string{"controlvm vm acpipowerbutton", "controlvm vm poweroff"},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			fake := &fakeVBoxManage{outputs: map[string]string{"showvminfo": `VMState="` + tc.state + `"`}}
+			p := &providerMeta{run: fake.run}
+			if err := shutdownVM(context.Background(), p, "vm", 0); err != nil {
+				t.Fatalf("shutdownVM() = %v", err)
+			}
+			if diff := deep.Equal(fake.commands(), tc.want); diff != nil {
+				t.Errorf("VBoxManage calls diff = %v", diff)
+			}
+		})
+	}
+}
+
+func TestStopVM(t *testing.T) {
+	testCases := map[string][]string{
+		"acpi":      {"controlvm vm acpipowerbutton"},
+		"poweroff":  {"controlvm vm poweroff"},
+		"savestate": {"controlvm vm savestate"},
+	}
+
+	for mode, want := range testCases {
+		t.Run(mode, func(t *testing.T) {
+			fake := &fakeVBoxManage{outputs: map[string]string{"showvminfo": `VMState="poweroff"`}}
+			p := &providerMeta{run: fake.run}
+			if err := stopVM(context.Background(), p, "vm", mode, defaultShutdownTimeout); err != nil {
+				t.Fatalf("stopVM() = %v", err)
+			}
+			if diff := deep.Equal(fake.commands(), want); diff != nil {
+				t.Errorf("VBoxManage calls diff = %v", diff)
+			}
+		})
+	}
+}
+
+func TestChangeState(t *testing.T) {
+	testCases := map[string]struct {
+		state, wanted, mode string
+		want                []string
+		wantErr             bool
+	}{
+		"unchanged":         {state: "running", wanted: "running"},
+		"start":             {state: "poweroff", wanted: "running", want: []string{"startvm vm --type headless"}},
+		"restart aborted":   {state: "aborted", wanted: "running", want: []string{"startvm vm --type headless"}},
+		"aborted":           {state: "aborted", wanted: "poweroff"},
+		"resume":            {state: "paused", wanted: "running", want: []string{"controlvm vm resume"}},
+		"restore":           {state: "saved", wanted: "running", want: []string{"startvm vm --type headless"}},
+		"stop":              {state: "running", wanted: "poweroff", mode: "acpi", want: []string{"controlvm vm acpipowerbutton"}},
+		"stop without save": {state: "running", wanted: "poweroff", mode: "savestate", want: []string{"controlvm vm acpipowerbutton"}},
+		"poweroff paused": {
+			state: "paused", wanted: "poweroff", mode: "poweroff",
+			want: []string{"controlvm vm resume", "controlvm vm poweroff"},
+		},
+		"discard": {state: "saved", wanted: "poweroff", want: []string{"discardstate vm"}},
+		"pause":   {state: "running", wanted: "paused", want: []string{"controlvm vm pause"}},
+		"start paused": {
+			state: "poweroff", wanted: "paused",
+			want: []string{"startvm vm --type headless", "controlvm vm pause"},
+		},
+		"save":    {state: "paused", wanted: "saved", want: []string{"controlvm vm savestate"}},
+		"invalid": {state: "stuck", wanted: "running", wantErr: true},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			fake := &fakeVBoxManage{outputs: map[string]string{"showvminfo": `VMState="poweroff"`}}
+			p := &providerMeta{run: fake.run}
+			err := changeState(context.Background(), p, "vm", tc.state, tc.wanted, tc.mode, defaultShutdownTimeout)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("changeState() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if diff := deep.Equal(fake.commands(), tc.want); diff != nil {
+				t.Errorf("VBoxManage calls diff = %v", diff)
+			}
+		})
+	}
+}
@@ -10,11 +10,20 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/hashicorp/go-cleanhttp"
+	"github.com/hashicorp/go-cty/cty"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
-	"github.com/terra-farm/go-virtualbox"
 )
 
 func init() {
@@ -26,6 +35,45 @@ func init() {
 // New returns a resource provider for virtualbox.
 func New() *schema.Provider {
 	return &schema.Provider{
+		Schema: map[string]*schema.Schema{
+			"gold_folder": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				DefaultFunc: schema.EnvDefaultFunc("VIRTUALBOX_GOLD_FOLDER", ""),
+				Description: "Folder where the images are unpacked to, defaults to ~/.terraform/virtualbox/gold",
+			},
+
+			"machine_folder": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				DefaultFunc: schema.EnvDefaultFunc("VIRTUALBOX_MACHINE_FOLDER", ""),
+				Description: "Folder where the VMs are created in, defaults to ~/.terraform/virtualbox/machine",
+			},
+
+			"cache_folder": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				DefaultFunc: schema.EnvDefaultFunc("VIRTUALBOX_CACHE_FOLDER", ""),
+				Description: "Folder where the remote images are downloaded to, defaults to ~/.terraform/virtualbox/cache",
+			},
+
+			"image_download": downloadSchema(),
+
+			"vboxmanage_path": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				DefaultFunc: schema.EnvDefaultFunc("VIRTUALBOX_VBOXMANAGE_PATH", ""),
+				Description: "Path to the VBoxManage binary, looked up in PATH when not set",
+			},
+
+			"image_lock_timeout": {
+				Type:             schema.TypeString,
+				Optional:         true,
+				Default:          defaultImageLockTimeout.String(),
+				Description:      "How long to wait for another process to finish unpacking or cloning a gold image",
+				ValidateDiagFunc: validateDuration,
+			},
+		},
 		ResourcesMap: map[string]*schema.Resource{
 			"virtualbox_vm": resourceVM(),
 		},
@@ -33,8 +81,188 @@ func New() *schema.Provider {
 	}
 }
 
-// configure creates a new instance of the new virtualbox manager which will be
-// used for communication with virtualbox.
-func configure(context.Context, *schema.ResourceData) (any, diag.Diagnostics) {
-	return virtualbox.NewManager(), nil
+// runFn runs VBoxManage with the given arguments, returning stdout, stderr
+// and the error if one occurred.
+type runFn func(context.Context, ...string) (string, string, error)
+
+// providerMeta is the configured provider which is passed to every resource
+// function as meta.
+type providerMeta struct {
+	// goldFolder is the folder where the images are unpacked to.
+	goldFolder string
+	// machineFolder is the folder where the VMs are created in.
+	machineFolder string
+	// cacheFolder is the folder where the remote images are downloaded to.
+	cacheFolder string
+	// vboxManagePath is the VBoxManage binary, empty if it is looked up in
+	// PATH.
+	vboxManagePath string
+	// imageLockTimeout is how long to wait for the lock of a gold image.
+	imageLockTimeout time.Duration
+
+	// httpClient is used to download the remote images.
+	httpClient *http.Client
+	// downloadSettings are the provider wide image_download settings.
+	downloadSettings downloadSettings
+
+	// run is used to execute all VBoxManage commands.
+	run runFn
+
+	// osTypesMu guards osTypes, the cached output of "VBoxManage list
+	// ostypes".
+	osTypesMu sync.Mutex
+	osTypes   []osType
+}
+
+// configure creates the provider meta holding the settings and the runFn
+// which is used for communication with VirtualBox.
+func configure(ctx context.Context, d *schema.ResourceData) (any, diag.Diagnostics) {
+	home := func() (string, error) {
+		usr, err := user.Current()
+		if err != nil {
+			return "", fmt.Errorf("unable to get the current user: %w", err)
+		}
+		return usr.HomeDir, nil
+	}
+
+	goldFolder, err := folderOrDefault(d.Get("gold_folder").(string), ".terraform/virtualbox/gold", home)
+	if err != nil {
+		return nil, diag.Errorf("invalid gold_folder: %v", err)
+	}
+	machineFolder, err := folderOrDefault(d.Get("machine_folder").(string), ".terraform/virtualbox/machine", home)
+	if err != nil {
+		return nil, diag.Errorf("invalid machine_folder: %v", err)
+	}
+
+	cacheFolder, err := folderOrDefault(d.Get("cache_folder").(string), ".terraform/virtualbox/cache", home)
+	if err != nil {
+		return nil, diag.Errorf("invalid cache_folder: %v", err)
+	}
+
+	imageLockTimeout, err := time.ParseDuration(d.Get("image_lock_timeout").(string))
+	if err != nil {
+		return nil, diag.Errorf("invalid image_lock_timeout: %v", err)
+	}
+
+	meta := &providerMeta{
+		goldFolder:       goldFolder,
+		machineFolder:    machineFolder,
+		cacheFolder:      cacheFolder,
+		imageLockTimeout: imageLockTimeout,
+		httpClient:       cleanhttp.DefaultPooledClient(),
+		downloadSettings: expandDownloadSettings(d.Get("image_download").([]any)),
+		run:              execVBoxManage(defaultVBoxManage()),
+	}
+
+	if path := d.Get("vboxmanage_path").(string); path != "" {
+		if err := validateVBoxManage(path); err != nil {
+			return nil, diag.Errorf("invalid vboxmanage_path: %v", err)
+		}
+		meta.vboxManagePath = path
+		meta.run = execVBoxManage(path)
+	}
+
+	return meta, nil
+}
+
+// imageCache returns the cache used for downloading remote images. The
+// resource settings are merged into the ones of the provider.
+func (m *providerMeta) imageCache(settings downloadSettings) (*imageCache, error) {
+	settings = m.downloadSettings.merge(settings)
+
+	client := m.httpClient
+	if settings.customTransport() {
+		transport, err := settings.transport()
+		if err != nil {
+			return nil, fmt.Errorf("invalid image_download settings: %w", err)
+		}
+		client = &http.Client{Transport: transport}
+	}
+
+	return &imageCache{
+		folder:      m.cacheFolder,
+		client:      client,
+		settings:    settings,
+		attempts:    defaultDownloadAttempts,
+		backoff:     defaultDownloadBackoff,
+		idleTimeout: defaultDownloadIdleTimeout,
+	}, nil
+}
+
+// validateDuration validates that the value can be parsed by
+// time.ParseDuration.
+func validateDuration(v any, path cty.Path) diag.Diagnostics {
+	if _, err := time.ParseDuration(v.(string)); err != nil {
+		return diag.Diagnostics{{
+			Severity:      diag.Error,
+			Summary:       "Invalid duration",
+			Detail:        err.Error(),
+			AttributePath: path,
+		}}
+	}
+	return nil
+}
+
+// folderOrDefault returns the absolute path of the folder, expanding a leading
+// "~" to the home directory. If folder is empty, def relative to the home
+// directory is returned instead.
+func folderOrDefault(folder, def string, home func() (string, error)) (string, error) {
+	switch {
+	case folder == "":
+		dir, err := home()
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(dir, def), nil
+	case folder == "~" || strings.HasPrefix(folder, "~/"):
+		dir, err := home()
+		if err != nil {
+			return "", err
+		}
+		folder = filepath.Join(dir, strings.TrimPrefix(folder, "~"))
+	}
+	return filepath.Abs(folder)
+}
+
+// validateVBoxManage checks that the VBoxManage binary at path exists.
+func validateVBoxManage(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return fmt.Errorf("%q is a directory", path)
+	}
+	return nil
+}
+
+// defaultVBoxManage returns the VBoxManage binary used without
+// vboxmanage_path, which is looked up in PATH or in VBOX_INSTALL_PATH on
+// Windows.
+func defaultVBoxManage() string {
+	if runtime.GOOS != "windows" {
+		return "VBoxManage"
+	}
+	dir := os.Getenv("VBOX_INSTALL_PATH")
+	if dir == "" {
+		dir = filepath.Join("C:\\", "Program Files", "Oracle", "VirtualBox")
+	}
+	return filepath.Join(dir, "VBoxManage.exe")
+}
+
+// execVBoxManage returns a runFn which executes the VBoxManage binary found
+// at path.
+func execVBoxManage(path string) runFn {
+	return func(ctx context.Context, args ...string) (string, string, error) {
+		var stdout, stderr strings.Builder
+		cmd := exec.CommandContext(ctx, path, args...) // #nosec
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		err := cmd.Run()
+		if ctx.Err() != nil {
+			// The command was killed, report why.
+			err = fmt.Errorf("VBoxManage %s: %w", args[0], ctx.Err())
+		}
+		return stdout.String(), stderr.String(), err
+	}
 }
@@ -0,0 +1,98 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+)
+
+func TestProvider(t *testing.T) {
+	if err := New().InternalValidate(); err != nil {
+		t.Fatalf("InternalValidate() = %v", err)
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	dir := t.TempDir()
+	vboxManage := filepath.Join(dir, "VBoxManage")
+	if err := os.WriteFile(vboxManage, nil, 0o755); err != nil {
+		t.Fatalf("unable to create fake VBoxManage: %v", err)
+	}
+	path := os.Getenv("PATH")
+
+	d := schema.TestResourceDataRaw(t, New().Schema, map[string]any{
+		"gold_folder":     filepath.Join(dir, "gold"),
+		"machine_folder":  filepath.Join(dir, "machine"),
+		"vboxmanage_path": vboxManage,
+	})
+
+	meta, diags := configure(context.Background(), d)
+	if diags.HasError() {
+		t.Fatalf("configure() = %v", diags)
+	}
+
+	p := meta.(*providerMeta)
+	if want := filepath.Join(dir, "gold"); p.goldFolder != want {
+		t.Errorf("goldFolder = %q, want %q", p.goldFolder, want)
+	}
+	if want := filepath.Join(dir, "machine"); p.machineFolder != want {
+		t.Errorf("machineFolder = %q, want %q", p.machineFolder, want)
+	}
+	if p.vboxManagePath != vboxManage {
+		t.Errorf("vboxManagePath = %q, want %q", p.vboxManagePath, vboxManage)
+	}
+	if got := os.Getenv("PATH"); got != path {
+		t.Errorf("PATH = %q, want it unchanged", got)
+	}
+
+	d = schema.TestResourceDataRaw(t, New().Schema, map[string]any{
+		"vboxmanage_path": dir,
+	})
+	if _, diags := configure(context.Background(), d); !diags.HasError() {
+		t.Errorf("configure() with a directory as vboxmanage_path succeeded")
+	}
+}
+
+func TestFolderOrDefault(t *testing.T) {
+	homeDir := t.TempDir()
+	home := func() (string, error) { return homeDir, nil }
+	relative, err := filepath.Abs("relative")
+	if err != nil {
+		t.Fatal(err)
+	}
+	absolute := filepath.Join(t.TempDir(), "gold")
+
+	testCases := map[string]struct {
+		in   string
+		want string
+	}{
+		"default":  {"", filepath.Join(homeDir, ".terraform/virtualbox/gold")},
+		"tilde":    {"~/images", filepath.Join(homeDir, "images")},
+		"absolute": {absolute, absolute},
+		"relative": {"relative", relative},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			got, err := folderOrDefault(tc.in, ".terraform/virtualbox/gold", home)
+			if err != nil {
+				t.Fatalf("folderOrDefault() error = %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("folderOrDefault() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+
+	t.Run("home error", func(t *testing.T) {
+		want := errors.New("no home")
+		_, err := folderOrDefault("", "gold", func() (string, error) { return "", want })
+		if !errors.Is(err, want) {
+			t.Errorf("folderOrDefault() error = %v, want %v", err, want)
+		}
+	})
+}
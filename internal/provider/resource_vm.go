@@ -2,29 +2,43 @@ package provider
 
 import (
 	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"io"
-	"net/http"
 	"net/url"
 	"os"
-	"os/user"
 	"path/filepath"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	humanize "github.com/dustin/go-humanize"
+	"github.com/hashicorp/go-cty/cty"
 	multierror "github.com/hashicorp/go-multierror"
 	"github.com/hashicorp/terraform-plugin-log/tflog"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
-	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/resource"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/validation"
 	vbox "github.com/terra-farm/go-virtualbox"
 )
 
+// Default timeouts of the operations, creating a VM includes downloading
+// and unpacking its image.
+const (
+	defaultCreateTimeout = 30 * time.Minute
+	defaultReadTimeout   = 5 * time.Minute
+	defaultUpdateTimeout = 20 * time.Minute
+	defaultDeleteTimeout = 10 * time.Minute
+)
+
 var (
 	defaultBootOrder = []string{"disk", "none", "none", "none"}
+
+	// Values of the enumerated attributes.
+	bootDevices    = []string{"none", "floppy", "dvd", "disk", "net"}
+	vmStatuses     = []string{"running", "poweroff", "paused", "saved"}
+	networkTypes   = []string{"nat", "bridged", "hostonly", "internal", "generic"}
+	networkDevices = []string{"PCIII", "FASTIII", "IntelPro1000MTDesktop", "IntelPro1000TServer", "IntelPro1000MTServer", "VirtIO"}
 )
 
 func init() {
@@ -33,11 +47,20 @@ func init() {
 
 func resourceVM() *schema.Resource {
 	return &schema.Resource{
-		Exists:        resourceVMExists,
-		CreateContext: resourceVMCreate,
-		ReadContext:   resourceVMRead,
-		UpdateContext: resourceVMUpdate,
-		Delete:        resourceVMDelete,
+		CreateContext: withTimeout(schema.TimeoutCreate, resourceVMCreate),
+		ReadContext:   withTimeout(schema.TimeoutRead, resourceVMRead),
+		UpdateContext: withTimeout(schema.TimeoutUpdate, resourceVMUpdate),
+		DeleteContext: withTimeout(schema.TimeoutDelete, resourceVMDelete),
+		CustomizeDiff: resourceVMCustomizeDiff,
+		Importer: &schema.ResourceImporter{
+			StateContext: resourceVMImport,
+		},
+		Timeouts: &schema.ResourceTimeout{
+			Create: schema.DefaultTimeout(defaultCreateTimeout),
+			Read:   schema.DefaultTimeout(defaultReadTimeout),
+			Update: schema.DefaultTimeout(defaultUpdateTimeout),
+			Delete: schema.DefaultTimeout(defaultDeleteTimeout),
+		},
 
 		Schema: map[string]*schema.Schema{
 
@@ -48,18 +71,32 @@ func resourceVM() *schema.Resource {
 			},
 
 			"image": {
-				Type:     schema.TypeString,
-				Required: true,
-				ForceNew: true,
+				Type:             schema.TypeString,
+				Optional:         true,
+				ForceNew:         true,
+				DiffSuppressFunc: suppressImported,
+				ExactlyOneOf:     []string{"image", "vagrant_box"},
+				Description:      "Image archive or Vagrant box, either a local path, a http(s) URL or a vagrant://<box>?version=<constraint> reference",
 			},
 
+			"vagrant_box": suppressImportedDiffs(vagrantBoxSchema()),
+
 			"url": {
-				Type:       schema.TypeString,
-				Optional:   true,
-				ForceNew:   true,
-				Deprecated: "Use the \"image\" option with a URL",
+				Type:             schema.TypeString,
+				Optional:         true,
+				ForceNew:         true,
+				DiffSuppressFunc: suppressImported,
+				Deprecated:       "Use the \"image\" option with a URL",
 			},
 
+			"image_cache_path": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "Local path of the image, remote images are downloaded into the cache folder",
+			},
+
+			"image_download": suppressImportedDiffs(downloadSchema()),
+
 			"optical_disks": {
 				Type:        schema.TypeList,
 				Optional:    true,
@@ -67,58 +104,239 @@ func resourceVM() *schema.Resource {
 				Elem:        &schema.Schema{Type: schema.TypeString},
 			},
 
-			"cpus": {
-				Type:     schema.TypeInt,
+			"clone_mode": {
+				Type:             schema.TypeString,
+				Optional:         true,
+				ForceNew:         true,
+				Default:          cloneModeFull,
+				DiffSuppressFunc: suppressImported,
+				Description:      "full to copy the image disks for every VM, linked to share them through a template VM",
+				ValidateDiagFunc: validation.ToDiagFunc(validation.StringInSlice(cloneModes, false)),
+			},
+
+			"disk_size": {
+				Type:             schema.TypeString,
+				Optional:         true,
+				Computed:         true,
+				Description:      "Size of the primary disk, which is grown to it. Disks can not shrink.",
+				ValidateDiagFunc: validateSize,
+				DiffSuppressFunc: suppressEquivalentSize,
+			},
+
+			"disk": diskSchema(),
+
+			"storage_controller": suppressImportedDiffs(storageControllerSchema()),
+
+			"disk_controller": {
+				Type:             schema.TypeString,
+				Optional:         true,
+				ForceNew:         true,
+				DiffSuppressFunc: suppressImported,
+				Description:      "Name of the storage controller the disks of the image are attached to, defaults to the first storage controller",
+			},
+
+			"optical_disk_controller": {
+				Type:             schema.TypeString,
+				Optional:         true,
+				ForceNew:         true,
+				DiffSuppressFunc: suppressImported,
+				Description:      "Name of the storage controller the optical disks and the cloud-init seed image are attached to, defaults to disk_controller",
+			},
+
+			"copy_optical_disks": {
+				Type:     schema.TypeBool,
 				Optional: true,
-				Default:  "2",
+				// VMs created before the attribute existed keep their copies,
+				// see opticalDisksCopied.
+				Computed:    true,
+				Description: "Copy the optical disk images into the VM folder instead of attaching them in place, defaults to false for new VMs",
+			},
+
+			"cpus": {
+				Type:        schema.TypeInt,
+				Optional:    true,
+				Computed:    true,
+				Description: "Number of CPUs, defaults to the OVF descriptor of the image or 2",
 			},
 
 			"memory": {
-				Type:     schema.TypeString,
-				Optional: true,
-				Default:  "512mib",
+				Type:        schema.TypeString,
+				Optional:    true,
+				Computed:    true,
+				Description: "Memory size, defaults to the OVF descriptor of the image or 512mib",
+			},
+
+			"os_type": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Computed:    true,
+				Description: "VirtualBox OS type, defaults to the OVF descriptor of the image or Linux_64",
+			},
+
+			"vram": {
+				Type:             schema.TypeInt,
+				Optional:         true,
+				Default:          defaultVRAM,
+				Description:      "Video memory in MiB",
+				ValidateDiagFunc: validation.ToDiagFunc(validation.IntBetween(1, 256)),
+			},
+
+			"firmware": {
+				Type:             schema.TypeString,
+				Optional:         true,
+				Computed:         true,
+				Description:      "Firmware, one of bios, efi, efi32, efi64, defaults to the image or bios",
+				ValidateDiagFunc: validation.ToDiagFunc(validation.StringInSlice(firmwares, false)),
+			},
+
+			"chipset": {
+				Type:             schema.TypeString,
+				Optional:         true,
+				Computed:         true,
+				Description:      "Emulated chipset, one of piix3, ich9, defaults to the image or piix3",
+				ValidateDiagFunc: validation.ToDiagFunc(validation.StringInSlice(chipsets, false)),
+			},
+
+			"paravirt_provider": {
+				Type:             schema.TypeString,
+				Optional:         true,
+				Computed:         true,
+				Description:      "Paravirtualization interface, one of none, default, legacy, minimal, hyperv, kvm, defaults to the image or default",
+				ValidateDiagFunc: validation.ToDiagFunc(validation.StringInSlice(paravirtProviders, false)),
+			},
+
+			"nested_virtualization": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     false,
+				Description: "Expose hardware virtualization to the guest",
+			},
+
+			"cpu_execution_cap": {
+				Type:             schema.TypeInt,
+				Optional:         true,
+				Default:          defaultCPUExecutionCap,
+				Description:      "Percentage of a host CPU a virtual CPU may use",
+				ValidateDiagFunc: validation.ToDiagFunc(validation.IntBetween(1, 100)),
+			},
+
+			"cpu_features": cpuFeaturesSchema(),
+
+			"cpu_hotplug": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     false,
+				Description: "Enable CPU hot-plugging, so cpus can change without restarting the VM",
+			},
+
+			"max_cpus": {
+				Type:             schema.TypeInt,
+				Optional:         true,
+				Default:          0,
+				Description:      "Number of CPU sockets with cpu_hotplug, defaults to cpus",
+				ValidateDiagFunc: validation.ToDiagFunc(validation.IntAtLeast(0)),
+			},
+
+			"guest_properties": {
+				Type:        schema.TypeMap,
+				Optional:    true,
+				Description: "Guest properties of the VM, changed without restarting the VM",
+				Elem:        &schema.Schema{Type: schema.TypeString},
+			},
+
+			"pending_restart": {
+				Type:        schema.TypeList,
+				Computed:    true,
+				Description: "Changed attributes which restart the running VM when applied",
+				Elem:        &schema.Schema{Type: schema.TypeString},
 			},
 
 			"status": {
-				Type:     schema.TypeString,
-				Optional: true,
-				Default:  "running",
+				Type:             schema.TypeString,
+				Optional:         true,
+				Default:          "running",
+				ValidateDiagFunc: validation.ToDiagFunc(validation.StringInSlice(vmStatuses, false)),
 			},
 
+			"shutdown_mode": {
+				Type:             schema.TypeString,
+				Optional:         true,
+				Default:          "acpi",
+				Description:      "How the running VM is stopped before it is changed or destroyed",
+				ValidateDiagFunc: validation.ToDiagFunc(validation.StringInSlice(shutdownModes, false)),
+			},
+
+			"shutdown_timeout": {
+				Type:             schema.TypeString,
+				Optional:         true,
+				Default:          defaultShutdownTimeout.String(),
+				Description:      "How long to wait for an ACPI shutdown before powering the VM off",
+				ValidateDiagFunc: validateDuration,
+			},
+
+			"wait_for": waitForSchema(),
+
 			"user_data": {
-				Deprecated: "user_data is not working and is temporarily deprecated while we figure out how to make it work",
-				Type:       schema.TypeString,
-				Optional:   true,
-				Default:    "",
+				Type:             schema.TypeString,
+				Optional:         true,
+				DiffSuppressFunc: suppressImported,
+				Default:          "",
+				Description:      "cloud-init user data, provided with a NoCloud seed image",
+			},
+
+			"meta_data": {
+				Type:             schema.TypeString,
+				Optional:         true,
+				DiffSuppressFunc: suppressImported,
+				Default:          "",
+				Description:      "cloud-init meta data, defaults to the VM UUID as instance-id and its name as hostname",
+			},
+
+			"network_config": {
+				Type:             schema.TypeString,
+				Optional:         true,
+				DiffSuppressFunc: suppressImported,
+				Default:          "",
+				Description:      "cloud-init network configuration",
 			},
 
 			"checksum": {
-				Type:     schema.TypeString,
-				Optional: true,
-				Default:  "",
+				Type:             schema.TypeString,
+				Optional:         true,
+				DiffSuppressFunc: suppressImported,
+				Default:          "",
+				Description:      "Checksum of the image, either together with checksum_type or as \"<type>:<hex>\"",
+				ValidateDiagFunc: validateChecksum,
 			},
 
 			"checksum_type": {
-				Type:     schema.TypeString,
-				Optional: true,
-				Default:  "",
+				Type:             schema.TypeString,
+				Optional:         true,
+				DiffSuppressFunc: suppressImported,
+				Default:          "",
+				Description:      "Checksum algorithm, one of md5, sha1, sha256, sha384, sha512",
+				ValidateDiagFunc: validation.ToDiagFunc(validation.StringInSlice(append([]string{""}, checksumTypes...), false)),
 			},
 
 			"network_adapter": {
 				Type:     schema.TypeList,
 				Optional: true,
+				// Images with an OVF descriptor bring their own adapters.
+				Computed: true,
 				Elem: &schema.Resource{
 					Schema: map[string]*schema.Schema{
 
 						"type": {
-							Type:     schema.TypeString,
-							Required: true,
+							Type:             schema.TypeString,
+							Required:         true,
+							ValidateDiagFunc: validation.ToDiagFunc(validation.StringInSlice(networkTypes, false)),
 						},
 
 						"device": {
-							Type:     schema.TypeString,
-							Optional: true,
-							Default:  "IntelPro1000MTServer",
+							Type:             schema.TypeString,
+							Optional:         true,
+							Default:          "IntelPro1000MTServer",
+							ValidateDiagFunc: validation.ToDiagFunc(validation.StringInSlice(networkDevices, false)),
 						},
 
 						"host_interface": {
@@ -126,6 +344,20 @@ func resourceVM() *schema.Resource {
 							Optional: true,
 						},
 
+						"cable_connected": {
+							Type:        schema.TypeBool,
+							Optional:    true,
+							Default:     true,
+							Description: "Whether the cable is connected, changed without restarting the VM",
+						},
+
+						"link_speed": {
+							Type:             schema.TypeInt,
+							Optional:         true,
+							Description:      "Link speed in kbps reported to the guest, 0 for the default of the device, changed without restarting the VM",
+							ValidateDiagFunc: validation.ToDiagFunc(validation.IntAtLeast(0)),
+						},
+
 						"status": {
 							Type:     schema.TypeString,
 							Computed: true,
@@ -152,53 +384,216 @@ func resourceVM() *schema.Resource {
 			"boot_order": {
 				Type:        schema.TypeList,
 				Optional:    true,
-				Description: "Boot order, max 4 slots, each in [none, floopy, dvd, disk, net]",
-				Elem:        &schema.Schema{Type: schema.TypeString},
-				MaxItems:    4,
+				Description: "Boot order, max 4 slots, each in [none, floppy, dvd, disk, net]",
+				Elem: &schema.Schema{
+					Type:             schema.TypeString,
+					ValidateDiagFunc: validation.ToDiagFunc(validation.StringInSlice(bootDevices, false)),
+				},
+				MaxItems: 4,
 			},
 		},
 	}
 }
 
-func resourceVMExists(d *schema.ResourceData, meta any) (bool, error) {
-	name := d.Get("name").(string)
+// withTimeout explains the errors of the operation fn which are caused by
+// exceeding its timeout, the summaries name the step which timed out.
+func withTimeout(key string, fn func(context.Context, *schema.ResourceData, any) diag.Diagnostics) func(context.Context, *schema.ResourceData, any) diag.Diagnostics {
+	return func(ctx context.Context, d *schema.ResourceData, meta any) diag.Diagnostics {
+		diags := fn(ctx, d, meta)
+		if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return diags
+		}
+		for i := range diags {
+			if diags[i].Severity == diag.Error && diags[i].Detail == "" {
+				diags[i].Detail = fmt.Sprintf("The %s timeout of %s was exceeded, it can be raised in the timeouts block.",
+					key, d.Timeout(key))
+			}
+		}
+		return diags
+	}
+}
 
-	switch _, err := vbox.GetMachine(name); err {
-	case nil:
-		return true, nil
-	case vbox.ErrMachineNotExist:
-		return false, nil
-	default:
-		return false, fmt.Errorf("error when checking for existance of the VM: %w", err)
+// resourceVMCustomizeDiff rejects changes which can not be applied.
+func resourceVMCustomizeDiff(ctx context.Context, d *schema.ResourceDiff, meta any) error {
+	layout := expandStorageLayout(d.Get)
+	if err := layout.validate(expandDataDisks(d.Get("disk").([]any), layout.DiskController)); err != nil {
+		return err
 	}
+	if checksum := d.Get("checksum").(string); checksum != "" && d.NewValueKnown("checksum") && d.NewValueKnown("checksum_type") {
+		if _, _, err := parseChecksum(checksum, d.Get("checksum_type").(string)); err != nil {
+			return fmt.Errorf("invalid checksum: %w", err)
+		}
+	}
+	if err := validateNetworkAdapters(d.Get("network_adapter").([]any)); err != nil {
+		return err
+	}
+	if d.NewValueKnown("wait_for") {
+		if err := expandWaitFor(d.Get("wait_for").([]any)).validate(d.Get("network_adapter").([]any)); err != nil {
+			return err
+		}
+	}
+	if p, ok := meta.(*providerMeta); ok && d.HasChange("os_type") && d.NewValueKnown("os_type") {
+		if err := p.validateOSType(ctx, d.Get("os_type").(string)); err != nil {
+			return err
+		}
+	}
+	if d.Get("cpu_hotplug").(bool) && d.Get("cpus").(int) > maxCPUs(d) {
+		return fmt.Errorf("cpus can not exceed max_cpus")
+	}
+	if o, n := d.GetChange("status"); d.Id() != "" && o == "saved" && n != "poweroff" {
+		if cold := coldChanges(d); len(cold) > 0 {
+			return fmt.Errorf("unable to change %s: %w", strings.Join(cold, ", "), errSavedState)
+		}
+	}
+	if err := setPendingRestart(ctx, d); err != nil {
+		return err
+	}
+
+	if d.Id() != "" && d.HasChange("disk") {
+		o, n := d.GetChange("disk")
+		if err := validateDataDiskChanges(expandDataDisks(o.([]any), layout.DiskController),
+			expandDataDisks(n.([]any), layout.DiskController)); err != nil {
+			return err
+		}
+	}
+
+	if d.Id() != "" && d.HasChange("disk_size") {
+		o, n := d.GetChange("disk_size")
+		oldSize, err := sizeMiB(o.(string))
+		if err != nil {
+			// Nothing to compare against, the size was never read back.
+			return nil
+		}
+		newSize, err := sizeMiB(n.(string))
+		if err != nil {
+			return nil
+		}
+		if newSize < oldSize {
+			return fmt.Errorf("disk_size can not shrink from %s to %s", o, n)
+		}
+	}
+	return nil
 }
 
-var imageOpMutex sync.Mutex
+// validateChecksum validates the format of the checksum attribute, the
+// checksum itself is validated against the image during creation.
+func validateChecksum(v any, path cty.Path) diag.Diagnostics {
+	checksum := v.(string)
+	if checksum == "" {
+		return nil
+	}
+	typ, sum, ok := strings.Cut(checksum, ":")
+	if !ok {
+		sum = checksum
+	} else if !isSupportedChecksumType(typ) {
+		return diag.Diagnostics{{
+			Severity:      diag.Error,
+			Summary:       "Invalid checksum type",
+			Detail:        InvalidChecksumTypeError(typ).Error(),
+			AttributePath: path,
+		}}
+	}
+	if _, err := hex.DecodeString(sum); err != nil {
+		return diag.Diagnostics{{
+			Severity:      diag.Error,
+			Summary:       "Invalid checksum",
+			Detail:        fmt.Sprintf("The checksum must be hex encoded: %v", err),
+			AttributePath: path,
+		}}
+	}
+	return nil
+}
 
-func resourceVMCreate(ctx context.Context, d *schema.ResourceData, meta any) diag.Diagnostics {
+// withImageLock runs fn while holding the lock of the gold image in goldPath.
+func withImageLock(ctx context.Context, p *providerMeta, goldPath string, fn func() diag.Diagnostics) diag.Diagnostics {
+	lock, err := acquireLock(ctx, imageLockPath(goldPath), p.imageLockTimeout)
+	if err != nil {
+		return diag.Errorf("unable to lock gold image %s: %v", goldPath, err)
+	}
+	defer func() {
+		if err := lock.Unlock(); err != nil {
+			tflog.Warn(ctx, "unable to unlock gold image", map[string]any{
+				"path":  goldPath,
+				"error": err.Error(),
+			})
+		}
+	}()
+	return fn()
+}
+
+// resolveImage returns the location of the image together with its checksum
+// and checksum type. Vagrant boxes are resolved through their box catalog,
+// using the published checksum unless one is configured.
+func resolveImage(ctx context.Context, p *providerMeta, d *schema.ResourceData) (string, string, string, error) {
 	image := d.Get("image").(string)
 
 	if addr, exists := d.GetOk("url"); exists {
 		image = addr.(string)
 	}
 
+	checksum := d.Get("checksum").(string)
+	checksumType := d.Get("checksum_type").(string)
+
+	box, isBox := expandVagrantBox(d.Get("vagrant_box").([]any))
+	if u, err := url.Parse(image); !isBox && err == nil && u.Scheme == vagrantScheme {
+		if box, err = parseVagrantURL(u); err != nil {
+			return "", "", "", err
+		}
+		isBox = true
+	}
+	if !isBox {
+		return image, checksum, checksumType, nil
+	}
+
+	c, err := p.imageCache(expandDownloadSettings(d.Get("image_download").([]any)))
+	if err != nil {
+		return "", "", "", err
+	}
+	release, err := resolveVagrantBox(ctx, c, box)
+	if err != nil {
+		return "", "", "", fmt.Errorf("unable to resolve vagrant box %s: %w", box.Name, err)
+	}
+	if checksum == "" && release.Checksum != "" {
+		checksum, checksumType = release.Checksum, ""
+	}
+	return release.URL, checksum, checksumType, nil
+}
+
+func resourceVMCreate(ctx context.Context, d *schema.ResourceData, meta any) diag.Diagnostics {
+	p := meta.(*providerMeta)
+	image, checksum, checksumType, err := resolveImage(ctx, p, d)
+	if err != nil {
+		return diag.Errorf("unable to resolve image: %v", err)
+	}
+
 	u, err := url.Parse(image)
 	if err != nil {
 		return diag.Errorf("could not parse image URL: %v", err)
 	}
 
-	imagePath, err := fetchIfRemote(u)
+	imagePath, err := fetchIfRemote(ctx, p, u, checksum, checksumType,
+		expandDownloadSettings(d.Get("image_download").([]any)))
 	if err != nil {
 		return diag.Errorf("unable to fetch remote image: %v", err)
 	}
+	if err := d.Set("image_cache_path", imagePath); err != nil {
+		return diag.Errorf("can't set image_cache_path: %v", err)
+	}
 
-	/* Get gold folder and machine folder */
-	usr, err := user.Current()
-	if err != nil {
-		return diag.Errorf("unable to get the current user: %v", err)
+	if checksum != "" {
+		if err := verifyImageFile(ctx, imagePath, checksum, checksumType); err != nil {
+			return diag.Diagnostics{{
+				Severity:      diag.Error,
+				Summary:       "Image checksum verification failed",
+				Detail:        fmt.Sprintf("The image %s could not be verified: %v", image, err),
+				AttributePath: cty.GetAttrPath("checksum"),
+			}}
+		}
 	}
-	goldFolder := filepath.Join(usr.HomeDir, ".terraform/virtualbox/gold")
-	machineFolder := filepath.Join(usr.HomeDir, ".terraform/virtualbox/machine")
+
+	/* Get gold folder and machine folder */
+	goldFolder := p.goldFolder
+	machineFolder := p.machineFolder
 	err = os.MkdirAll(goldFolder, 0740)
 	if err != nil {
 		return diag.Errorf("unable to create gold folder: %v", err)
@@ -208,160 +603,205 @@ func resourceVMCreate(ctx context.Context, d *schema.ResourceData, meta any) dia
 		return diag.Errorf("unable to create machine folder: %v", err)
 	}
 
-	// Unpack gold image to gold folder
-	imageOpMutex.Lock() // Sequentialize image unpacking to avoid conflicts
 	goldFileName := filepath.Base(imagePath)
 	goldName := strings.TrimSuffix(goldFileName, filepath.Ext(goldFileName))
 	if filepath.Ext(goldName) == ".tar" {
 		goldName = strings.TrimSuffix(goldName, ".tar")
 	}
-
 	goldPath := filepath.Join(goldFolder, goldName)
-	if err = unpackImage(ctx, imagePath, goldPath); err != nil {
-		imageOpMutex.Unlock()
-		return diag.Errorf("failed to unpack image %s: %v", image, err)
-	}
-	imageOpMutex.Unlock()
-
-	// Gather '*.vdi' and "*.vmdk" files from gold
-	goldDisks, err := gatherDisks(goldPath)
-	if err != nil {
-		return diag.Errorf("unable to gather disks: %v", err)
-	}
-
-	// Create VM instance
-	name := d.Get("name").(string)
-	vm, err := vbox.CreateMachine(name, machineFolder)
-	if err != nil {
-		return diag.Errorf("can't create virtualbox VM %s: %v", name, err)
-	}
-
-	// Clone gold virtual disk files to VM folder
-	for _, src := range goldDisks {
-		filename := filepath.Base(src)
 
-		target := filepath.Join(vm.BaseFolder, filename)
-
-		if _, _, err := vbox.Run(ctx, "internalcommands", "sethduuid", src); err != nil {
-			return diag.Errorf("unable to set UUID: %v", err)
+	// The gold image is shared with other VMs and possibly other Terraform
+	// runs, so it is locked while it is unpacked and its disks are cloned.
+	var (
+		vm       *vbox.Machine
+		diskSize = d.Get("disk_size").(string)
+		layout   = expandStorageLayout(d.Get)
+	)
+	if diags := withImageLock(ctx, p, goldPath, func() diag.Diagnostics {
+		// Unpack gold image to gold folder
+		imageSum, err := imageSHA256(imagePath, checksum, checksumType)
+		if err != nil {
+			return diag.Errorf("unable to checksum image %s: %v", image, err)
 		}
-
-		imageOpMutex.Lock() // Sequentialize image cloning to improve disk performance
-		err := vbox.CloneHD(src, target)
-		imageOpMutex.Unlock()
+		upToDate, err := goldImageUpToDate(goldPath, imageSum)
 		if err != nil {
-			return diag.Errorf("failed to clone *.vdi and *.vmdk to VM folder: %v", err)
+			return diag.Errorf("unable to check gold image %s: %v", goldPath, err)
 		}
-	}
-
-	// Attach virtual disks to VM
-	vmDisks, err := gatherDisks(vm.BaseFolder)
-	if err != nil {
-		return diag.Errorf("unable to gather disks: %v", err)
-	}
-
-	if err := vm.AddStorageCtl("SATA", vbox.StorageController{
-		SysBus:      vbox.SysBusSATA,
-		Ports:       uint(len(vmDisks)) + 1,
-		Chipset:     vbox.CtrlIntelAHCI,
-		HostIOCache: true,
-		Bootable:    true,
-	}); err != nil {
-		return diag.Errorf("can't create VirtualBox storage controller: %v", err)
-	}
-
-	for i, disk := range vmDisks {
-		if err := vm.AttachStorage("SATA", vbox.StorageMedium{
-			Port:      uint(i),
-			Device:    0,
-			DriveType: vbox.DriveHDD,
-			Medium:    disk,
-		}); err != nil {
-			return diag.Errorf("failed to attach VirtualBox storage medium: %v", err)
+		if !upToDate {
+			// The gold folder is either missing, incomplete or stale.
+			if err = unpackImage(ctx, imagePath, goldPath); err != nil {
+				return diag.Errorf("failed to unpack image %s: %v", image, err)
+			}
 		}
-	}
 
-	opticalDiskCount := d.Get("optical_disks.#").(int)
-	opticalDisks := make([]string, 0, opticalDiskCount)
-
-	for i := 0; i < opticalDiskCount; i++ {
-		attr := fmt.Sprintf("optical_disks.%d", i)
-		if opticalDiskImage, ok := d.Get(attr).(string); ok && attr != "" {
-			opticalDisks = append(opticalDisks, opticalDiskImage)
+		// Gather '*.vdi' and "*.vmdk" files from gold, in attachment order
+		goldDisks, err := gatherDisks(goldPath)
+		if err != nil {
+			return diag.Errorf("unable to gather disks: %v", err)
 		}
-	}
 
-	for i := 0; i < len(opticalDisks); i++ {
-		opticalDiskImage := opticalDisks[i]
-		fileName := filepath.Base(opticalDiskImage)
-
-		target := filepath.Join(vm.BaseFolder, fileName)
-
-		sourceFile, err := os.Open(opticalDiskImage)
+		// Read the hardware defaults from the OVF descriptor of the image if
+		// there is one, the VM is created from it so the appliance settings
+		// are kept.
+		ovfPath, err := findOVF(goldPath)
 		if err != nil {
-			return diag.Errorf("failed to open source optical disk image: %v", err)
+			return diag.Errorf("unable to find OVF descriptor: %v", err)
+		}
+		var desc *ovfDescriptor
+		if ovfPath != "" {
+			if desc, err = parseOVF(ovfPath); err != nil {
+				return diag.Errorf("unable to read OVF descriptor: %v", err)
+			}
+			tflog.Debug(ctx, "found OVF descriptor", map[string]any{
+				"ovf":     ovfPath,
+				"os_type": desc.OSType,
+				"cpus":    desc.CPUs,
+				"memory":  desc.Memory,
+				"disks":   desc.Disks,
+				"nics":    len(desc.NICs),
+			})
+		}
+		if err := setHardwareDefaults(d, desc); err != nil {
+			return diag.Errorf("unable to set hardware defaults: %v", err)
 		}
 
-		// make sure the file is closed when this function ends
-		defer sourceFile.Close()
+		name := d.Get("name").(string)
+		if d.Get("clone_mode").(string) == cloneModeLinked {
+			tpl, err := ensureTemplate(ctx, p, templateName(goldPath, imageSum, layout), goldPath, ovfPath, goldDisks, layout)
+			if err != nil {
+				return diag.Errorf("unable to create template VM: %v", err)
+			}
+			if vm, err = linkedClone(ctx, p, tpl, name, machineFolder, goldPath); err != nil {
+				return diag.Errorf("can't create virtualbox VM %s: %v", name, err)
+			}
+			setVMID(ctx, d, vm)
+			return nil
+		}
 
-		targetFile, err := os.Create(target)
+		// Create VM instance
+		if ovfPath != "" {
+			if err := importOVF(ctx, p, ovfPath, name, machineFolder); err != nil {
+				return diag.Errorf("can't create virtualbox VM %s: %v", name, err)
+			}
+			vm, err = getMachine(ctx, p, name)
+		} else {
+			vm, err = createMachine(ctx, p, name, machineFolder)
+		}
 		if err != nil {
-			return diag.Errorf("failed to create target optical disk image: %v", err)
+			return diag.Errorf("can't create virtualbox VM %s: %v", name, err)
 		}
+		setVMID(ctx, d, vm)
+
+		// Clone gold virtual disk files to VM folder
+		var vmDisks []string
+		for i, src := range goldDisks {
+			target, err := cloneTarget(goldPath, vm.BaseFolder, src)
+			if err != nil {
+				return diag.Errorf("unable to name disk clone: %v", err)
+			}
 
-		// make sure the file is closed when this function ends
-		defer targetFile.Close()
+			if _, _, err := p.run(ctx, "internalcommands", "sethduuid", src); err != nil {
+				return diag.Errorf("unable to set UUID: %v", err)
+			}
 
-		if _, err := io.Copy(targetFile, sourceFile); err != nil {
-			return diag.Errorf("copy optical disk image failed: %v", err)
+			if i == 0 && diskSize != "" && !resizable(target) {
+				// Convert the primary disk while cloning it, so it can be
+				// resized.
+				target = vdiPath(target)
+				if _, stderr, err := p.run(ctx, "clonemedium", "disk", src, target, "--format", "VDI"); err != nil {
+					return diag.Errorf("failed to clone %s to VM folder: %v: %s", src, err, stderr)
+				}
+			} else if _, stderr, err := p.run(ctx, "clonemedium", "disk", src, target); err != nil {
+				return diag.Errorf("failed to clone *.vdi and *.vmdk to VM folder: %v: %s", err, stderr)
+			}
+			vmDisks = append(vmDisks, target)
 		}
 
-		// Explicitly sync & close the file now, so virtualbox can read it immediately, if we do not
-		// do this, attaching the iso will fail.
-		if err := targetFile.Sync(); err != nil {
-			return diag.Errorf("sync target optical disk image to filesystem: %v", err)
+		// Attach virtual disks to VM, in the order of the gold disks
+		if err := createStorageControllers(ctx, p, vm.UUID, layout, vmDisks); err != nil {
+			return diag.Errorf("unable to attach disks: %v", err)
 		}
+		return nil
+	}); diags.HasError() {
+		return diags
+	}
 
-		if err := targetFile.Close(); err != nil {
-			return diag.Errorf("close target optical disk image: %v", err)
+	if diskSize != "" {
+		size, err := humanize.ParseBytes(diskSize)
+		if err != nil {
+			return diag.Errorf("invalid disk_size: %v", err)
 		}
+		if err := growPrimaryDisk(ctx, p, vm.UUID, layout.primaryDisk(), size); err != nil {
+			return diag.Errorf("unable to resize primary disk: %v", err)
+		}
+	}
+
+	// Attach the optical disks after the disks of the image, in place unless
+	// configured otherwise.
+	if err := d.Set("copy_optical_disks", d.Get("copy_optical_disks").(bool)); err != nil {
+		return diag.Errorf("can't set copy_optical_disks: %v", err)
+	}
+	if err := updateOpticalDisks(ctx, p, vm.UUID, vm.BaseFolder, layout.OpticalController,
+		expandStrings(d.Get("optical_disks").([]any)), d.Get("copy_optical_disks").(bool), false); err != nil {
+		return diag.Errorf("unable to attach optical disks: %v", err)
+	}
 
-		if err := vm.AttachStorage("SATA", vbox.StorageMedium{
-			Port:      uint(len(vmDisks) + i),
-			Device:    0,
-			DriveType: vbox.DriveDVD,
-			Medium:    target,
-		}); err != nil {
-			return diag.Errorf("unable to attach VirtualBox storage medium: %v", err)
+	// Attach the cloud-init seed image after the optical disks
+	if seed, ok := expandCloudInitSeed(d); ok {
+		if err := attachSeed(ctx, p, vm.UUID, vm.Name, vm.BaseFolder, layout.OpticalController, seed); err != nil {
+			return diag.Errorf("unable to attach cloud-init seed image: %v", err)
 		}
 	}
 
+	// Create and attach the data disks after the disks of the image
+	disks, err := updateDataDisks(ctx, p, vm.UUID, vm.BaseFolder, nil,
+		expandDataDisks(d.Get("disk").([]any), layout.DiskController))
+	if err != nil {
+		return diag.Errorf("unable to create data disks: %v", err)
+	}
+	if err := d.Set("disk", flattenDataDisks(disks)); err != nil {
+		return diag.Errorf("can't set disk: %v", err)
+	}
+
 	// Setup VM general properties
 	if err := tfToVbox(ctx, d, vm); err != nil {
 		return diag.Errorf("unable to convert Terraform data to VM properties: %v", err)
 	}
-	if err := vm.Modify(); err != nil {
+	if err := modifyMachine(ctx, p, vm); err != nil {
 		return diag.Errorf("can't set up VM properties: %v", err)
 	}
+	if err := modifyHardware(ctx, p, vm.UUID, d); err != nil {
+		return diag.Errorf("can't set up VM hardware: %v", err)
+	}
+	if d.Get("cpu_hotplug").(bool) {
+		// Enabling CPU hot-plugging attaches all sockets.
+		if err := plugCPUs(ctx, p, vm.UUID, maxCPUs(d), d.Get("cpus").(int), false); err != nil {
+			return diag.Errorf("can't set up VM CPUs: %v", err)
+		}
+	}
+	if err := updateGuestProperties(ctx, p, vm.UUID, nil, d.Get("guest_properties").(map[string]any)); err != nil {
+		return diag.Errorf("can't set up guest properties: %v", err)
+	}
 
-	// Start the VM
-	if err := vm.Start(); err != nil {
+	// Put the VM into the configured state
+	if err := reconcileState(ctx, d, vm, "poweroff", meta); err != nil {
 		return diag.Errorf("unable to start VM: %v", err)
 	}
+	if err := d.Set("pending_restart", []string{}); err != nil {
+		return diag.Errorf("can't set pending_restart: %v", err)
+	}
+
+	// Errors here are already logged.
+	return resourceVMRead(ctx, d, meta)
+}
 
-	// Assign VM ID
+// setVMID assigns the ID of the VM as soon as it exists, so that the VM is
+// in the state even if a later step of the creation fails.
+func setVMID(ctx context.Context, d *schema.ResourceData, vm *vbox.Machine) {
 	tflog.Debug(ctx, "resource ID", map[string]any{
 		"uuid": vm.UUID,
 	})
 	d.SetId(vm.UUID)
-
-	if err := waitUntilVMIsReady(ctx, d, vm, meta); err != nil {
-		return diag.Errorf("failed to wait until VM is ready: %v", err)
-	}
-
-	// Errors here are already logged.
-	return resourceVMRead(ctx, d, meta)
 }
 
 func setState(d *schema.ResourceData, state vbox.MachineState) error {
@@ -376,7 +816,10 @@ func setState(d *schema.ResourceData, state vbox.MachineState) error {
 	case vbox.Saved:
 		err = d.Set("status", "saved")
 	case vbox.Aborted:
-		err = d.Set("status", "aborted")
+		// An aborted VM is powered off, but it is drift for any other status.
+		if d.Get("status").(string) != "poweroff" {
+			err = d.Set("status", "aborted")
+		}
 	}
 	if err != nil {
 		return fmt.Errorf("unable to update VM state: %w", err)
@@ -385,7 +828,7 @@ func setState(d *schema.ResourceData, state vbox.MachineState) error {
 }
 
 func resourceVMRead(ctx context.Context, d *schema.ResourceData, meta any) diag.Diagnostics {
-	vm, err := vbox.GetMachine(d.Id())
+	vm, err := getMachine(ctx, meta.(*providerMeta), d.Id())
 	switch err {
 	case nil:
 		break
@@ -410,10 +853,6 @@ func resourceVMRead(ctx context.Context, d *schema.ResourceData, meta any) diag.
 	if err != nil {
 		return diag.Errorf("can't set name: %v", err)
 	}
-	err = d.Set("cpus", vm.CPUs)
-	if err != nil {
-		return diag.Errorf("can't set cpus: %v", err)
-	}
 	bytes := uint64(vm.Memory) * humanize.MiByte
 	repr := humanize.IBytes(bytes)
 	err = d.Set("memory", strings.ToLower(repr))
@@ -421,7 +860,48 @@ func resourceVMRead(ctx context.Context, d *schema.ResourceData, meta any) diag.
 		return diag.Errorf("can't set memory: %v", err)
 	}
 
-	if err = netVboxToTf(vm, d); err != nil {
+	info, err := showVMInfo(ctx, meta.(*providerMeta), vm.UUID)
+	if err != nil {
+		return diag.Errorf("unable to get VM info: %v", err)
+	}
+	if err := setHardware(ctx, meta.(*providerMeta), d, info); err != nil {
+		return diag.Errorf("unable to read hardware: %v", err)
+	}
+
+	layout := expandStorageLayout(d.Get)
+	drives := info.opticalDrives(vm.BaseFolder, layout.OpticalController)
+	configured := expandStrings(d.Get("optical_disks").([]any))
+	if copied, ok := opticalDisksCopied(drives, vm.BaseFolder, configured); ok {
+		if err := d.Set("copy_optical_disks", copied); err != nil {
+			return diag.Errorf("can't set copy_optical_disks: %v", err)
+		}
+	}
+	opticalDisks := opticalDiskImages(drives, vm.BaseFolder, configured, d.Get("copy_optical_disks").(bool))
+	if err := d.Set("optical_disks", opticalDisks); err != nil {
+		return diag.Errorf("can't set optical_disks: %v", err)
+	}
+	primarySlot := layout.primaryDisk()
+	if primary := info.medium(primarySlot.Controller, primarySlot.Port, primarySlot.Device); primary != "" {
+		capacity, err := mediumCapacity(ctx, meta.(*providerMeta), primary)
+		if err != nil {
+			return diag.Errorf("unable to get primary disk size: %v", err)
+		}
+		if err := d.Set("disk_size", formatSize(capacity)); err != nil {
+			return diag.Errorf("can't set disk_size: %v", err)
+		}
+	}
+
+	if keys := sortedKeys(d.Get("guest_properties").(map[string]any)); len(keys) > 0 {
+		props, err := readGuestProperties(ctx, meta.(*providerMeta), vm.UUID, keys)
+		if err != nil {
+			return diag.Errorf("unable to read guest properties: %v", err)
+		}
+		if err := d.Set("guest_properties", props); err != nil {
+			return diag.Errorf("can't set guest_properties: %v", err)
+		}
+	}
+
+	if err = netVboxToTf(ctx, meta.(*providerMeta), vm, info, d); err != nil {
 		return diag.Errorf("can't convert vbox network to terraform data: %v", err)
 	}
 
@@ -454,78 +934,263 @@ func resourceVMRead(ctx context.Context, d *schema.ResourceData, meta any) diag.
 	return nil
 }
 
-func powerOnAndWait(ctx context.Context, d *schema.ResourceData, vm *vbox.Machine, meta any) error {
-	if err := vm.Start(); err != nil {
-		return fmt.Errorf("can't start vm: %w", err)
+// reconcileState takes the VM from state to the configured status, and waits
+// for it to become ready if it is started.
+func reconcileState(ctx context.Context, d *schema.ResourceData, vm *vbox.Machine, state string, meta any) error {
+	mode, timeout, err := expandShutdown(d)
+	if err != nil {
+		return err
 	}
-
-	if err := waitUntilVMIsReady(ctx, d, vm, meta); err != nil {
-		return fmt.Errorf("unabke to poer on and wait: %w", err)
+	wanted := d.Get("status").(string)
+	if err := changeState(ctx, meta.(*providerMeta), vm.UUID, state, wanted, mode, timeout); err != nil {
+		return err
+	}
+	if wanted == "running" && state != "running" {
+		if err := waitUntilVMIsReady(ctx, d, vm, meta); err != nil {
+			return fmt.Errorf("failed to wait until VM is ready: %w", err)
+		}
 	}
-
 	return nil
 }
 
 func resourceVMUpdate(ctx context.Context, d *schema.ResourceData, meta any) diag.Diagnostics {
-	// TODO: allow partial updates
+	// Changes of the stored attributes do not touch the VM.
+	if !d.HasChangesExcept(storedAttributes...) {
+		return resourceVMRead(ctx, d, meta)
+	}
+	p := meta.(*providerMeta)
 
-	vm, err := vbox.GetMachine(d.Id())
+	vm, err := getMachine(ctx, p, d.Id())
 	if err != nil {
 		return diag.Errorf("unable to get machine %s: %v", d.Id(), err)
 	}
+	layout := expandStorageLayout(d.Get)
+
+	state := string(vm.State)
+
+	// Changes which do not need a power cycle are applied to the running or
+	// paused VM. Optical disks are only swapped live as long as the VM has
+	// enough optical drives.
+	live := !d.HasChangesExcept(append([]string{"status", "shutdown_mode", "shutdown_timeout"}, storedAttributes...)...)
+	cold := coldChanges(d)
+	if !live && (vm.State == vbox.Running || vm.State == vbox.Paused) && len(cold) == 0 {
+		err := applyLiveChanges(ctx, p, d, vm, layout)
+		switch {
+		case err == nil:
+			live = true
+		case errors.Is(err, errOpticalDrivesMissing):
+			cold = []string{"optical_disks"}
+		default:
+			return diag.Errorf("unable to update running VM: %v", err)
+		}
+	}
+	if live {
+		if err := reconcileState(ctx, d, vm, state, meta); err != nil {
+			return diag.Errorf("unable to change the state of machine %s: %v", d.Id(), err)
+		}
+		return resourceVMRead(ctx, d, meta)
+	}
+
+	if state == "saved" && d.Get("status").(string) != "poweroff" {
+		return diag.Errorf("unable to update machine %s: %v", d.Id(), errSavedState)
+	}
+	if state != "poweroff" {
+		tflog.Info(ctx, "shutting down VM to apply changes", map[string]any{
+			"vm":      vm.Name,
+			"state":   state,
+			"changes": cold,
+		})
+		mode, timeout, err := expandShutdown(d)
+		if err != nil {
+			return diag.Errorf("unable to shut down machine %s: %v", d.Id(), err)
+		}
+		if err := changeState(ctx, p, vm.UUID, state, "poweroff", mode, timeout); err != nil {
+			return diag.Errorf("unable to shut down machine %s: %v", d.Id(), err)
+		}
+	}
+
+	if d.HasChanges("optical_disks", "copy_optical_disks") {
+		if err := updateOpticalDisks(ctx, p, vm.UUID, vm.BaseFolder, layout.OpticalController,
+			expandStrings(d.Get("optical_disks").([]any)), d.Get("copy_optical_disks").(bool), false); err != nil {
+			return diag.Errorf("unable to update optical disks: %v", err)
+		}
+	}
 
-	if err := vm.Poweroff(); err != nil {
-		return diag.Errorf("unable to poweroff machine %s: %v", d.Id(), err)
+	if d.HasChange("disk_size") && d.Get("disk_size").(string) != "" {
+		size, err := humanize.ParseBytes(d.Get("disk_size").(string))
+		if err != nil {
+			return diag.Errorf("invalid disk_size: %v", err)
+		}
+		if err := growPrimaryDisk(ctx, p, vm.UUID, layout.primaryDisk(), size); err != nil {
+			return diag.Errorf("unable to resize primary disk: %v", err)
+		}
+	}
+
+	if d.HasChanges("user_data", "meta_data", "network_config") {
+		seed, ok := expandCloudInitSeed(d)
+		if err := updateSeed(ctx, p, vm.UUID, vm.Name, vm.BaseFolder, layout.OpticalController, seed, ok); err != nil {
+			return diag.Errorf("unable to update cloud-init seed image: %v", err)
+		}
+	}
+
+	if d.HasChange("disk") {
+		o, n := d.GetChange("disk")
+		disks, err := updateDataDisks(ctx, p, vm.UUID, vm.BaseFolder,
+			expandDataDisks(o.([]any), layout.DiskController), expandDataDisks(n.([]any), layout.DiskController))
+		if err != nil {
+			return diag.Errorf("unable to update data disks: %v", err)
+		}
+		if err := d.Set("disk", flattenDataDisks(disks)); err != nil {
+			return diag.Errorf("can't set disk: %v", err)
+		}
+	}
+
+	if d.HasChange("guest_properties") {
+		o, n := d.GetChange("guest_properties")
+		if err := updateGuestProperties(ctx, p, vm.UUID, o.(map[string]any), n.(map[string]any)); err != nil {
+			return diag.Errorf("unable to update guest properties: %v", err)
+		}
+	}
+
+	// CPUs above the new count are unplugged before the sockets change, new
+	// ones are plugged afterwards.
+	oldHotplug, _ := d.GetChange("cpu_hotplug")
+	oldCPUs, _ := d.GetChange("cpus")
+	attached := maxCPUs(d)
+	if oldHotplug.(bool) {
+		attached = oldCPUs.(int)
+		target := 1
+		if d.Get("cpu_hotplug").(bool) {
+			target = d.Get("cpus").(int)
+		}
+		if target < attached {
+			if err := plugCPUs(ctx, p, vm.UUID, attached, target, false); err != nil {
+				return diag.Errorf("unable to unplug CPUs: %v", err)
+			}
+			attached = target
+		}
 	}
 
 	// Modify VM
 	if err := tfToVbox(ctx, d, vm); err != nil {
 		return diag.Errorf("can't convert terraform config to virtual machine: %v", err)
 	}
-	if err := vm.Modify(); err != nil {
+	if err := modifyMachine(ctx, p, vm); err != nil {
 		return diag.Errorf("unable to modify the vm: %v", err)
 	}
+	if err := modifyHardware(ctx, p, vm.UUID, d); err != nil {
+		return diag.Errorf("unable to modify the vm hardware: %v", err)
+	}
+	if d.Get("cpu_hotplug").(bool) {
+		if err := plugCPUs(ctx, p, vm.UUID, attached, d.Get("cpus").(int), false); err != nil {
+			return diag.Errorf("unable to plug CPUs: %v", err)
+		}
+	}
 
-	if err := powerOnAndWait(ctx, d, vm, meta); err != nil {
-		return diag.Errorf("unable to power on and wait for VM: %v", err)
+	if err := reconcileState(ctx, d, vm, "poweroff", meta); err != nil {
+		return diag.Errorf("unable to change the state of machine %s: %v", d.Id(), err)
 	}
 
 	// Errors are already logged
 	return resourceVMRead(ctx, d, meta)
 }
 
-func resourceVMDelete(d *schema.ResourceData, meta any) error {
-	vm, err := vbox.GetMachine(d.Id())
+func resourceVMDelete(ctx context.Context, d *schema.ResourceData, meta any) diag.Diagnostics {
+	p := meta.(*providerMeta)
+	vm, err := getMachine(ctx, p, d.Id())
+	if err != nil {
+		return diag.Errorf("unable to get machine for deletion: %v", err)
+	}
+
+	// Linked clones reference the template they were cloned from.
+	template, linked, err := getExtraData(ctx, p, vm.UUID, extraDataTemplate)
 	if err != nil {
-		return fmt.Errorf("unable to get machine for deletion: %w", err)
+		return diag.Errorf("unable to get template of the VM: %v", err)
 	}
-	if err := vm.Delete(); err != nil {
-		return fmt.Errorf("unabke to remove the VM: %w", err)
+	gold, hasGold, err := getExtraData(ctx, p, vm.UUID, extraDataGold)
+	if err != nil {
+		return diag.Errorf("unable to get gold image of the VM: %v", err)
+	}
+
+	switch vm.State {
+	case vbox.Running:
+		mode, timeout, err := expandShutdown(d)
+		if err != nil {
+			return diag.Errorf("unable to shut down the VM: %v", err)
+		}
+		if err := stopVM(ctx, p, vm.UUID, mode, timeout); err != nil {
+			return diag.Errorf("unable to shut down the VM: %v", err)
+		}
+	case vbox.Paused:
+		if err := stopVM(ctx, p, vm.UUID, "poweroff", 0); err != nil {
+			return diag.Errorf("unable to power off the VM: %v", err)
+		}
+	}
+
+	if err := deleteMachine(ctx, p, vm.UUID); err != nil {
+		return diag.Errorf("unable to remove the VM: %v", err)
+	}
+
+	if linked && hasGold {
+		if err := releaseTemplate(ctx, p, template, gold, vm.UUID); err != nil {
+			return diag.Errorf("unable to release template: %v", err)
+		}
 	}
 	return nil
 }
 
-// Wait until VM is ready, and 'ready' means the first non NAT NIC get a ipv4_address assigned
-func waitUntilVMIsReady(ctx context.Context, d *schema.ResourceData, vm *vbox.Machine, meta any) error {
-	for i, nic := range vm.NICs {
-		if nic.Network == vbox.NICNetNAT {
-			continue
-		}
+// cloneTarget returns the path in the VM folder a gold disk is cloned to.
+// Disks in subdirectories of the gold image are flattened into the VM folder,
+// their directories become part of the name to avoid collisions.
+func cloneTarget(goldPath, vmFolder, disk string) (string, error) {
+	rel, err := filepath.Rel(goldPath, disk)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(vmFolder, strings.ReplaceAll(rel, string(filepath.Separator), "-")), nil
+}
+
+// Hardware used for attributes which are neither configured nor set by the
+// OVF descriptor of the image.
+const (
+	defaultCPUs   = 2
+	defaultMemory = "512mib"
+	defaultOSType = "Linux_64"
+)
 
-		key := fmt.Sprintf("network_adapter.%d.ipv4_address_available", i)
-		if _, err := waitForVMAttribute(
-			ctx,
-			d,
-			[]string{"yes"},
-			[]string{"no"},
-			key,
-			meta,
-			30*time.Second,
-			1*time.Second,
-		); err != nil {
-			return fmt.Errorf("waiting for VM (%s) to become ready: %w", d.Get("name"), err)
+// setHardwareDefaults fills the hardware attributes which are not configured
+// from the OVF descriptor, if any, or the provider defaults.
+func setHardwareDefaults(d *schema.ResourceData, desc *ovfDescriptor) error {
+	if desc == nil {
+		desc = &ovfDescriptor{}
+	}
+
+	if d.Get("cpus").(int) == 0 {
+		cpus := defaultCPUs
+		if desc.CPUs > 0 {
+			cpus = int(desc.CPUs)
+		}
+		if err := d.Set("cpus", cpus); err != nil {
+			return fmt.Errorf("can't set cpus: %w", err)
+		}
+	}
+	if d.Get("memory").(string) == "" {
+		memory := defaultMemory
+		if desc.Memory > 0 {
+			memory = formatMemory(desc.Memory)
+		}
+		if err := d.Set("memory", memory); err != nil {
+			return fmt.Errorf("can't set memory: %w", err)
+		}
+	}
+	if d.Get("os_type").(string) == "" {
+		osType := defaultOSType
+		if desc.OSType != "" {
+			osType = desc.OSType
+		}
+		if err := d.Set("os_type", osType); err != nil {
+			return fmt.Errorf("can't set os_type: %w", err)
 		}
-		break
 	}
 	return nil
 }
@@ -533,7 +1198,10 @@ func waitUntilVMIsReady(ctx context.Context, d *schema.ResourceData, vm *vbox.Ma
 func tfToVbox(ctx context.Context, d *schema.ResourceData, vm *vbox.Machine) error {
 	var err error
 
-	vm.OSType = "Linux_64"
+	vm.OSType = d.Get("os_type").(string)
+	if vm.OSType == "" {
+		vm.OSType = defaultOSType
+	}
 	vm.CPUs = uint(d.Get("cpus").(int))
 	bytes, err := humanize.ParseBytes(d.Get("memory").(string))
 	if err != nil {
@@ -541,18 +1209,41 @@ func tfToVbox(ctx context.Context, d *schema.ResourceData, vm *vbox.Machine) err
 	}
 	vm.Memory = uint(bytes / humanize.MiByte) // VirtualBox expect memory to be in MiB units
 
-	vm.VRAM = 20 // Always 10MiB for vram
-	vm.Flag = vbox.ACPI | vbox.IOAPIC | vbox.RTCUSEUTC | vbox.PAE |
-		vbox.HWVIRTEX | vbox.NESTEDPAGING | vbox.LARGEPAGES | vbox.LONGMODE |
-		vbox.VTXVPID | vbox.VTXUX
+	vm.VRAM = uint(d.Get("vram").(int))
+	// Keep the firmware of the image unless it is configured.
+	if firmware := d.Get("firmware").(string); firmware != "" {
+		vm.Firmware = firmware
+	}
+	vm.Flag = expandCPUFlags(d.Get("cpu_features").([]any))
+	if d.Get("cpu_hotplug").(bool) {
+		// With CPU hot-plugging, the CPU count is the number of sockets.
+		vm.Flag |= vbox.CPUHOTPLUG
+		vm.CPUs = uint(maxCPUs(d))
+	}
 	vm.NICs, err = netTfToVbox(ctx, d)
-	vm.BootOrder = defaultBootOrder
+	vm.BootOrder = append([]string(nil), defaultBootOrder...)
 	for i, bootDev := range d.Get("boot_order").([]any) {
 		vm.BootOrder[i] = bootDev.(string)
 	}
 	return err
 }
 
+// validateNetworkAdapters checks that the host only and bridged adapters have
+// a host interface.
+func validateNetworkAdapters(v []any) error {
+	for i, raw := range v {
+		m, ok := raw.(map[string]any)
+		if !ok {
+			continue
+		}
+		typ, _ := m["type"].(string)
+		if iface, _ := m["host_interface"].(string); iface == "" && (typ == "hostonly" || typ == "bridged") {
+			return fmt.Errorf("network_adapter.%d.host_interface is required for %s networks", i, typ)
+		}
+	}
+	return nil
+}
+
 func netTfToVbox(ctx context.Context, d *schema.ResourceData) ([]vbox.NIC, error) {
 	tfToVboxNetworkType := func(attr string) (vbox.NICNetwork, error) {
 		switch attr {
@@ -633,8 +1324,8 @@ func netTfToVbox(ctx context.Context, d *schema.ResourceData) ([]vbox.NIC, error
 }
 
 // countRuntimeNics will return the number of NICs found after VM successfully started.
-func countRuntimeNICs(vm *vbox.Machine) (int, error) {
-	count, err := vbox.GetGuestProperty(vm.UUID, "/VirtualBox/GuestInfo/Net/Count")
+func countRuntimeNICs(ctx context.Context, p *providerMeta, vm *vbox.Machine) (int, error) {
+	count, _, err := getGuestProperty(ctx, p, vm.UUID, "/VirtualBox/GuestInfo/Net/Count")
 
 	if err != nil {
 		return 0, err
@@ -647,7 +1338,7 @@ func countRuntimeNICs(vm *vbox.Machine) (int, error) {
 	return strconv.Atoi(count)
 }
 
-func netVboxToTf(vm *vbox.Machine, d *schema.ResourceData) error {
+func netVboxToTf(ctx context.Context, p *providerMeta, vm *vbox.Machine, info vmInfo, d *schema.ResourceData) error {
 	vboxToTfNetworkType := func(netType vbox.NICNetwork) string {
 		switch netType {
 		case vbox.NICNetBridged:
@@ -686,7 +1377,7 @@ func netVboxToTf(vm *vbox.Machine, d *schema.ResourceData) error {
 
 	/* Collect NIC data from guest OS, available only when VM is running */
 	if vm.State == vbox.Running {
-		nicCount, err := countRuntimeNICs(vm)
+		nicCount, err := countRuntimeNICs(ctx, p, vm)
 		if err != nil {
 			return err
 		}
@@ -708,7 +1399,7 @@ func netVboxToTf(vm *vbox.Machine, d *schema.ResourceData) error {
 			var osNic OsNicData
 
 			/* NIC MAC address */
-			macAddr, err := vbox.GetGuestProperty(vm.UUID, fmt.Sprintf("/VirtualBox/GuestInfo/Net/%d/MAC", i))
+			macAddr, _, err := getGuestProperty(ctx, p, vm.UUID, fmt.Sprintf("/VirtualBox/GuestInfo/Net/%d/MAC", i))
 			if err != nil {
 				errs = append(errs, err)
 				continue
@@ -718,7 +1409,7 @@ func netVboxToTf(vm *vbox.Machine, d *schema.ResourceData) error {
 			}
 
 			/* NIC status */
-			status, err := vbox.GetGuestProperty(vm.UUID, fmt.Sprintf("/VirtualBox/GuestInfo/Net/%d/Status", i))
+			status, _, err := getGuestProperty(ctx, p, vm.UUID, fmt.Sprintf("/VirtualBox/GuestInfo/Net/%d/Status", i))
 			if err != nil {
 				errs = append(errs, err)
 				continue
@@ -729,7 +1420,7 @@ func netVboxToTf(vm *vbox.Machine, d *schema.ResourceData) error {
 			osNic.status = strings.ToLower(status)
 
 			/* NIC ipv4 address */
-			ipv4Addr, err := vbox.GetGuestProperty(vm.UUID, fmt.Sprintf("/VirtualBox/GuestInfo/Net/%d/V4/IP", i))
+			ipv4Addr, _, err := getGuestProperty(ctx, p, vm.UUID, fmt.Sprintf("/VirtualBox/GuestInfo/Net/%d/V4/IP", i))
 			if err != nil {
 				errs = append(errs, err)
 				continue
@@ -749,13 +1440,16 @@ func netVboxToTf(vm *vbox.Machine, d *schema.ResourceData) error {
 		// Assign NIC property to vbox structure and Terraform
 		nics := make([]map[string]any, 0, 1)
 
-		for _, nic := range vm.NICs {
+		for i, nic := range vm.NICs {
 			out := make(map[string]any)
 
 			out["type"] = vboxToTfNetworkType(nic.Network)
 			out["device"] = vboxToTfVdevice(nic.Hardware)
 			out["host_interface"] = nic.HostInterface
 			out["mac_address"] = nic.MacAddr
+			out["cable_connected"] = info[fmt.Sprintf("cableconnected%d", i+1)] != "off"
+			// The link speed is not reported, it is kept from the state.
+			out["link_speed"] = d.Get(fmt.Sprintf("network_adapter.%d.link_speed", i))
 
 			osNic, ok := osNicMap[nic.MacAddr]
 			if !ok {
@@ -781,13 +1475,15 @@ func netVboxToTf(vm *vbox.Machine, d *schema.ResourceData) error {
 		// Assign NIC property to vbox structure and Terraform
 		nics := make([]map[string]any, 0, 1)
 
-		for _, nic := range vm.NICs {
+		for i, nic := range vm.NICs {
 			out := make(map[string]any)
 
 			out["type"] = vboxToTfNetworkType(nic.Network)
 			out["device"] = vboxToTfVdevice(nic.Hardware)
 			out["host_interface"] = nic.HostInterface
 			out["mac_address"] = nic.MacAddr
+			out["cable_connected"] = info[fmt.Sprintf("cableconnected%d", i+1)] != "off"
+			out["link_speed"] = d.Get(fmt.Sprintf("network_adapter.%d.link_speed", i))
 
 			out["status"] = "down"
 			out["ipv4_address"] = ""
@@ -804,92 +1500,3 @@ func netVboxToTf(vm *vbox.Machine, d *schema.ResourceData) error {
 
 	return nil
 }
-
-func waitForVMAttribute(ctx context.Context, d *schema.ResourceData, target []string, pending []string, attribute string, meta any, delay, interval time.Duration) (any, error) {
-	// Wait for the vm so we can get the networking attributes that show up
-	// after a while.
-	tflog.Debug(ctx, "waiting for vm to have required attribute value", map[string]any{
-		"vm":        d.Get("name"),
-		"attribute": attribute,
-		"target":    "target",
-	})
-
-	stateConf := &resource.StateChangeConf{
-		Pending:        pending,
-		Target:         target,
-		Refresh:        newVMStateRefreshFunc(ctx, d, attribute, meta),
-		Timeout:        5 * time.Minute,
-		Delay:          delay,
-		MinTimeout:     interval,
-		NotFoundChecks: 60,
-	}
-
-	return stateConf.WaitForStateContext(ctx)
-}
-
-func newVMStateRefreshFunc(ctx context.Context, d *schema.ResourceData, attribute string, meta any) resource.StateRefreshFunc {
-	return func() (any, string, error) {
-		err := resourceVMRead(ctx, d, meta)
-		if err != nil {
-			// TODO: How do we provide context easily without exploring the
-			//       diag.Diagnostics
-			return nil, "", fmt.Errorf("unable to read VM")
-		}
-
-		// See if we can access our attribute
-		if attr, ok := d.GetOk(attribute); ok {
-			// Retrieve the VM properties
-			vm, err := vbox.GetMachine(d.Id())
-			if err != nil {
-				return nil, "", fmt.Errorf("unable to retrive vm: %w", err)
-			}
-
-			return &vm, attr.(string), nil
-		}
-
-		return nil, "", nil
-	}
-}
-
-func fetchIfRemote(u *url.URL) (string, error) {
-	// If the schema is empty, treat it as a local path, otherwise
-	// use it as a remote.
-	if u.Scheme == "" {
-		return u.Path, nil
-	}
-
-	// TODO: Add special handing for other schemes, such as
-	//		 s3, gcs, (s)ftp(s).
-	// We want to quit if the scheme is not currently supported.
-	switch u.Scheme {
-	case "http", "https":
-		break
-	default:
-		return "", fmt.Errorf("unsupported scheme %s", u.Scheme)
-	}
-
-	_, file := filepath.Split(u.Path)
-
-	// if the file is not found, and the error is unexpected, return
-	if _, err := os.Stat(file); err != nil && !os.IsNotExist(err) {
-		return "", err
-	}
-
-	f, err := os.Create(file)
-	if err != nil {
-		return "", err
-	}
-	defer f.Close()
-
-	resp, err := http.Get(u.String())
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-
-	if _, err := io.Copy(f, resp.Body); err != nil {
-		return "", err
-	}
-
-	return file, nil
-}
@@ -0,0 +1,328 @@
+package provider
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/terraform"
+)
+
+func TestResourceVMValidate(t *testing.T) {
+	testCases := map[string]struct {
+		config  map[string]any
+		wantErr bool
+	}{
+		"valid": {
+			config: map[string]any{
+				"status":     "paused",
+				"boot_order": []any{"dvd", "disk"},
+				"network_adapter": []any{map[string]any{
+					"type":   "nat",
+					"device": "VirtIO",
+				}},
+			},
+		},
+		"status": {
+			config:  map[string]any{"status": "stopped"},
+			wantErr: true,
+		},
+		"boot device": {
+			config:  map[string]any{"boot_order": []any{"floopy"}},
+			wantErr: true,
+		},
+		"network type": {
+			config:  map[string]any{"network_adapter": []any{map[string]any{"type": "nated"}}},
+			wantErr: true,
+		},
+		"network device": {
+			config:  map[string]any{"network_adapter": []any{map[string]any{"type": "nat", "device": "e1000"}}},
+			wantErr: true,
+		},
+		"firmware": {
+			config:  map[string]any{"firmware": "uefi"},
+			wantErr: true,
+		},
+		"shutdown mode": {
+			config:  map[string]any{"shutdown_mode": "halt"},
+			wantErr: true,
+		},
+		"shutdown timeout": {
+			config:  map[string]any{"shutdown_timeout": "5"},
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			tc.config["name"] = "vm"
+			tc.config["image"] = "image.box"
+			diags := resourceVM().Validate(terraform.NewResourceConfigRaw(tc.config))
+			if diags.HasError() != tc.wantErr {
+				t.Errorf("Validate() = %v, wantErr %v", diags, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateNetworkAdapters(t *testing.T) {
+	testCases := map[string]struct {
+		adapters []any
+		wantErr  bool
+	}{
+		"nat":            {adapters: []any{map[string]any{"type": "nat", "host_interface": ""}}},
+		"hostonly":       {adapters: []any{map[string]any{"type": "hostonly", "host_interface": "vboxnet0"}}},
+		"missing bridge": {adapters: []any{map[string]any{"type": "bridged", "host_interface": ""}}, wantErr: true},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			if err := validateNetworkAdapters(tc.adapters); (err != nil) != tc.wantErr {
+				t.Errorf("validateNetworkAdapters() error = %v, wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestWithTimeout(t *testing.T) {
+	d := schema.TestResourceDataRaw(t, resourceVM().Schema, map[string]any{"name": "vm"})
+	create := withTimeout(schema.TimeoutCreate, func(ctx context.Context, d *schema.ResourceData, meta any) diag.Diagnostics {
+		<-ctx.Done()
+		return diag.Errorf("unable to start VM: %v", ctx.Err())
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	diags := create(ctx, d, nil)
+	if len(diags) != 1 || !strings.Contains(diags[0].Detail, "create timeout") {
+		t.Errorf("withTimeout() = %v, want the create timeout in the detail", diags)
+	}
+
+	diags = create(canceledContext(), d, nil)
+	if len(diags) != 1 || diags[0].Detail != "" {
+		t.Errorf("withTimeout() = %v, want no detail when canceled", diags)
+	}
+}
+
+func canceledContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return ctx
+}
+
+// createVBoxManage fakes VBoxManage for a VM which is created powered off
+// and gets an address once it was started.
+type createVBoxManage struct {
+	calls []string
+	state string
+}
+
+func (f *createVBoxManage) run(ctx context.Context, args ...string) (string, string, error) {
+	f.calls = append(f.calls, strings.Join(args, " "))
+	switch args[0] {
+	case "showvminfo":
+		if args[1] == "" {
+			return "", "VBoxManage: error: Invalid machine name or UUID", errors.New("exit status 1")
+		}
+		return `name="vm"
+UUID="c8b4a2c1-0d4e-4a8b-9d0a-1f2e3d4c5b6a"
+CfgFile="/vms/vm/vm.vbox"
+VMState="` + f.state + `"
+memory=512
+cpus=2
+nic1="nat"
+nictype1="82545EM"
+macaddress1="080027000001"
+`, "", nil
+	case "startvm":
+		f.state = "running"
+	case "guestproperty":
+		switch args[3] {
+		case "/VirtualBox/GuestInfo/Net/Count":
+			return "Value: 1\n", "", nil
+		case "/VirtualBox/GuestInfo/Net/0/MAC":
+			return "Value: 080027000001\n", "", nil
+		case "/VirtualBox/GuestInfo/Net/0/Status":
+			return "Value: Up\n", "", nil
+		case "/VirtualBox/GuestInfo/Net/0/V4/IP":
+			return "Value: 10.0.2.15\n", "", nil
+		}
+		return "No value set!\n", "", nil
+	}
+	return "", "", nil
+}
+
+func TestResourceVMCreate_wait(t *testing.T) {
+	image := writeTar(t, []tarEntry{{hdr: tar.Header{Name: "box-disk001.vmdk"}, body: "disk"}})
+	fake := &createVBoxManage{state: "poweroff"}
+	p := newTestMeta(t)
+	p.goldFolder = t.TempDir()
+	p.machineFolder = t.TempDir()
+	p.run = fake.run
+
+	d := schema.TestResourceDataRaw(t, resourceVM().Schema, map[string]any{
+		"name":            "vm",
+		"image":           image,
+		"network_adapter": []any{map[string]any{"type": "nat"}},
+		"wait_for":        []any{map[string]any{"condition": "any_address"}},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if diags := resourceVMCreate(ctx, d, p); diags.HasError() {
+		t.Fatalf("resourceVMCreate() = %v", diags)
+	}
+
+	if got, want := d.Id(), "c8b4a2c1-0d4e-4a8b-9d0a-1f2e3d4c5b6a"; got != want {
+		t.Errorf("Id() = %q, want %q", got, want)
+	}
+	if got := d.Get("network_adapter.0.ipv4_address"); got != "10.0.2.15" {
+		t.Errorf("network_adapter.0.ipv4_address = %q, want the address the wait saw", got)
+	}
+	for _, call := range fake.calls {
+		if strings.HasPrefix(call, "showvminfo  ") {
+			t.Errorf("VM info read without an ID: %q", call)
+		}
+	}
+}
+
+func TestResourceVMCustomizeDiff_checksum(t *testing.T) {
+	sum := "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	testCases := map[string]struct {
+		checksum, checksumType string
+		wantErr                bool
+	}{
+		"none":             {},
+		"prefixed":         {checksum: "sha256:" + sum},
+		"with type":        {checksum: sum, checksumType: "sha256"},
+		"without type":     {checksum: sum, wantErr: true},
+		"mismatching type": {checksum: "sha256:" + sum, checksumType: "md5", wantErr: true},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			config := terraform.NewResourceConfigRaw(map[string]any{
+				"name":          "vm",
+				"image":         "image.box",
+				"checksum":      tc.checksum,
+				"checksum_type": tc.checksumType,
+			})
+			if _, err := resourceVM().Diff(context.Background(), nil, config, nil); (err != nil) != tc.wantErr {
+				t.Errorf("Diff() error = %v, wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestResourceVMCustomizeDiff_pendingRestart(t *testing.T) {
+	raw := func(memory string, properties map[string]any) map[string]any {
+		return map[string]any{
+			"name":             "vm",
+			"image":            "image.box",
+			"cpus":             2,
+			"memory":           memory,
+			"disk_size":        "10gib",
+			"os_type":          "Ubuntu_64",
+			"guest_properties": properties,
+			"network_adapter":  []any{map[string]any{"type": "nat"}},
+		}
+	}
+
+	testCases := map[string]struct {
+		pending []string
+		config  map[string]any
+		want    map[string]string
+	}{
+		"cold change": {
+			config: raw("1 gib", nil),
+			want:   map[string]string{"memory": "1 gib", "pending_restart.#": "1", "pending_restart.0": "memory"},
+		},
+		"live change": {
+			pending: []string{"memory"},
+			config:  raw("512 mib", map[string]any{"/a": "b"}),
+			want:    map[string]string{"guest_properties.%": "1", "guest_properties./a": "b", "pending_restart.#": "0", "pending_restart.0": ""},
+		},
+		"kept after apply": {
+			pending: []string{"memory"},
+			config:  raw("512 mib", nil),
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			d := schema.TestResourceDataRaw(t, resourceVM().Schema, raw("512 mib", nil))
+			d.SetId("vm")
+			features := map[string]any{}
+			for _, f := range cpuFeatures {
+				features[f.Attr] = true
+			}
+			for key, v := range map[string]any{
+				"pending_restart": tc.pending,
+				"cpu_features":    []any{features},
+			} {
+				if err := d.Set(key, v); err != nil {
+					t.Fatalf("Set(%s) = %v", key, err)
+				}
+			}
+
+			diff, err := resourceVM().Diff(context.Background(), d.State(), terraform.NewResourceConfigRaw(tc.config), nil)
+			if err != nil {
+				t.Fatalf("Diff() = %v", err)
+			}
+			got := map[string]string{}
+			if diff != nil {
+				for key, a := range diff.Attributes {
+					got[key] = a.New
+				}
+			}
+			if len(got) == 0 {
+				got = nil
+			}
+			if diff := deep.Equal(got, tc.want); diff != nil {
+				t.Errorf("Diff() diff = %v", diff)
+			}
+		})
+	}
+}
+
+func TestResourceVMCustomizeDiff_saved(t *testing.T) {
+	raw := func(status, memory string, properties map[string]any) map[string]any {
+		return map[string]any{
+			"name":             "vm",
+			"image":            "image.box",
+			"status":           status,
+			"memory":           memory,
+			"guest_properties": properties,
+		}
+	}
+
+	testCases := map[string]struct {
+		config  map[string]any
+		wantErr bool
+	}{
+		"cold change":             {config: raw("saved", "1 gib", nil), wantErr: true},
+		"cold change and start":   {config: raw("running", "1 gib", nil), wantErr: true},
+		"cold change and discard": {config: raw("poweroff", "1 gib", nil)},
+		"live change":             {config: raw("saved", "512 mib", map[string]any{"/a": "b"})},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			d := schema.TestResourceDataRaw(t, resourceVM().Schema, raw("saved", "512 mib", nil))
+			d.SetId("vm")
+
+			_, err := resourceVM().Diff(context.Background(), d.State(), terraform.NewResourceConfigRaw(tc.config), nil)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Diff() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if tc.wantErr && !strings.Contains(err.Error(), "saved state") {
+				t.Errorf("Diff() error = %v, want the saved state explained", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,320 @@
+package provider
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/validation"
+)
+
+// storageBuses maps the buses accepted by "VBoxManage storagectl --add" to
+// the chipset controllers on them get by default.
+var storageBuses = map[string]string{
+	"ide":    "PIIX4",
+	"sata":   "IntelAHCI",
+	"scsi":   "LSILogic",
+	"sas":    "LSILogicSAS",
+	"floppy": "I82078",
+	"usb":    "USB",
+	"pcie":   "NVMe",
+	"virtio": "VirtIO",
+}
+
+// storageChipsets are the chipsets accepted by "VBoxManage storagectl
+// --controller".
+var storageChipsets = []string{
+	"BusLogic", "IntelAHCI", "LSILogic", "LSILogicSAS", "PIIX3", "PIIX4",
+	"ICH6", "I82078", "USB", "NVMe", "VirtIO",
+}
+
+// growableBuses are the buses whose controllers have a configurable port
+// count.
+var growableBuses = map[string]bool{
+	"sata":   true,
+	"sas":    true,
+	"usb":    true,
+	"pcie":   true,
+	"virtio": true,
+}
+
+// storageController is a storage controller created for the VM.
+type storageController struct {
+	Name    string
+	Bus     string
+	Chipset string
+	// PortCount is the initial port count, 0 to pick one.
+	PortCount   int
+	HostIOCache bool
+	Bootable    bool
+}
+
+// defaultStorageController is the controller VMs get when none is
+// configured, the disks of the image and the optical disks are attached to
+// it.
+var defaultStorageController = storageController{
+	Name:        defaultDiskController,
+	Bus:         "sata",
+	Chipset:     "IntelAHCI",
+	HostIOCache: true,
+	Bootable:    true,
+}
+
+// storageControllerSchema is the schema of the storage_controller blocks of
+// the virtualbox_vm resource.
+func storageControllerSchema() *schema.Schema {
+	buses := make([]string, 0, len(storageBuses))
+	for bus := range storageBuses {
+		buses = append(buses, bus)
+	}
+
+	return &schema.Schema{
+		Type:        schema.TypeList,
+		Optional:    true,
+		ForceNew:    true,
+		Description: "Storage controllers of the VM, defaults to a single SATA controller",
+		Elem: &schema.Resource{
+			Schema: map[string]*schema.Schema{
+				"name": {
+					Type:             schema.TypeString,
+					Required:         true,
+					Description:      "Name of the storage controller, referenced by the attachments",
+					ValidateDiagFunc: validation.ToDiagFunc(validation.StringIsNotWhiteSpace),
+				},
+
+				"bus": {
+					Type:             schema.TypeString,
+					Required:         true,
+					Description:      "Bus of the storage controller, one of ide, sata, scsi, sas, floppy, usb, pcie, virtio",
+					ValidateDiagFunc: validation.ToDiagFunc(validation.StringInSlice(buses, false)),
+				},
+
+				"chipset": {
+					Type:             schema.TypeString,
+					Optional:         true,
+					Default:          "",
+					Description:      "Chipset of the storage controller, defaults to the usual chipset of the bus",
+					ValidateDiagFunc: validation.ToDiagFunc(validation.StringInSlice(append([]string{""}, storageChipsets...), false)),
+				},
+
+				"port_count": {
+					Type:             schema.TypeInt,
+					Optional:         true,
+					Default:          0,
+					Description:      "Initial number of ports, 0 to size it for the disks of the image",
+					ValidateDiagFunc: validation.ToDiagFunc(validation.IntAtLeast(0)),
+				},
+
+				"host_io_cache": {
+					Type:        schema.TypeBool,
+					Optional:    true,
+					Default:     true,
+					Description: "Use the host I/O cache for the attached media",
+				},
+
+				"bootable": {
+					Type:        schema.TypeBool,
+					Optional:    true,
+					Default:     true,
+					Description: "Whether the VM can boot from the storage controller",
+				},
+			},
+		},
+	}
+}
+
+// storageLayout is the storage configuration of the VM.
+type storageLayout struct {
+	Controllers []storageController
+	// DiskController gets the disks of the image, and data disks which do not
+	// name a controller.
+	DiskController string
+	// OpticalController gets the optical disks and the cloud-init seed image.
+	OpticalController string
+}
+
+// expandStorageLayout returns the storage layout of the VM from the values
+// returned by get, which is the Get method of either schema.ResourceData or
+// schema.ResourceDiff. Without storage controllers, VMs get the default SATA
+// controller. The disk controller defaults to the first controller, the
+// optical one to the disk controller.
+func expandStorageLayout(get func(string) any) storageLayout {
+	var layout storageLayout
+	for _, raw := range get("storage_controller").([]any) {
+		m, ok := raw.(map[string]any)
+		if !ok {
+			continue
+		}
+		ctl := storageController{
+			Name:        m["name"].(string),
+			Bus:         strings.ToLower(m["bus"].(string)),
+			Chipset:     m["chipset"].(string),
+			PortCount:   m["port_count"].(int),
+			HostIOCache: m["host_io_cache"].(bool),
+			Bootable:    m["bootable"].(bool),
+		}
+		if ctl.Chipset == "" {
+			ctl.Chipset = storageBuses[ctl.Bus]
+		}
+		layout.Controllers = append(layout.Controllers, ctl)
+	}
+	if len(layout.Controllers) == 0 {
+		layout.Controllers = []storageController{defaultStorageController}
+	}
+
+	layout.DiskController = get("disk_controller").(string)
+	if layout.DiskController == "" {
+		layout.DiskController = layout.Controllers[0].Name
+	}
+	layout.OpticalController = get("optical_disk_controller").(string)
+	if layout.OpticalController == "" {
+		layout.OpticalController = layout.DiskController
+	}
+	return layout
+}
+
+// controller returns the storage controller called name.
+func (layout storageLayout) controller(name string) (storageController, bool) {
+	for _, ctl := range layout.Controllers {
+		if ctl.Name == name {
+			return ctl, true
+		}
+	}
+	return storageController{}, false
+}
+
+// validate checks that the controller names are unique and that the
+// attachments reference existing controllers.
+func (layout storageLayout) validate(disks []dataDisk) error {
+	seen := make(map[string]bool, len(layout.Controllers))
+	for _, ctl := range layout.Controllers {
+		if seen[ctl.Name] {
+			return fmt.Errorf("storage controller %q is defined multiple times", ctl.Name)
+		}
+		seen[ctl.Name] = true
+	}
+
+	check := func(attr, name string) error {
+		if name != "" && !seen[name] {
+			return fmt.Errorf("%s references unknown storage controller %q", attr, name)
+		}
+		return nil
+	}
+	if err := check("disk_controller", layout.DiskController); err != nil {
+		return err
+	}
+	if err := check("optical_disk_controller", layout.OpticalController); err != nil {
+		return err
+	}
+	for i, disk := range disks {
+		if err := check(fmt.Sprintf("disk.%d.controller", i), disk.Controller); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isDefault reports whether the layout is the one of VMs without storage
+// controllers.
+func (layout storageLayout) isDefault() bool {
+	return len(layout.Controllers) == 1 &&
+		layout.Controllers[0] == defaultStorageController &&
+		layout.DiskController == defaultStorageController.Name &&
+		layout.OpticalController == defaultStorageController.Name
+}
+
+// fingerprint identifies the controllers and the disk controller, which
+// linked clones inherit from their template.
+func (layout storageLayout) fingerprint() string {
+	h := sha256.New()
+	for _, ctl := range layout.Controllers {
+		fmt.Fprintf(h, "%q %s %s %d %t %t\n", ctl.Name, ctl.Bus, ctl.Chipset, ctl.PortCount, ctl.HostIOCache, ctl.Bootable)
+	}
+	fmt.Fprintf(h, "disk %q\n", layout.DiskController)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// chipsetDevicesPerPort returns how many devices can be attached to each port
+// of controllers with the chipset, IDE and floppy ports have a master and a
+// slave.
+func chipsetDevicesPerPort(chipset string) int {
+	switch strings.ToUpper(chipset) {
+	case "PIIX3", "PIIX4", "ICH6", "I82078":
+		return 2
+	default:
+		return 1
+	}
+}
+
+// diskSlot returns the slot of the i-th disk of the image on the controller.
+func diskSlot(ctl storageController, i int) storageSlot {
+	n := chipsetDevicesPerPort(ctl.Chipset)
+	return storageSlot{Controller: ctl.Name, Port: i / n, Device: i % n}
+}
+
+// createStorageControllers adds the controllers of the layout to the VM and
+// attaches the disks of the image to the disk controller, in order. Unless
+// configured otherwise, the disk controller gets one more port than needed
+// for the disks, which is kept for the first optical disk.
+func createStorageControllers(ctx context.Context, p *providerMeta, vmID string, layout storageLayout, disks []string) error {
+	for _, ctl := range layout.Controllers {
+		ports := ctl.PortCount
+		if ports == 0 && ctl.Name == layout.DiskController && growableBuses[ctl.Bus] {
+			n := chipsetDevicesPerPort(ctl.Chipset)
+			ports = (len(disks) + 1 + n - 1) / n
+		}
+
+		args := []string{"storagectl", vmID,
+			"--name", ctl.Name,
+			"--add", ctl.Bus,
+			"--controller", ctl.Chipset,
+			"--hostiocache", onOff(ctl.HostIOCache),
+			"--bootable", onOff(ctl.Bootable),
+		}
+		if ports > 0 {
+			args = append(args, "--portcount", strconv.Itoa(ports))
+		}
+		tflog.Debug(ctx, "adding storage controller", map[string]any{
+			"name":    ctl.Name,
+			"bus":     ctl.Bus,
+			"chipset": ctl.Chipset,
+			"ports":   ports,
+		})
+		if _, stderr, err := p.run(ctx, args...); err != nil {
+			return fmt.Errorf("unable to add storage controller %q: %w: %s", ctl.Name, err, stderr)
+		}
+	}
+
+	if len(disks) == 0 {
+		return nil
+	}
+	ctl, ok := layout.controller(layout.DiskController)
+	if !ok {
+		return fmt.Errorf("storage controller %q does not exist", layout.DiskController)
+	}
+	for i, disk := range disks {
+		slot := diskSlot(ctl, i)
+		if _, stderr, err := p.run(ctx, "storageattach", vmID,
+			"--storagectl", slot.Controller,
+			"--port", strconv.Itoa(slot.Port),
+			"--device", strconv.Itoa(slot.Device),
+			"--type", "hdd",
+			"--medium", disk,
+		); err != nil {
+			return fmt.Errorf("unable to attach disk %s: %w: %s", disk, err, stderr)
+		}
+	}
+	return nil
+}
+
+func onOff(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
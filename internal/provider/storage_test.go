@@ -0,0 +1,216 @@
+package provider
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+// fakeGet returns a Get function answering from values.
+func fakeGet(values map[string]any) func(string) any {
+	return func(key string) any {
+		if v, ok := values[key]; ok {
+			return v
+		}
+		switch key {
+		case "storage_controller":
+			return []any{}
+		default:
+			return ""
+		}
+	}
+}
+
+func TestExpandStorageLayout(t *testing.T) {
+	nvme := map[string]any{
+		"name": "NVMe", "bus": "pcie", "chipset": "", "port_count": 0,
+		"host_io_cache": false, "bootable": true,
+	}
+	ide := map[string]any{
+		"name": "IDE", "bus": "ide", "chipset": "PIIX3", "port_count": 0,
+		"host_io_cache": true, "bootable": false,
+	}
+
+	testCases := map[string]struct {
+		values map[string]any
+		want   storageLayout
+	}{
+		"default": {
+			want: storageLayout{
+				Controllers:       []storageController{defaultStorageController},
+				DiskController:    "SATA",
+				OpticalController: "SATA",
+			},
+		},
+		"first controller": {
+			values: map[string]any{"storage_controller": []any{nvme, ide}},
+			want: storageLayout{
+				Controllers: []storageController{
+					{Name: "NVMe", Bus: "pcie", Chipset: "NVMe", Bootable: true},
+					{Name: "IDE", Bus: "ide", Chipset: "PIIX3", HostIOCache: true},
+				},
+				DiskController:    "NVMe",
+				OpticalController: "NVMe",
+			},
+		},
+		"optical controller": {
+			values: map[string]any{
+				"storage_controller":      []any{nvme, ide},
+				"optical_disk_controller": "IDE",
+			},
+			want: storageLayout{
+				Controllers: []storageController{
+					{Name: "NVMe", Bus: "pcie", Chipset: "NVMe", Bootable: true},
+					{Name: "IDE", Bus: "ide", Chipset: "PIIX3", HostIOCache: true},
+				},
+				DiskController:    "NVMe",
+				OpticalController: "IDE",
+			},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			got := expandStorageLayout(fakeGet(tc.values))
+			if diff := deep.Equal(got, tc.want); diff != nil {
+				t.Errorf("expandStorageLayout() diff = %v", diff)
+			}
+		})
+	}
+}
+
+func TestStorageLayoutValidate(t *testing.T) {
+	sata := storageController{Name: "SATA", Bus: "sata", Chipset: "IntelAHCI"}
+	ide := storageController{Name: "IDE", Bus: "ide", Chipset: "PIIX4"}
+
+	testCases := map[string]struct {
+		layout  storageLayout
+		disks   []dataDisk
+		wantErr bool
+	}{
+		"valid": {
+			layout: storageLayout{Controllers: []storageController{sata, ide}, DiskController: "SATA", OpticalController: "IDE"},
+			disks:  []dataDisk{{Controller: "IDE", Port: 1}},
+		},
+		"duplicate controller": {
+			layout:  storageLayout{Controllers: []storageController{sata, sata}, DiskController: "SATA", OpticalController: "SATA"},
+			wantErr: true,
+		},
+		"unknown disk controller": {
+			layout:  storageLayout{Controllers: []storageController{sata}, DiskController: "NVMe", OpticalController: "SATA"},
+			wantErr: true,
+		},
+		"unknown data disk controller": {
+			layout:  storageLayout{Controllers: []storageController{sata}, DiskController: "SATA", OpticalController: "SATA"},
+			disks:   []dataDisk{{Controller: "IDE"}},
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			if err := tc.layout.validate(tc.disks); (err != nil) != tc.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestCreateStorageControllers(t *testing.T) {
+	testCases := map[string]struct {
+		layout storageLayout
+		disks  []string
+		want   []string
+	}{
+		"default": {
+			layout: storageLayout{
+				Controllers:       []storageController{defaultStorageController},
+				DiskController:    "SATA",
+				OpticalController: "SATA",
+			},
+			disks: []string{"a.vdi", "b.vdi"},
+			want: []string{
+				"storagectl vm --name SATA --add sata --controller IntelAHCI --hostiocache on --bootable on --portcount 3",
+				"storageattach vm --storagectl SATA --port 0 --device 0 --type hdd --medium a.vdi",
+				"storageattach vm --storagectl SATA --port 1 --device 0 --type hdd --medium b.vdi",
+			},
+		},
+		"ide disks": {
+			layout: storageLayout{
+				Controllers: []storageController{
+					{Name: "IDE", Bus: "ide", Chipset: "PIIX4", Bootable: true},
+					{Name: "NVMe", Bus: "pcie", Chipset: "NVMe", PortCount: 2},
+				},
+				DiskController:    "IDE",
+				OpticalController: "IDE",
+			},
+			disks: []string{"a.vdi", "b.vdi", "c.vdi"},
+			want: []string{
+				"storagectl vm --name IDE --add ide --controller PIIX4 --hostiocache off --bootable on",
+				"storagectl vm --name NVMe --add pcie --controller NVMe --hostiocache off --bootable off --portcount 2",
+				"storageattach vm --storagectl IDE --port 0 --device 0 --type hdd --medium a.vdi",
+				"storageattach vm --storagectl IDE --port 0 --device 1 --type hdd --medium b.vdi",
+				"storageattach vm --storagectl IDE --port 1 --device 0 --type hdd --medium c.vdi",
+			},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			fake := &fakeVBoxManage{}
+			p := &providerMeta{run: fake.run}
+
+			if err := createStorageControllers(context.Background(), p, "vm", tc.layout, tc.disks); err != nil {
+				t.Fatalf("createStorageControllers() = %v", err)
+			}
+			if diff := deep.Equal(fake.commands(), tc.want); diff != nil {
+				t.Errorf("VBoxManage calls diff = %v", diff)
+			}
+		})
+	}
+}
+
+func TestFreeSlot(t *testing.T) {
+	const ideVMInfo = `storagecontrollername0="IDE"
+storagecontrollertype0="PIIX4"
+storagecontrollerportcount0="2"
+storagecontrollermaxportcount0="2"
+"IDE-0-0"="/vms/vm/box-disk001.vmdk"
+"IDE-0-1"="none"
+"IDE-1-0"="none"
+"IDE-1-1"="none"
+storagecontrollername1="SATA"
+storagecontrollertype1="IntelAhci"
+storagecontrollerportcount1="1"
+storagecontrollermaxportcount1="30"
+"SATA-0-0"="/vms/vm/disk-SATA-0.vdi"
+`
+	info := parseVMInfo(ideVMInfo)
+
+	testCases := map[string]struct {
+		controller string
+		want       storageSlot
+		wantErr    bool
+	}{
+		"slave device": {controller: "IDE", want: storageSlot{Controller: "IDE", Port: 0, Device: 1}},
+		"new port":     {controller: "SATA", want: storageSlot{Controller: "SATA", Port: 1}},
+		"unknown":      {controller: "NVMe", wantErr: true},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			got, err := info.freeSlot(tc.controller)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("freeSlot() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if diff := deep.Equal(got, tc.want); diff != nil {
+				t.Errorf("freeSlot() diff = %v", diff)
+			}
+		})
+	}
+
+	if slot, ok := info.attachment("/vms/vm/disk-SATA-0.vdi"); !ok || slot != (storageSlot{Controller: "SATA"}) {
+		t.Errorf("attachment() = %+v, %v", slot, ok)
+	}
+}
@@ -0,0 +1,278 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	version "github.com/hashicorp/go-version"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+)
+
+const (
+	// vagrantScheme is the URL scheme used to reference Vagrant boxes in the
+	// image attribute, e.g. "vagrant://ubuntu/bionic64?version=>=20180903".
+	vagrantScheme = "vagrant"
+	// defaultVagrantServerURL is the Vagrant box catalog used when neither
+	// the box nor the VAGRANT_SERVER_URL environment variable point to
+	// another one.
+	defaultVagrantServerURL = "https://vagrantcloud.com"
+	// defaultVagrantProvider is the box provider picked from the catalog.
+	defaultVagrantProvider = "virtualbox"
+)
+
+// vagrantBoxSchema is the schema of the vagrant_box block of the
+// virtualbox_vm resource.
+func vagrantBoxSchema() *schema.Schema {
+	return &schema.Schema{
+		Type:        schema.TypeList,
+		Optional:    true,
+		ForceNew:    true,
+		MaxItems:    1,
+		Description: "Vagrant box used as the image, resolved through the Vagrant box catalog",
+		Elem: &schema.Resource{
+			Schema: map[string]*schema.Schema{
+				"name": {
+					Type:        schema.TypeString,
+					Required:    true,
+					ForceNew:    true,
+					Description: "Name of the box, e.g. ubuntu/bionic64",
+				},
+
+				"version": {
+					Type:        schema.TypeString,
+					Optional:    true,
+					ForceNew:    true,
+					Description: "Version constraint of the box, e.g. \">= 20180903\", the latest version is used when not set",
+				},
+
+				"provider": {
+					Type:        schema.TypeString,
+					Optional:    true,
+					ForceNew:    true,
+					Default:     defaultVagrantProvider,
+					Description: "Box provider to pick from the box versions",
+				},
+
+				"metadata_url": {
+					Type:        schema.TypeString,
+					Optional:    true,
+					ForceNew:    true,
+					Description: "URL or local path of the box metadata JSON, defaults to the box in the Vagrant Cloud catalog",
+				},
+			},
+		},
+	}
+}
+
+// vagrantBox references a box in a Vagrant box catalog.
+type vagrantBox struct {
+	Name        string
+	Version     string
+	Provider    string
+	MetadataURL string
+}
+
+// expandVagrantBox converts the vagrant_box block into a vagrantBox. The
+// second return value is false if the block is not set.
+func expandVagrantBox(v []any) (vagrantBox, bool) {
+	if len(v) == 0 || v[0] == nil {
+		return vagrantBox{}, false
+	}
+	m := v[0].(map[string]any)
+	return vagrantBox{
+		Name:        m["name"].(string),
+		Version:     m["version"].(string),
+		Provider:    m["provider"].(string),
+		MetadataURL: m["metadata_url"].(string),
+	}, true
+}
+
+// parseVagrantURL parses a "vagrant://<name>?version=<constraint>&provider=<provider>"
+// image reference.
+func parseVagrantURL(u *url.URL) (vagrantBox, error) {
+	name := strings.Trim(u.Host+u.Path, "/")
+	if name == "" {
+		return vagrantBox{}, fmt.Errorf("vagrant box name is missing in %q", u)
+	}
+	q := u.Query()
+	box := vagrantBox{
+		Name:     name,
+		Version:  q.Get("version"),
+		Provider: q.Get("provider"),
+	}
+	if box.Provider == "" {
+		box.Provider = defaultVagrantProvider
+	}
+	return box, nil
+}
+
+// metadataURL returns the location of the box metadata.
+func (b vagrantBox) metadataURL() string {
+	if b.MetadataURL != "" {
+		return b.MetadataURL
+	}
+	server := os.Getenv("VAGRANT_SERVER_URL")
+	if server == "" {
+		server = defaultVagrantServerURL
+	}
+	return strings.TrimSuffix(server, "/") + "/" + b.Name
+}
+
+// vagrantMetadata is the box metadata format used by the Vagrant box catalogs.
+type vagrantMetadata struct {
+	Name     string                   `json:"name"`
+	Versions []vagrantMetadataVersion `json:"versions"`
+}
+
+type vagrantMetadataVersion struct {
+	Version   string                    `json:"version"`
+	Status    string                    `json:"status"`
+	Providers []vagrantMetadataProvider `json:"providers"`
+}
+
+type vagrantMetadataProvider struct {
+	Name         string `json:"name"`
+	URL          string `json:"url"`
+	Checksum     string `json:"checksum"`
+	ChecksumType string `json:"checksum_type"`
+}
+
+// vagrantBoxRelease is a box version resolved from the metadata.
+type vagrantBoxRelease struct {
+	Version string
+	URL     string
+	// Checksum in the "<type>:<hex>" form, empty if none was published.
+	Checksum string
+}
+
+// resolveVagrantBox fetches the metadata of the box and picks the newest
+// version matching the version constraint which is available for the
+// provider.
+func resolveVagrantBox(ctx context.Context, c *imageCache, box vagrantBox) (vagrantBoxRelease, error) {
+	metadata, err := fetchVagrantMetadata(ctx, c, box.metadataURL())
+	if err != nil {
+		return vagrantBoxRelease{}, err
+	}
+	release, err := metadata.release(box)
+	if err != nil {
+		return vagrantBoxRelease{}, err
+	}
+
+	tflog.Debug(ctx, "resolved vagrant box", map[string]any{
+		"box":     box.Name,
+		"version": release.Version,
+		"url":     release.URL,
+	})
+	return release, nil
+}
+
+func fetchVagrantMetadata(ctx context.Context, c *imageCache, location string) (*vagrantMetadata, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata URL: %w", err)
+	}
+
+	var r io.ReadCloser
+	switch u.Scheme {
+	case "http", "https":
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+		if err != nil {
+			return nil, err
+		}
+		c.settings.apply(req)
+		req.Header.Set("Accept", "application/json")
+
+		resp, err := c.client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("unable to fetch box metadata: %w", err)
+		}
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			resp.Body.Close()
+			return nil, fmt.Errorf("unable to fetch box metadata from %s: %s", location, resp.Status)
+		}
+		r = resp.Body
+	case "file", "":
+		path := u.Path
+		if u.Scheme == "" {
+			path = location
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read box metadata: %w", err)
+		}
+		r = f
+	default:
+		return nil, fmt.Errorf("unsupported metadata URL scheme %s", u.Scheme)
+	}
+	defer r.Close()
+
+	var metadata vagrantMetadata
+	if err := json.NewDecoder(r).Decode(&metadata); err != nil {
+		return nil, fmt.Errorf("unable to decode box metadata from %s: %w", location, err)
+	}
+	return &metadata, nil
+}
+
+// release picks the newest active version matching the box constraint which
+// is available for the box provider.
+func (m *vagrantMetadata) release(box vagrantBox) (vagrantBoxRelease, error) {
+	var constraints version.Constraints
+	if box.Version != "" {
+		var err error
+		if constraints, err = version.NewConstraint(box.Version); err != nil {
+			return vagrantBoxRelease{}, fmt.Errorf("invalid version constraint %q: %w", box.Version, err)
+		}
+	}
+
+	var (
+		best     *version.Version
+		selected vagrantBoxRelease
+	)
+	for _, v := range m.Versions {
+		if v.Status != "" && v.Status != "active" {
+			continue
+		}
+		ver, err := version.NewVersion(v.Version)
+		if err != nil {
+			// Skip versions which can not be compared instead of failing on
+			// somebody else's typo.
+			continue
+		}
+		if constraints != nil && !constraints.Check(ver) {
+			continue
+		}
+		if best != nil && !ver.GreaterThan(best) {
+			continue
+		}
+		for _, p := range v.Providers {
+			if p.Name != box.Provider {
+				continue
+			}
+			best = ver
+			selected = vagrantBoxRelease{
+				Version: v.Version,
+				URL:     p.URL,
+			}
+			if p.Checksum != "" && p.ChecksumType != "" {
+				selected.Checksum = strings.ToLower(p.ChecksumType) + ":" + p.Checksum
+			}
+			break
+		}
+	}
+
+	if best == nil {
+		return vagrantBoxRelease{}, fmt.Errorf("no version of box %s matching %q is available for provider %s",
+			box.Name, box.Version, box.Provider)
+	}
+	if selected.URL == "" {
+		return vagrantBoxRelease{}, fmt.Errorf("box %s version %s has no download URL", box.Name, selected.Version)
+	}
+	return selected, nil
+}
@@ -0,0 +1,133 @@
+package provider
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+func TestParseVagrantURL(t *testing.T) {
+	testCases := map[string]struct {
+		in      string
+		want    vagrantBox
+		wantErr bool
+	}{
+		"name only": {
+			in:   "vagrant://ubuntu/bionic64",
+			want: vagrantBox{Name: "ubuntu/bionic64", Provider: "virtualbox"},
+		},
+		"version constraint": {
+			in:   "vagrant://ubuntu/bionic64?version=>=20180903",
+			want: vagrantBox{Name: "ubuntu/bionic64", Version: ">=20180903", Provider: "virtualbox"},
+		},
+		"provider": {
+			in:   "vagrant://ubuntu/bionic64?provider=libvirt",
+			want: vagrantBox{Name: "ubuntu/bionic64", Provider: "libvirt"},
+		},
+		"missing name": {
+			in:      "vagrant://",
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			got, err := parseVagrantURL(mustParseURL(t, tc.in))
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("parseVagrantURL() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if diff := deep.Equal(got, tc.want); diff != nil {
+				t.Errorf("parseVagrantURL() diff = %v", diff)
+			}
+		})
+	}
+}
+
+func TestResolveVagrantBox(t *testing.T) {
+	metadata := filepath.Join("testdata", "vagrant", "bionic64.json")
+
+	testCases := map[string]struct {
+		box     vagrantBox
+		want    vagrantBoxRelease
+		wantErr bool
+	}{
+		"latest active version with the provider": {
+			box: vagrantBox{Name: "ubuntu/bionic64", Provider: "virtualbox"},
+			want: vagrantBoxRelease{
+				Version:  "20180903.0.0",
+				URL:      "https://vagrantcloud.com/ubuntu/boxes/bionic64/versions/20180903.0.0/providers/virtualbox.box",
+				Checksum: "sha256:a213cfed68038b2dc6ac00e94bfb0b3659f6db8a04b6ad6a877a08f08c27604d",
+			},
+		},
+		"version constraint": {
+			box: vagrantBox{Name: "ubuntu/bionic64", Version: "< 20180903", Provider: "virtualbox"},
+			want: vagrantBoxRelease{
+				Version:  "20180820.0.0",
+				URL:      "https://vagrantcloud.com/ubuntu/boxes/bionic64/versions/20180820.0.0/providers/virtualbox.box",
+				Checksum: "sha1:943a702d06f34599aee1f8da8ef9f7296031d699",
+			},
+		},
+		"other provider": {
+			box: vagrantBox{Name: "ubuntu/bionic64", Provider: "libvirt"},
+			want: vagrantBoxRelease{
+				Version: "20181001.0.0",
+				URL:     "https://vagrantcloud.com/ubuntu/boxes/bionic64/versions/20181001.0.0/providers/libvirt.box",
+			},
+		},
+		"no matching version": {
+			box:     vagrantBox{Name: "ubuntu/bionic64", Version: ">= 20181105", Provider: "virtualbox"},
+			wantErr: true,
+		},
+		"invalid constraint": {
+			box:     vagrantBox{Name: "ubuntu/bionic64", Version: "latest", Provider: "virtualbox"},
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			tc.box.MetadataURL = metadata
+			got, err := resolveVagrantBox(context.Background(), newTestImageCache(t), tc.box)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("resolveVagrantBox() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if diff := deep.Equal(got, tc.want); diff != nil {
+				t.Errorf("resolveVagrantBox() diff = %v", diff)
+			}
+		})
+	}
+}
+
+func TestResolveVagrantBox_server(t *testing.T) {
+	body, err := os.ReadFile(filepath.Join("testdata", "vagrant", "bionic64.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ubuntu/bionic64" || r.Header.Get("Accept") != "application/json" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(body)
+	}))
+	defer srv.Close()
+	t.Setenv("VAGRANT_SERVER_URL", srv.URL)
+
+	got, err := resolveVagrantBox(context.Background(), newTestImageCache(t), vagrantBox{
+		Name:     "ubuntu/bionic64",
+		Version:  ">= 20180903",
+		Provider: "virtualbox",
+	})
+	if err != nil {
+		t.Fatalf("resolveVagrantBox() = %v", err)
+	}
+	if got.Version != "20180903.0.0" {
+		t.Errorf("resolveVagrantBox() version = %q, want %q", got.Version, "20180903.0.0")
+	}
+}
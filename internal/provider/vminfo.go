@@ -0,0 +1,202 @@
+package provider
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// vmInfo is the machine readable output of "VBoxManage showvminfo", keyed by
+// the property names with the quotes removed.
+type vmInfo map[string]string
+
+// showVMInfo returns the machine readable VM information of the VM id.
+func showVMInfo(ctx context.Context, p *providerMeta, id string) (vmInfo, error) {
+	stdout, stderr, err := p.run(ctx, "showvminfo", id, "--machinereadable")
+	if err != nil {
+		return nil, fmt.Errorf("unable to get VM info of %s: %w: %s", id, err, stderr)
+	}
+	return parseVMInfo(stdout), nil
+}
+
+// parseVMInfo parses the key="value" lines of "VBoxManage showvminfo
+// --machinereadable".
+func parseVMInfo(out string) vmInfo {
+	info := vmInfo{}
+	s := bufio.NewScanner(strings.NewReader(out))
+	for s.Scan() {
+		key, value, ok := strings.Cut(s.Text(), "=")
+		if !ok {
+			continue
+		}
+		if k, err := strconv.Unquote(key); err == nil {
+			key = k
+		}
+		if v, err := strconv.Unquote(value); err == nil {
+			value = v
+		}
+		info[key] = value
+	}
+	return info
+}
+
+// vmStorageController is a storage controller as reported by showvminfo.
+type vmStorageController struct {
+	Name string
+	// Type is the chipset, e.g. IntelAhci or PIIX4.
+	Type string
+	// Ports is the current port count.
+	Ports int
+	// MaxPorts is the maximum port count, 0 if unknown.
+	MaxPorts int
+}
+
+// devicesPerPort returns how many devices can be attached to each port.
+func (c vmStorageController) devicesPerPort() int {
+	return chipsetDevicesPerPort(c.Type)
+}
+
+// storageSlot is a device of a port of a storage controller.
+type storageSlot struct {
+	Controller string
+	Port       int
+	Device     int
+}
+
+// storageController returns the storage controller called name, and false if
+// the VM has no such controller.
+func (info vmInfo) storageController(name string) (vmStorageController, bool) {
+	for i := 0; ; i++ {
+		ctl, ok := info[fmt.Sprintf("storagecontrollername%d", i)]
+		if !ok {
+			return vmStorageController{}, false
+		}
+		if ctl != name {
+			continue
+		}
+		ports, _ := strconv.Atoi(info[fmt.Sprintf("storagecontrollerportcount%d", i)])
+		maxPorts, _ := strconv.Atoi(info[fmt.Sprintf("storagecontrollermaxportcount%d", i)])
+		return vmStorageController{
+			Name:     ctl,
+			Type:     info[fmt.Sprintf("storagecontrollertype%d", i)],
+			Ports:    ports,
+			MaxPorts: maxPorts,
+		}, true
+	}
+}
+
+// medium returns the medium attached to the device at port of the storage
+// controller, empty if there is none.
+func (info vmInfo) medium(controller string, port, device int) string {
+	medium := info[fmt.Sprintf("%s-%d-%d", controller, port, device)]
+	if medium == "none" {
+		return ""
+	}
+	return medium
+}
+
+// slots returns the slots of the current ports of the storage controller.
+func (info vmInfo) slots(controller string) []storageSlot {
+	ctl, ok := info.storageController(controller)
+	if !ok {
+		return nil
+	}
+	var slots []storageSlot
+	for port := 0; port < ctl.Ports; port++ {
+		for device := 0; device < ctl.devicesPerPort(); device++ {
+			slots = append(slots, storageSlot{Controller: controller, Port: port, Device: device})
+		}
+	}
+	return slots
+}
+
+// attachment returns the slot the medium at path is attached to.
+func (info vmInfo) attachment(path string) (storageSlot, bool) {
+	for key, value := range info {
+		if value != path {
+			continue
+		}
+		// Keys are "<controller>-<port>-<device>", the controller name may
+		// contain dashes itself.
+		rest, d, ok := cutLast(key, "-")
+		if !ok {
+			continue
+		}
+		controller, p, ok := cutLast(rest, "-")
+		if !ok {
+			continue
+		}
+		port, err := strconv.Atoi(p)
+		if err != nil {
+			continue
+		}
+		device, err := strconv.Atoi(d)
+		if err != nil {
+			continue
+		}
+		if _, ok := info.storageController(controller); ok {
+			return storageSlot{Controller: controller, Port: port, Device: device}, true
+		}
+	}
+	return storageSlot{}, false
+}
+
+// freeSlot returns the first slot of the storage controller without a
+// medium, which might be beyond its current port count.
+func (info vmInfo) freeSlot(controller string) (storageSlot, error) {
+	ctl, ok := info.storageController(controller)
+	if !ok {
+		return storageSlot{}, fmt.Errorf("storage controller %q does not exist", controller)
+	}
+	for _, slot := range info.slots(controller) {
+		if info.medium(controller, slot.Port, slot.Device) == "" {
+			return slot, nil
+		}
+	}
+	if ctl.MaxPorts > 0 && ctl.Ports >= ctl.MaxPorts {
+		return storageSlot{}, fmt.Errorf("storage controller %q has no free port left", controller)
+	}
+	return storageSlot{Controller: controller, Port: ctl.Ports}, nil
+}
+
+func cutLast(s, sep string) (string, string, bool) {
+	i := strings.LastIndex(s, sep)
+	if i < 0 {
+		return s, "", false
+	}
+	return s[:i], s[i+len(sep):], true
+}
+
+// ensurePort grows the port count of the storage controller so port exists.
+func ensurePort(ctx context.Context, p *providerMeta, info vmInfo, vmID, controller string, port int) error {
+	ctl, ok := info.storageController(controller)
+	if !ok {
+		return fmt.Errorf("storage controller %q does not exist", controller)
+	}
+	if port < ctl.Ports {
+		return nil
+	}
+	if ctl.MaxPorts > 0 && port >= ctl.MaxPorts {
+		return fmt.Errorf("storage controller %q has only %d ports", controller, ctl.MaxPorts)
+	}
+	if _, stderr, err := p.run(ctx, "storagectl", vmID,
+		"--name", controller,
+		"--portcount", strconv.Itoa(port+1),
+	); err != nil {
+		return fmt.Errorf("unable to add ports to storage controller %q: %w: %s", controller, err, stderr)
+	}
+	return nil
+}
+
+// hasSnapshot reports whether the VM has a snapshot with the name, snapshots
+// below the first one have keys like SnapshotName-1-1.
+func (info vmInfo) hasSnapshot(name string) bool {
+	for key, value := range info {
+		if (key == "SnapshotName" || strings.HasPrefix(key, "SnapshotName-")) && value == name {
+			return true
+		}
+	}
+	return false
+}
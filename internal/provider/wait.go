@@ -0,0 +1,241 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/resource"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/validation"
+	vbox "github.com/terra-farm/go-virtualbox"
+)
+
+// waitConditions are the values of wait_for.condition, first_address is the
+// condition used without a wait_for block.
+var waitConditions = []string{"first_address", "any_address", "all_addresses", "guest_property", "tcp_port", "none"}
+
+// How often the readiness of a started VM is checked, and how long a TCP
+// connection attempt may take.
+const (
+	waitPollInterval = time.Second
+	tcpDialTimeout   = 5 * time.Second
+)
+
+// waitForSchema is the schema of the wait_for block of the virtualbox_vm
+// resource.
+func waitForSchema() *schema.Schema {
+	return &schema.Schema{
+		Type:        schema.TypeList,
+		Optional:    true,
+		MaxItems:    1,
+		Description: "Condition the started VM has to meet before it is ready, by default an IPv4 address on the first non-NAT network adapter",
+		Elem: &schema.Resource{
+			Schema: map[string]*schema.Schema{
+				"condition": {
+					Type:             schema.TypeString,
+					Required:         true,
+					Description:      "One of first_address, any_address, all_addresses, guest_property, tcp_port or none",
+					ValidateDiagFunc: validation.ToDiagFunc(validation.StringInSlice(waitConditions, false)),
+				},
+				"guest_property": {
+					Type:        schema.TypeString,
+					Optional:    true,
+					Description: "Guest property the guest_property condition waits for",
+				},
+				"value": {
+					Type:        schema.TypeString,
+					Optional:    true,
+					Description: "Value the guest property has to reach, any value if empty",
+				},
+				"port": {
+					Type:             schema.TypeInt,
+					Optional:         true,
+					Description:      "TCP port the tcp_port condition waits for",
+					ValidateDiagFunc: validation.ToDiagFunc(validation.IsPortNumber),
+				},
+				"host": {
+					Type:        schema.TypeString,
+					Optional:    true,
+					Description: "Host the TCP port is dialed on, defaults to the IPv4 address of the first non-NAT network adapter",
+				},
+			},
+		},
+	}
+}
+
+// waitFor is the wait_for block.
+type waitFor struct {
+	Condition     string
+	GuestProperty string
+	Value         string
+	Port          int
+	Host          string
+}
+
+// expandWaitFor returns the wait_for block, or the first_address condition
+// if there is none.
+func expandWaitFor(v []any) waitFor {
+	w := waitFor{Condition: "first_address"}
+	if len(v) == 0 {
+		return w
+	}
+	m, ok := v[0].(map[string]any)
+	if !ok {
+		return w
+	}
+	if condition, _ := m["condition"].(string); condition != "" {
+		w.Condition = condition
+	}
+	w.GuestProperty, _ = m["guest_property"].(string)
+	w.Value, _ = m["value"].(string)
+	w.Port, _ = m["port"].(int)
+	w.Host, _ = m["host"].(string)
+	return w
+}
+
+// validate checks that the condition has the attributes it needs, the TCP
+// port is dialed on a non-NAT network adapter unless the host is set.
+func (w waitFor) validate(adapters []any) error {
+	switch w.Condition {
+	case "guest_property":
+		if w.GuestProperty == "" {
+			return fmt.Errorf("wait_for.0.guest_property is required for the guest_property condition")
+		}
+	case "tcp_port":
+		if w.Port == 0 {
+			return fmt.Errorf("wait_for.0.port is required for the tcp_port condition")
+		}
+		if _, ok := firstAddress(adapters); w.Host == "" && !ok {
+			return fmt.Errorf("wait_for.0.host is required for the tcp_port condition without a non-NAT network adapter")
+		}
+	}
+	return nil
+}
+
+// firstAddress returns the IPv4 address of the first non-NAT network adapter,
+// which is empty until the guest reports it, and false if there is none.
+func firstAddress(adapters []any) (string, bool) {
+	for _, raw := range adapters {
+		m, ok := raw.(map[string]any)
+		if !ok || m["type"] == "nat" {
+			continue
+		}
+		if m["ipv4_address_available"] != "yes" {
+			return "", true
+		}
+		address, _ := m["ipv4_address"].(string)
+		return address, true
+	}
+	return "", false
+}
+
+// addressesReady reports whether the network adapters meet the address
+// condition. VMs with only NAT adapters meet the first_address condition.
+func addressesReady(condition string, adapters []any) bool {
+	if condition == "first_address" {
+		address, ok := firstAddress(adapters)
+		return !ok || address != ""
+	}
+
+	assigned := 0
+	for _, raw := range adapters {
+		if m, ok := raw.(map[string]any); ok && m["ipv4_address_available"] == "yes" {
+			assigned++
+		}
+	}
+	if condition == "all_addresses" {
+		return len(adapters) > 0 && assigned == len(adapters)
+	}
+	return assigned > 0
+}
+
+// guestPropertyReady reports whether the guest property of the condition is
+// set to its value, or to any value if there is none.
+func guestPropertyReady(ctx context.Context, p *providerMeta, vmID string, w waitFor) (bool, error) {
+	value, ok, err := getGuestProperty(ctx, p, vmID, w.GuestProperty)
+	if err != nil {
+		return false, err
+	}
+	return ok && (w.Value == "" || value == w.Value), nil
+}
+
+// tcpReachable reports whether a TCP connection to the host and port can be
+// established.
+func tcpReachable(ctx context.Context, host string, port int) bool {
+	dialer := &net.Dialer{Timeout: tcpDialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		tflog.Debug(ctx, "TCP port not reachable yet", map[string]any{
+			"host":  host,
+			"port":  port,
+			"error": err.Error(),
+		})
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// vmReady checks the condition once. The network adapters are read back from
+// the guest for all but the guest_property condition.
+func vmReady(ctx context.Context, d *schema.ResourceData, vm *vbox.Machine, w waitFor, meta any) (bool, error) {
+	if w.Condition == "guest_property" {
+		return guestPropertyReady(ctx, meta.(*providerMeta), vm.UUID, w)
+	}
+
+	if diags := resourceVMRead(ctx, d, meta); diags.HasError() {
+		return false, fmt.Errorf("unable to read VM: %s", diags[0].Summary)
+	}
+	adapters := d.Get("network_adapter").([]any)
+	if w.Condition != "tcp_port" {
+		return addressesReady(w.Condition, adapters), nil
+	}
+
+	host := w.Host
+	if host == "" {
+		host, _ = firstAddress(adapters)
+	}
+	return host != "" && tcpReachable(ctx, host, w.Port), nil
+}
+
+// waitUntilVMIsReady waits until the started VM meets the wait_for
+// condition. The wait is only limited by the timeout of the operation.
+func waitUntilVMIsReady(ctx context.Context, d *schema.ResourceData, vm *vbox.Machine, meta any) error {
+	w := expandWaitFor(d.Get("wait_for").([]any))
+	if w.Condition == "none" {
+		return nil
+	}
+	tflog.Debug(ctx, "waiting for VM to become ready", map[string]any{
+		"vm":        d.Get("name"),
+		"condition": w.Condition,
+	})
+
+	timeout := defaultReadTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	stateConf := &resource.StateChangeConf{
+		Pending: []string{"waiting"},
+		Target:  []string{"ready"},
+		Refresh: func() (any, string, error) {
+			ready, err := vmReady(ctx, d, vm, w, meta)
+			if err != nil {
+				return nil, "", err
+			}
+			if ready {
+				return w, "ready", nil
+			}
+			return w, "waiting", nil
+		},
+		Timeout:      timeout,
+		PollInterval: waitPollInterval,
+	}
+	if _, err := stateConf.WaitForStateContext(ctx); err != nil {
+		return fmt.Errorf("waiting for VM (%s) to become ready: %w", d.Get("name"), err)
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package provider
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+func TestExpandWaitFor(t *testing.T) {
+	testCases := map[string]struct {
+		v    []any
+		want waitFor
+	}{
+		"no block": {
+			want: waitFor{Condition: "first_address"},
+		},
+		"guest property": {
+			v: []any{map[string]any{
+				"condition":      "guest_property",
+				"guest_property": "/VirtualBox/GuestInfo/OS/LoggedInUsers",
+				"value":          "1",
+				"port":           0,
+				"host":           "",
+			}},
+			want: waitFor{Condition: "guest_property", GuestProperty: "/VirtualBox/GuestInfo/OS/LoggedInUsers", Value: "1"},
+		},
+		"tcp port": {
+			v:    []any{map[string]any{"condition": "tcp_port", "port": 22, "host": "192.168.56.10"}},
+			want: waitFor{Condition: "tcp_port", Port: 22, Host: "192.168.56.10"},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			if diff := deep.Equal(expandWaitFor(tc.v), tc.want); diff != nil {
+				t.Errorf("expandWaitFor() diff = %v", diff)
+			}
+		})
+	}
+}
+
+func TestWaitForValidate(t *testing.T) {
+	natOnly := []any{map[string]any{"type": "nat"}}
+	hostOnly := []any{map[string]any{"type": "nat"}, map[string]any{"type": "hostonly"}}
+
+	testCases := map[string]struct {
+		w        waitFor
+		adapters []any
+		wantErr  bool
+	}{
+		"first address": {
+			w:        waitFor{Condition: "first_address"},
+			adapters: natOnly,
+		},
+		"guest property": {
+			w: waitFor{Condition: "guest_property", GuestProperty: "/VirtualBox/GuestInfo/OS/LoggedInUsers"},
+		},
+		"guest property without name": {
+			w:       waitFor{Condition: "guest_property"},
+			wantErr: true,
+		},
+		"tcp port": {
+			w:        waitFor{Condition: "tcp_port", Port: 22},
+			adapters: hostOnly,
+		},
+		"tcp port without port": {
+			w:        waitFor{Condition: "tcp_port"},
+			adapters: hostOnly,
+			wantErr:  true,
+		},
+		"tcp port with nat only": {
+			w:        waitFor{Condition: "tcp_port", Port: 22},
+			adapters: natOnly,
+			wantErr:  true,
+		},
+		"tcp port with host": {
+			w:        waitFor{Condition: "tcp_port", Port: 2222, Host: "127.0.0.1"},
+			adapters: natOnly,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			if err := tc.w.validate(tc.adapters); (err != nil) != tc.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestAddressesReady(t *testing.T) {
+	adapter := func(typ string, address string) any {
+		available := "no"
+		if address != "" {
+			available = "yes"
+		}
+		return map[string]any{"type": typ, "ipv4_address": address, "ipv4_address_available": available}
+	}
+	natOnly := []any{adapter("nat", "10.0.2.15")}
+	waiting := []any{adapter("nat", "10.0.2.15"), adapter("hostonly", "")}
+	partial := []any{adapter("nat", ""), adapter("hostonly", "192.168.56.10")}
+	assigned := []any{adapter("nat", "10.0.2.15"), adapter("hostonly", "192.168.56.10")}
+
+	testCases := []struct {
+		condition string
+		adapters  []any
+		want      bool
+	}{
+		{"first_address", natOnly, true},
+		{"first_address", waiting, false},
+		{"first_address", partial, true},
+		{"any_address", nil, false},
+		{"any_address", waiting, true},
+		{"any_address", []any{adapter("nat", "")}, false},
+		{"all_addresses", nil, false},
+		{"all_addresses", waiting, false},
+		{"all_addresses", partial, false},
+		{"all_addresses", assigned, true},
+	}
+
+	for _, tc := range testCases {
+		if got := addressesReady(tc.condition, tc.adapters); got != tc.want {
+			t.Errorf("addressesReady(%q, %v) = %v, want %v", tc.condition, tc.adapters, got, tc.want)
+		}
+	}
+}
+
+func TestGuestPropertyReady(t *testing.T) {
+	testCases := map[string]struct {
+		output string
+		value  string
+		want   bool
+	}{
+		"not set":       {output: "No value set!\n", want: false},
+		"any value":     {output: "Value: 0\n", want: true},
+		"value reached": {output: "Value: 1\n", value: "1", want: true},
+		"other value":   {output: "Value: 0\n", value: "1", want: false},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			fake := &fakeVBoxManage{outputs: map[string]string{"guestproperty": tc.output}}
+			p := &providerMeta{run: fake.run}
+
+			w := waitFor{Condition: "guest_property", GuestProperty: "/VirtualBox/GuestInfo/OS/LoggedInUsers", Value: tc.value}
+			got, err := guestPropertyReady(context.Background(), p, "vm", w)
+			if err != nil {
+				t.Fatalf("guestPropertyReady() = %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("guestPropertyReady() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestTCPReachable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() = %v", err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+
+	if !tcpReachable(context.Background(), "127.0.0.1", port) {
+		t.Errorf("tcpReachable() = false with a listener")
+	}
+	l.Close()
+	if tcpReachable(context.Background(), "127.0.0.1", port) {
+		t.Errorf("tcpReachable() = true without a listener")
+	}
+}